@@ -0,0 +1,150 @@
+// this package keeps the instagram accounts chats post to
+package account
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/nuxdie/instabot/vault"
+)
+
+const keyPrefix = "account:"
+
+// Default is the chat ID of the account of chats that didn't connect one
+const Default int64 = 0
+
+var ErrNotFound = errors.New("no instagram account connected")
+var ErrNoVault = errors.New("instagram passwords can't be kept without a vault key")
+
+// Account is the instagram account a chat connected with /connect
+type Account struct {
+	ChatId      int64
+	Username    string
+	ConnectedAt time.Time
+}
+
+// Store keeps an account per chat in a redis hash named after the chat ID,
+// so the telegram bot can connect accounts and the instagram worker can
+// post with them. Passwords are kept in the vault, sealed.
+type Store struct {
+	redis *redis.Client
+	vault *vault.Vault
+}
+
+// NewStore returns a store that can't keep passwords when vault is nil
+func NewStore(client *redis.Client, vault *vault.Vault) *Store {
+	return &Store{
+		redis: client,
+		vault: vault,
+	}
+}
+
+func key(chatId int64) string {
+	return keyPrefix + strconv.FormatInt(chatId, 10)
+}
+
+// Get returns ErrNotFound for chats that didn't connect an account
+func (store *Store) Get(chatId int64) (Account, error) {
+	fields, err := store.redis.HGetAll(key(chatId)).Result()
+
+	if err != nil {
+		return Account{}, err
+	}
+
+	if fields["username"] == "" {
+		return Account{}, ErrNotFound
+	}
+
+	if fields["password"] != "" && store.vault != nil {
+		err = store.sealPassword(chatId, fields["password"])
+
+		if err != nil {
+			return Account{}, err
+		}
+	}
+
+	connectedAt, _ := strconv.ParseInt(fields["connected_at"], 10, 64)
+
+	return Account{
+		ChatId:      chatId,
+		Username:    fields["username"],
+		ConnectedAt: time.Unix(connectedAt, 0),
+	}, nil
+}
+
+// sealPassword moves a password accounts used to keep in their hash into the
+// vault
+func (store *Store) sealPassword(chatId int64, password string) error {
+	err := store.vault.Put(key(chatId), []byte(password))
+
+	if err != nil {
+		return err
+	}
+
+	return store.redis.HDel(key(chatId), "password").Err()
+}
+
+// CanConnect tells whether accounts can be connected, which takes a vault
+func (store *Store) CanConnect() bool {
+	return store.vault != nil
+}
+
+// Put connects account to its chat, replacing the one it had along with its
+// session. The password goes first, an account is never there without one.
+func (store *Store) Put(account Account, password []byte) error {
+	if store.vault == nil {
+		return ErrNoVault
+	}
+
+	err := store.vault.Put(key(account.ChatId), password)
+
+	if err != nil {
+		return err
+	}
+
+	err = store.vault.Delete(sessionKey(account.ChatId))
+
+	if err != nil {
+		return err
+	}
+
+	_, err = store.redis.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.Del(key(account.ChatId))
+		pipe.HMSet(key(account.ChatId), map[string]interface{}{
+			"username":     account.Username,
+			"connected_at": account.ConnectedAt.Unix(),
+		})
+
+		return nil
+	})
+
+	return err
+}
+
+// Delete disconnects the account of a chat and forgets its password and
+// session, ErrNotFound if it had none
+func (store *Store) Delete(chatId int64) error {
+	deleted, err := store.redis.Del(key(chatId)).Result()
+
+	if err != nil {
+		return err
+	}
+
+	if deleted == 0 {
+		return ErrNotFound
+	}
+
+	if store.vault == nil {
+		return nil
+	}
+
+	err = store.vault.Delete(sessionKey(chatId))
+
+	if err != nil {
+		return err
+	}
+
+	return store.vault.Delete(key(chatId))
+}
@@ -0,0 +1,57 @@
+package account
+
+import (
+	"github.com/ahmdrz/goinsta"
+)
+
+// Login starts a new instagram session of account with the password from
+// the vault, on the device of its last session when there is one. goinsta
+// keeps its own copy of the password for as long as the session lives.
+func (store *Store) Login(account Account) (*goinsta.Instagram, error) {
+	if store.vault == nil {
+		return nil, ErrNoVault
+	}
+
+	device, err := store.session(account)
+
+	if err != nil && err != ErrNoSession {
+		return nil, err
+	}
+
+	var insta *goinsta.Instagram
+
+	err = store.vault.Open(key(account.ChatId), func(password []byte) error {
+		var err error
+		insta, err = login(account.Username, string(password), device)
+
+		return err
+	})
+
+	return insta, err
+}
+
+// Verify tells whether instagram takes the credentials by logging in on a
+// new device. The session is worth saving, instagram is wary of accounts
+// that log in from new devices all the time.
+func Verify(username, password string) (*goinsta.Instagram, error) {
+	return login(username, password, session{})
+}
+
+// login logs in on the device of last, or on a new one when it's empty
+func login(username, password string, last session) (*goinsta.Instagram, error) {
+	insta := goinsta.New(username, password)
+
+	if last.DeviceId != "" {
+		insta.Informations.DeviceID = last.DeviceId
+		insta.Informations.UUID = last.Uuid
+		insta.Informations.PhoneID = last.PhoneId
+	}
+
+	err := insta.Login()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return insta, nil
+}
@@ -0,0 +1,137 @@
+package account
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/ahmdrz/goinsta"
+	"github.com/nuxdie/instabot/vault"
+)
+
+// Sessions are sealed in the vault next to the passwords, their cookies let
+// anyone post as the account. Instagram ties a session to the device that
+// logged in, a login reuses the device of the last session.
+const sessionKeyPrefix = "session:"
+
+// instagram sets its cookies for the whole domain, the jar only hands out
+// their names and values
+const cookieDomain = ".instagram.com"
+
+var ErrNoSession = errors.New("no instagram session saved")
+
+var apiUrl, _ = url.Parse(goinsta.GOINSTA_API_URL)
+
+// session is what's kept of a login to make requests with it again
+type session struct {
+	Username  string            `json:"username"`
+	UserId    int64             `json:"user_id"`
+	DeviceId  string            `json:"device_id"`
+	Uuid      string            `json:"uuid"`
+	PhoneId   string            `json:"phone_id"`
+	RankToken string            `json:"rank_token"`
+	Token     string            `json:"token"`
+	Cookies   map[string]string `json:"cookies"`
+}
+
+func sessionKey(chatId int64) string {
+	return sessionKeyPrefix + strconv.FormatInt(chatId, 10)
+}
+
+// Session restores the last saved session of account, ErrNoSession when
+// there's none. Whether instagram still takes it shows on the first request.
+func (store *Store) Session(account Account) (*goinsta.Instagram, error) {
+	saved, err := store.session(account)
+
+	if err != nil {
+		return nil, err
+	}
+
+	insta := goinsta.New(account.Username, "")
+	insta.Informations.DeviceID = saved.DeviceId
+	insta.Informations.UUID = saved.Uuid
+	insta.Informations.PhoneID = saved.PhoneId
+	insta.Informations.RankToken = saved.RankToken
+	insta.Informations.Token = saved.Token
+	insta.LoggedInUser.ID = saved.UserId
+	insta.LoggedInUser.Username = saved.Username
+	insta.IsLoggedIn = true
+
+	cookies := make([]*http.Cookie, 0, len(saved.Cookies))
+
+	for name, value := range saved.Cookies {
+		cookies = append(cookies, &http.Cookie{
+			Name:   name,
+			Value:  value,
+			Domain: cookieDomain,
+			Path:   "/",
+		})
+	}
+
+	err = insta.SetCookies(apiUrl, cookies)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return insta, nil
+}
+
+// SaveSession keeps the session of account for later requests, replacing
+// the one saved before
+func (store *Store) SaveSession(account Account, insta *goinsta.Instagram) error {
+	if store.vault == nil {
+		return ErrNoVault
+	}
+
+	saved := session{
+		Username:  account.Username,
+		UserId:    insta.LoggedInUser.ID,
+		DeviceId:  insta.Informations.DeviceID,
+		Uuid:      insta.Informations.UUID,
+		PhoneId:   insta.Informations.PhoneID,
+		RankToken: insta.Informations.RankToken,
+		Token:     insta.Informations.Token,
+		Cookies:   make(map[string]string),
+	}
+
+	for _, cookie := range insta.GetSessions(apiUrl) {
+		saved.Cookies[cookie.Name] = cookie.Value
+	}
+
+	plain, err := json.Marshal(saved)
+
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		for i := range plain {
+			plain[i] = 0
+		}
+	}()
+
+	return store.vault.Put(sessionKey(account.ChatId), plain)
+}
+
+// session reads the saved session of account. A session of an account the
+// chat connected before doesn't count.
+func (store *Store) session(account Account) (session, error) {
+	var saved session
+
+	if store.vault == nil {
+		return saved, ErrNoVault
+	}
+
+	err := store.vault.Open(sessionKey(account.ChatId), func(plain []byte) error {
+		return json.Unmarshal(plain, &saved)
+	})
+
+	if err == vault.ErrNotFound || (err == nil && saved.Username != account.Username) {
+		return session{}, ErrNoSession
+	}
+
+	return saved, err
+}
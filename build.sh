@@ -9,4 +9,7 @@ do
   cd ..
 done
 
+# scratch images have no time zone database
+cp "$(go env GOROOT)/lib/time/zoneinfo.zip" telegram/
+
 #cp key.json hashtag/
\ No newline at end of file
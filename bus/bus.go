@@ -0,0 +1,507 @@
+// this package carries metadata.ChannelMessage between services over a Redis Stream
+package bus
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/nuxdie/instabot/lanes"
+	"github.com/nuxdie/instabot/logging"
+	"github.com/nuxdie/instabot/metadata"
+	"github.com/nuxdie/instabot/metrics"
+	"github.com/nuxdie/instabot/shutdown"
+)
+
+const payloadField = "message"
+const deadSuffix = ":dead"
+
+// Handler processes a single message. The entry is acknowledged only when
+// it returns nil, otherwise it stays pending and is delivered again later.
+// Handlers for the same photo run one at a time, in stream order.
+type Handler func(message metadata.ChannelMessage) error
+
+// Processor is implemented by *redis.Client, *redis.Tx and redis.Pipeliner
+type Processor interface {
+	Process(cmd redis.Cmder) error
+}
+
+type Config struct {
+	Stream        string        // stream key shared by every service
+	Group         string        // consumer group, one per service
+	Consumer      string        // consumer name, unique per running process
+	Block         time.Duration // must stay below redis client ReadTimeout
+	Count         int64         // max entries per read
+	ClaimIdle     time.Duration // pending entries idle for longer are reclaimed
+	MaxDeliveries int64         // deliveries before an entry goes to the dead stream
+	MaxLen        int64         // approximate stream length cap, 0 means unbounded
+	Handlers      int           // max handlers running at once
+}
+
+type Bus struct {
+	lastPoll int64 // unix ns of the last read attempt, accessed atomically
+	lastRead int64 // unix ns of the last successful read, accessed atomically
+	redis    *redis.Client
+	config   Config
+	stop     chan struct{}
+	once     sync.Once
+	handlers sync.WaitGroup
+	pool     *lanes.Pool
+	lock     sync.Mutex
+	active   map[string]bool // IDs of entries queued or running
+}
+
+func New(client *redis.Client, config Config) *Bus {
+	if config.Consumer == "" {
+		config.Consumer, _ = os.Hostname()
+	}
+
+	if config.Block == 0 {
+		config.Block = time.Second * 2
+	}
+
+	if config.Count == 0 {
+		config.Count = 10
+	}
+
+	if config.ClaimIdle == 0 {
+		config.ClaimIdle = time.Minute
+	}
+
+	if config.MaxDeliveries == 0 {
+		config.MaxDeliveries = 5
+	}
+
+	if config.Handlers == 0 {
+		config.Handlers = 4
+	}
+
+	return &Bus{
+		redis:  client,
+		config: config,
+		stop:   make(chan struct{}),
+		pool:   lanes.New(config.Handlers, int(config.Count)),
+		active: make(map[string]bool),
+	}
+}
+
+// Publish appends message to the stream and returns the entry ID
+func (bus *Bus) Publish(message metadata.ChannelMessage) (string, error) {
+	cmd, err := bus.Add(bus.redis, message)
+
+	if err != nil {
+		return "", err
+	}
+
+	return cmd.Result()
+}
+
+// Add queues XADD on pipe, so a message can be published in the same
+// MULTI/EXEC as the photo fields it refers to
+func (bus *Bus) Add(pipe Processor, message metadata.ChannelMessage) (*redis.StringCmd, error) {
+	payload, err := json.Marshal(&message)
+
+	if err != nil {
+		log.Printf("[ERROR] Couldn't encode JSON: %s", err)
+		return nil, err
+	}
+
+	args := []interface{}{"xadd", bus.config.Stream}
+
+	if bus.config.MaxLen > 0 {
+		args = append(args, "maxlen", "~", bus.config.MaxLen)
+	}
+
+	args = append(args, "*", payloadField, payload)
+
+	cmd := redis.NewStringCmd(args...)
+	pipe.Process(cmd)
+
+	return cmd, nil
+}
+
+// Outbox satisfies metadata.Outbox, so stores publish through the bus
+func (bus *Bus) Outbox(pipe redis.Pipeliner, message metadata.ChannelMessage) error {
+	_, err := bus.Add(pipe, message)
+	return err
+}
+
+// Subscribe creates the consumer group if needed and feeds every entry to
+// handler until Close is called. Entries left pending by this consumer
+// before a restart are processed first. Reading stalls while handlers are
+// busy and their queues are full. Handlers may still be running when it
+// returns, see Wait.
+func (bus *Bus) Subscribe(handler Handler) error {
+	err := bus.createGroup()
+
+	if err != nil {
+		return err
+	}
+
+	defer bus.pool.Close()
+
+	log.Printf("[INFO] subscribed to redis stream %s as %s/%s",
+		bus.config.Stream, bus.config.Group, bus.config.Consumer)
+
+	err = bus.read("0", handler)
+
+	if err != nil {
+		log.Printf("[ERROR] Couldn't read own pending entries from %s: %s",
+			bus.config.Stream, err)
+	}
+
+	lastClaim := time.Now()
+
+	for {
+		select {
+		case <-bus.stop:
+			return nil
+		default:
+		}
+
+		if time.Since(lastClaim) > bus.config.ClaimIdle/2 {
+			bus.claim(handler)
+			lastClaim = time.Now()
+		}
+
+		err := bus.read(">", handler)
+		bus.touch(&bus.lastPoll)
+
+		if err == nil || err == redis.Nil {
+			bus.touch(&bus.lastRead)
+		} else {
+			log.Printf("[ERROR] Couldn't read from redis stream %s: %s",
+				bus.config.Stream, err)
+			time.Sleep(bus.config.Block)
+		}
+	}
+}
+
+// Alive fails when the subscription loop stopped or got stuck
+func (bus *Bus) Alive() error {
+	return bus.fresh("read attempt", &bus.lastPoll)
+}
+
+// Ready fails when the subscription couldn't read from redis lately
+func (bus *Bus) Ready() error {
+	return bus.fresh("successful read", &bus.lastRead)
+}
+
+func (bus *Bus) touch(at *int64) {
+	atomic.StoreInt64(at, time.Now().UnixNano())
+}
+
+// fresh fails unless at was touched within a few read timeouts
+func (bus *Bus) fresh(what string, at *int64) error {
+	last := atomic.LoadInt64(at)
+
+	if last == 0 {
+		return fmt.Errorf("no %s from %s yet", what, bus.config.Stream)
+	}
+
+	if age := time.Since(time.Unix(0, last)); age > bus.config.Block*5 {
+		return fmt.Errorf("last %s from %s was %s ago", what, bus.config.Stream,
+			age.Truncate(time.Millisecond))
+	}
+
+	return nil
+}
+
+// Close stops Subscribe after the read in progress, at most Block later
+func (bus *Bus) Close() {
+	bus.once.Do(func() {
+		close(bus.stop)
+	})
+}
+
+// Wait waits for running handlers once Subscribe returned, false means some
+// are still running after timeout
+func (bus *Bus) Wait(timeout time.Duration) bool {
+	return shutdown.Wait(&bus.handlers, timeout)
+}
+
+// Unsubscribe removes the consumer from the group once Subscribe returned,
+// so every deploy doesn't leave another one behind. A consumer that still
+// has pending entries is kept, they'd be lost otherwise; other consumers
+// claim them after ClaimIdle.
+func (bus *Bus) Unsubscribe() error {
+	pending := redis.NewSliceCmd("xpending", bus.config.Stream, bus.config.Group,
+		"-", "+", 1, bus.config.Consumer)
+	err := bus.redis.Process(pending)
+
+	if err != nil {
+		log.Printf("[ERROR] Couldn't list pending entries of %s: %s", bus.config.Consumer, err)
+		return err
+	}
+
+	if len(pending.Val()) > 0 {
+		log.Printf("[WARN] Consumer %s still has pending entries, keeping it in %s",
+			bus.config.Consumer, bus.config.Group)
+		return nil
+	}
+
+	err = bus.redis.Process(redis.NewIntCmd("xgroup", "delconsumer", bus.config.Stream,
+		bus.config.Group, bus.config.Consumer))
+
+	if err != nil {
+		log.Printf("[ERROR] Couldn't remove consumer %s from %s: %s",
+			bus.config.Consumer, bus.config.Group, err)
+		return err
+	}
+
+	log.Printf("[INFO] unsubscribed %s/%s from redis stream %s",
+		bus.config.Group, bus.config.Consumer, bus.config.Stream)
+
+	return nil
+}
+
+func (bus *Bus) Ack(ids ...string) error {
+	args := []interface{}{"xack", bus.config.Stream, bus.config.Group}
+
+	for _, id := range ids {
+		args = append(args, id)
+	}
+
+	return bus.redis.Process(redis.NewIntCmd(args...))
+}
+
+func (bus *Bus) createGroup() error {
+	cmd := redis.NewStatusCmd("xgroup", "create", bus.config.Stream, bus.config.Group,
+		"$", "mkstream")
+	err := bus.redis.Process(cmd)
+
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		log.Printf("[ERROR] Couldn't create consumer group %s on %s: %s",
+			bus.config.Group, bus.config.Stream, err)
+		return err
+	}
+
+	return nil
+}
+
+// read fetches entries starting after id. ">" means new entries, "0" means
+// entries already delivered to this consumer but never acknowledged.
+func (bus *Bus) read(id string, handler Handler) error {
+	cmd := redis.NewSliceCmd("xreadgroup", "group", bus.config.Group, bus.config.Consumer,
+		"count", bus.config.Count, "block", int64(bus.config.Block/time.Millisecond),
+		"streams", bus.config.Stream, id)
+	err := bus.redis.Process(cmd)
+
+	if err != nil {
+		return err
+	}
+
+	for _, stream := range cmd.Val() {
+		fields, ok := stream.([]interface{})
+
+		if !ok || len(fields) != 2 {
+			return fmt.Errorf("unexpected xreadgroup reply %v", stream)
+		}
+
+		entries, _ := fields[1].([]interface{})
+		bus.dispatch(entries, handler)
+	}
+
+	return nil
+}
+
+// claim takes over entries that stayed pending for too long, most likely
+// because their consumer died. Entries delivered too many times are moved to
+// the dead stream instead of being handled again.
+func (bus *Bus) claim(handler Handler) {
+	pending := redis.NewSliceCmd("xpending", bus.config.Stream, bus.config.Group,
+		"-", "+", bus.config.Count*10)
+	err := bus.redis.Process(pending)
+
+	if err != nil {
+		log.Printf("[ERROR] Couldn't list pending entries of %s: %s", bus.config.Stream, err)
+		return
+	}
+
+	var ids []interface{}
+
+	for _, item := range pending.Val() {
+		info, ok := item.([]interface{})
+
+		if !ok || len(info) != 4 {
+			continue
+		}
+
+		id, _ := info[0].(string)
+		idle, _ := info[2].(int64)
+		deliveries, _ := info[3].(int64)
+
+		// still queued or running here, not abandoned
+		if bus.busy(id) {
+			continue
+		}
+
+		if time.Duration(idle)*time.Millisecond < bus.config.ClaimIdle {
+			continue
+		}
+
+		if deliveries >= bus.config.MaxDeliveries {
+			bus.bury(id, deliveries)
+			continue
+		}
+
+		ids = append(ids, id)
+	}
+
+	if len(ids) == 0 {
+		return
+	}
+
+	args := []interface{}{"xclaim", bus.config.Stream, bus.config.Group, bus.config.Consumer,
+		int64(bus.config.ClaimIdle / time.Millisecond)}
+	args = append(args, ids...)
+
+	cmd := redis.NewSliceCmd(args...)
+	err = bus.redis.Process(cmd)
+
+	if err != nil {
+		log.Printf("[ERROR] Couldn't claim pending entries of %s: %s", bus.config.Stream, err)
+		return
+	}
+
+	log.Printf("[INFO] Claimed %d stale entries from %s", len(cmd.Val()), bus.config.Stream)
+
+	bus.dispatch(cmd.Val(), handler)
+}
+
+// bury copies the entry to the dead stream and acknowledges it
+func (bus *Bus) bury(id string, deliveries int64) {
+	cmd := redis.NewSliceCmd("xrange", bus.config.Stream, id, id)
+	err := bus.redis.Process(cmd)
+
+	if err != nil {
+		log.Printf("[ERROR] Couldn't read entry %s from %s: %s", id, bus.config.Stream, err)
+		return
+	}
+
+	payload := ""
+
+	if len(cmd.Val()) == 1 {
+		_, payload = parseEntry(cmd.Val()[0])
+	}
+
+	log.Printf("[WARN] Entry %s was delivered %d times, moving to %s: %s",
+		id, deliveries, bus.config.Stream+deadSuffix, payload)
+
+	_, err = bus.redis.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.Process(redis.NewStringCmd("xadd", bus.config.Stream+deadSuffix, "*",
+			"id", id, "group", bus.config.Group, "deliveries", deliveries, payloadField, payload))
+		pipe.Process(redis.NewIntCmd("xack", bus.config.Stream, bus.config.Group, id))
+		return nil
+	})
+
+	if err != nil {
+		log.Printf("[ERROR] Couldn't move entry %s to %s: %s",
+			id, bus.config.Stream+deadSuffix, err)
+	}
+}
+
+func (bus *Bus) dispatch(entries []interface{}, handler Handler) {
+	for _, entry := range entries {
+		id, payload := parseEntry(entry)
+
+		if id == "" {
+			continue
+		}
+
+		var message metadata.ChannelMessage
+		err := json.Unmarshal([]byte(payload), &message)
+
+		if err != nil {
+			log.Printf("[ERROR] Couldn't decode JSON message %s, dropping it: %s", id, payload)
+			bus.Ack(id)
+			continue
+		}
+
+		if bus.busy(id) {
+			continue
+		}
+
+		metrics.Messages.WithLabelValues(bus.config.Group, message.Type).Inc()
+		bus.handlers.Add(1)
+		bus.setBusy(id, true)
+
+		queued := bus.pool.Submit(bus.stop, message.PhotoId, bus.handle(id, message, handler))
+
+		if !queued {
+			// closing, the entry stays pending for whoever reads next
+			bus.setBusy(id, false)
+			bus.handlers.Done()
+		}
+	}
+}
+
+func (bus *Bus) busy(id string) bool {
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+
+	return bus.active[id]
+}
+
+func (bus *Bus) setBusy(id string, busy bool) {
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+
+	if busy {
+		bus.active[id] = true
+	} else {
+		delete(bus.active, id)
+	}
+}
+
+func (bus *Bus) handle(id string, message metadata.ChannelMessage, handler Handler) func() {
+	return func() {
+		defer bus.handlers.Done()
+		defer bus.setBusy(id, false)
+
+		inFlight := metrics.InFlight.WithLabelValues(bus.config.Group)
+		inFlight.Inc()
+		defer inFlight.Dec()
+
+		err := handler(message)
+
+		if err != nil {
+			logging.ForMessage(message).Printf("[WARN] Leaving entry %s pending: %s", id, err)
+			return
+		}
+
+		err = bus.Ack(id)
+
+		if err != nil {
+			logging.ForMessage(message).Printf("[ERROR] Couldn't ack entry %s: %s", id, err)
+		}
+	}
+}
+
+// parseEntry turns a [id, [field, value, ...]] reply into id and payload.
+// A deleted entry comes back with nil fields.
+func parseEntry(entry interface{}) (string, string) {
+	parts, ok := entry.([]interface{})
+
+	if !ok || len(parts) != 2 {
+		return "", ""
+	}
+
+	id, _ := parts[0].(string)
+	fields, _ := parts[1].([]interface{})
+
+	for i := 0; i+1 < len(fields); i += 2 {
+		if fields[i] == payloadField {
+			payload, _ := fields[i+1].(string)
+			return id, payload
+		}
+	}
+
+	return id, ""
+}
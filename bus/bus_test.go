@@ -0,0 +1,272 @@
+package bus
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/nuxdie/instabot/metadata"
+)
+
+const testGroup = "test"
+
+// testBus connects to the redis in TEST_REDIS_ADDR, the tests are skipped
+// without one. The stream test:bus:<name> and its dead stream are removed
+// first.
+func testBus(t *testing.T, name string, config Config) *Bus {
+	addr := os.Getenv("TEST_REDIS_ADDR")
+
+	if addr == "" {
+		t.Skip("TEST_REDIS_ADDR isn't set")
+	}
+
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	config.Stream = "test:bus:" + name
+	config.Group = testGroup
+	config.Block = 50 * time.Millisecond
+
+	client.Del(config.Stream, config.Stream+deadSuffix)
+
+	bus := New(client, config)
+
+	err := bus.createGroup()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return bus
+}
+
+// subscribe runs Subscribe until the returned func is called, which waits
+// for it and its handlers to finish
+func subscribe(t *testing.T, bus *Bus, handler Handler) func() {
+	done := make(chan error, 1)
+
+	go func() {
+		done <- bus.Subscribe(handler)
+	}()
+
+	return func() {
+		bus.Close()
+
+		if err := <-done; err != nil {
+			t.Errorf("Subscribe failed: %s", err)
+		}
+
+		if !bus.Wait(time.Second) {
+			t.Errorf("handlers didn't finish")
+		}
+	}
+}
+
+// pending counts the entries of the group that weren't acknowledged
+func pending(t *testing.T, bus *Bus) int {
+	cmd := redis.NewSliceCmd("xpending", bus.config.Stream, bus.config.Group, "-", "+", 100)
+	err := bus.redis.Process(cmd)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return len(cmd.Val())
+}
+
+// buried counts the entries of the dead stream
+func buried(bus *Bus) int {
+	cmd := redis.NewIntCmd("xlen", bus.config.Stream+deadSuffix)
+	bus.redis.Process(cmd)
+
+	return int(cmd.Val())
+}
+
+// waitFor polls condition for a second
+func waitFor(condition func() bool) bool {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); {
+		if condition() {
+			return true
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return condition()
+}
+
+// handled records the messages a handler got
+type handled struct {
+	lock     sync.Mutex
+	messages []metadata.ChannelMessage
+}
+
+func (handled *handled) handler(err error) Handler {
+	return func(message metadata.ChannelMessage) error {
+		handled.lock.Lock()
+		defer handled.lock.Unlock()
+
+		handled.messages = append(handled.messages, message)
+
+		return err
+	}
+}
+
+func (handled *handled) count() int {
+	handled.lock.Lock()
+	defer handled.lock.Unlock()
+
+	return len(handled.messages)
+}
+
+func TestSubscribeAck(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		pending int
+	}{
+		{"handled", nil, 0},
+		{"failed", errors.New("stage failed"), 1},
+	}
+
+	for _, test := range tests {
+		bus := testBus(t, "ack", Config{})
+		got := &handled{}
+		stop := subscribe(t, bus, got.handler(test.err))
+
+		_, err := bus.Publish(metadata.ChannelMessage{Type: "DONE", PhotoId: "photo"})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !waitFor(func() bool { return got.count() == 1 }) {
+			t.Errorf("%s: handler got %d messages, want 1", test.name, got.count())
+		}
+
+		stop()
+
+		if got.count() == 1 && got.messages[0].PhotoId != "photo" {
+			t.Errorf("%s: handler got %v", test.name, got.messages[0])
+		}
+
+		if count := pending(t, bus); count != test.pending {
+			t.Errorf("%s: %d entries pending, want %d", test.name, count, test.pending)
+		}
+	}
+}
+
+// entries a consumer left pending are handled when it subscribes again
+func TestSubscribeOwnPending(t *testing.T) {
+	bus := testBus(t, "own", Config{Consumer: "restarted"})
+	bus.Publish(metadata.ChannelMessage{Type: "DONE", PhotoId: "photo"})
+
+	// delivered before the restart, never acknowledged
+	err := bus.read(">", func(message metadata.ChannelMessage) error {
+		return errors.New("crashed")
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bus.Wait(time.Second)
+
+	got := &handled{}
+	stop := subscribe(t, bus, got.handler(nil))
+
+	waitFor(func() bool { return got.count() == 1 })
+	stop()
+
+	if got.count() != 1 || pending(t, bus) != 0 {
+		t.Errorf("handled %d messages, %d pending, want 1 and 0", got.count(), pending(t, bus))
+	}
+}
+
+// entries of a dead consumer are claimed once they're idle for ClaimIdle,
+// or moved to the dead stream once they were delivered MaxDeliveries times
+func TestClaim(t *testing.T) {
+	tests := []struct {
+		name          string
+		maxDeliveries int64
+		handled       int
+		dead          int
+	}{
+		{"claimed", 2, 1, 0},
+		{"buried", 1, 0, 1},
+	}
+
+	for _, test := range tests {
+		bus := testBus(t, "claim", Config{
+			Consumer:      "alive",
+			ClaimIdle:     100 * time.Millisecond,
+			MaxDeliveries: test.maxDeliveries,
+		})
+		bus.Publish(metadata.ChannelMessage{Type: "DONE", PhotoId: "photo"})
+
+		// delivered to a consumer that died before acknowledging it
+		cmd := redis.NewSliceCmd("xreadgroup", "group", testGroup, "dead", "count", 1,
+			"streams", bus.config.Stream, ">")
+
+		if err := bus.redis.Process(cmd); err != nil {
+			t.Fatal(err)
+		}
+
+		time.Sleep(bus.config.ClaimIdle)
+
+		got := &handled{}
+		stop := subscribe(t, bus, got.handler(nil))
+
+		waitFor(func() bool { return got.count()+buried(bus) == 1 })
+		stop()
+
+		if got.count() != test.handled || buried(bus) != test.dead || pending(t, bus) != 0 {
+			t.Errorf("%s: handled %d, buried %d, %d pending, want %d, %d and 0", test.name,
+				got.count(), buried(bus), pending(t, bus), test.handled, test.dead)
+		}
+	}
+}
+
+// messages of the same photo are handled one at a time, in stream order
+func TestSubscribeOrder(t *testing.T) {
+	bus := testBus(t, "order", Config{Handlers: 4})
+
+	for _, messageType := range []string{"NEW", "DONE", "DONE", "ERROR"} {
+		bus.Publish(metadata.ChannelMessage{Type: messageType, PhotoId: "photo"})
+	}
+
+	var lock sync.Mutex
+	running := 0
+	var types []string
+
+	stop := subscribe(t, bus, func(message metadata.ChannelMessage) error {
+		lock.Lock()
+		running++
+
+		if running > 1 {
+			t.Errorf("handlers of the same photo ran at once")
+		}
+
+		lock.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		lock.Lock()
+		running--
+		types = append(types, message.Type)
+		lock.Unlock()
+
+		return nil
+	})
+
+	waitFor(func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+
+		return len(types) == 4
+	})
+	stop()
+
+	if len(types) != 4 || types[0] != "NEW" || types[3] != "ERROR" {
+		t.Errorf("handled %v, want NEW, DONE, DONE, ERROR", types)
+	}
+}
@@ -0,0 +1,139 @@
+package chatconfig
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// FileStore keeps every chat config in one JSON file, for small setups
+// without mongo. The file is read once and rewritten on every Upsert, a
+// temporary file renamed over it so a crash doesn't leave half of it behind.
+type FileStore struct {
+	lock    sync.Mutex
+	path    string
+	configs map[int64]ChatConfig
+}
+
+// NewFileStore reads the chat configs in path, a missing file is created by
+// the first Upsert
+func NewFileStore(path string) (*FileStore, error) {
+	store := &FileStore{
+		path:    path,
+		configs: make(map[int64]ChatConfig),
+	}
+
+	data, err := ioutil.ReadFile(path)
+
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var configs []ChatConfig
+	err = json.Unmarshal(data, &configs)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, config := range configs {
+		store.configs[config.ChatId] = config
+	}
+
+	return store, nil
+}
+
+func (store *FileStore) Get(chatId int64) (ChatConfig, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	config, ok := store.configs[chatId]
+
+	if !ok {
+		return ChatConfig{}, ErrNotFound
+	}
+
+	return config, nil
+}
+
+func (store *FileStore) All() ([]ChatConfig, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	return store.sorted(), nil
+}
+
+func (store *FileStore) Upsert(config ChatConfig) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	previous, existed := store.configs[config.ChatId]
+	store.configs[config.ChatId] = config
+
+	err := store.write()
+
+	if err == nil {
+		return nil
+	}
+
+	if existed {
+		store.configs[config.ChatId] = previous
+	} else {
+		delete(store.configs, config.ChatId)
+	}
+
+	return err
+}
+
+// sorted lists the configs by chat ID, so the file doesn't reorder itself
+func (store *FileStore) sorted() []ChatConfig {
+	configs := make([]ChatConfig, 0, len(store.configs))
+
+	for _, config := range store.configs {
+		configs = append(configs, config)
+	}
+
+	sort.Slice(configs, func(i, j int) bool {
+		return configs[i].ChatId < configs[j].ChatId
+	})
+
+	return configs
+}
+
+func (store *FileStore) write() error {
+	data, err := json.MarshalIndent(store.sorted(), "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(store.path), filepath.Base(store.path)+".")
+
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(data)
+
+	if err == nil {
+		err = file.Sync()
+	}
+
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+
+	return os.Rename(file.Name(), store.path)
+}
@@ -0,0 +1,53 @@
+package chatconfig
+
+import (
+	"sync"
+)
+
+// MemoryStore is a Store kept in process memory, for tests and setups that
+// don't need chats remembered across restarts
+type MemoryStore struct {
+	lock    sync.Mutex
+	configs map[int64]ChatConfig
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		configs: make(map[int64]ChatConfig),
+	}
+}
+
+func (store *MemoryStore) Get(chatId int64) (ChatConfig, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	config, ok := store.configs[chatId]
+
+	if !ok {
+		return ChatConfig{}, ErrNotFound
+	}
+
+	return config, nil
+}
+
+func (store *MemoryStore) All() ([]ChatConfig, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	configs := make([]ChatConfig, 0, len(store.configs))
+
+	for _, config := range store.configs {
+		configs = append(configs, config)
+	}
+
+	return configs, nil
+}
+
+func (store *MemoryStore) Upsert(config ChatConfig) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	store.configs[config.ChatId] = config
+
+	return nil
+}
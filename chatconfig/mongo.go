@@ -0,0 +1,117 @@
+package chatconfig
+
+import (
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// MongoStore keeps a document per chat in a mongo collection, unique by
+// chat_id
+type MongoStore struct {
+	session    *mgo.Session
+	db         string
+	collection string
+}
+
+// NewMongoStore makes sure chat_id is unique in collection. Configs inserted
+// twice for a chat by older versions of the bot are dropped, keeping the
+// latest one.
+func NewMongoStore(session *mgo.Session, db, collection string) (*MongoStore, error) {
+	store := &MongoStore{
+		session:    session,
+		db:         db,
+		collection: collection,
+	}
+
+	err := store.dropDuplicates()
+
+	if err != nil {
+		return nil, err
+	}
+
+	session, configs := store.configs()
+	defer session.Close()
+
+	err = configs.EnsureIndex(mgo.Index{
+		Key:    []string{"chat_id"},
+		Unique: true,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// configs returns the collection on a copy of the session, a copy gets a
+// fresh socket while the shared session keeps a broken one
+func (store *MongoStore) configs() (*mgo.Session, *mgo.Collection) {
+	session := store.session.Copy()
+
+	return session, session.DB(store.db).C(store.collection)
+}
+
+func (store *MongoStore) dropDuplicates() error {
+	session, configs := store.configs()
+	defer session.Close()
+
+	var duplicates []struct {
+		Ids []bson.ObjectId `bson:"ids"`
+	}
+
+	err := configs.Pipe([]bson.M{
+		{"$sort": bson.M{"_id": 1}},
+		{"$group": bson.M{"_id": "$chat_id", "ids": bson.M{"$push": "$_id"}, "count": bson.M{"$sum": 1}}},
+		{"$match": bson.M{"count": bson.M{"$gt": 1}}},
+	}).All(&duplicates)
+
+	if err != nil {
+		return err
+	}
+
+	for _, duplicate := range duplicates {
+		// object IDs start with the time they were made, the last is the latest
+		older := duplicate.Ids[:len(duplicate.Ids)-1]
+		_, err := configs.RemoveAll(bson.M{"_id": bson.M{"$in": older}})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (store *MongoStore) Get(chatId int64) (ChatConfig, error) {
+	session, configs := store.configs()
+	defer session.Close()
+
+	var config ChatConfig
+	err := configs.Find(bson.M{"chat_id": chatId}).One(&config)
+
+	if err == mgo.ErrNotFound {
+		return config, ErrNotFound
+	}
+
+	return config, err
+}
+
+func (store *MongoStore) All() ([]ChatConfig, error) {
+	session, configs := store.configs()
+	defer session.Close()
+
+	var all []ChatConfig
+	err := configs.Find(nil).All(&all)
+
+	return all, err
+}
+
+func (store *MongoStore) Upsert(config ChatConfig) error {
+	session, configs := store.configs()
+	defer session.Close()
+
+	_, err := configs.Upsert(bson.M{"chat_id": config.ChatId}, config)
+
+	return err
+}
@@ -0,0 +1,100 @@
+package chatconfig
+
+import (
+	"sync"
+)
+
+// Repository caches the chat configs of a Store. Reads are served from the
+// cache, chats that aren't in it are read through from the store once, and
+// writes go to both. It's safe for concurrent use.
+type Repository struct {
+	store Store
+	lock  sync.RWMutex
+	cache map[int64]ChatConfig
+
+	// updates run one at a time, so the store gets them in the same order
+	// as the cache
+	updates sync.Mutex
+}
+
+func NewRepository(store Store) *Repository {
+	return &Repository{
+		store: store,
+		cache: make(map[int64]ChatConfig),
+	}
+}
+
+// Load fills the cache with every chat config in the store and returns how
+// many there are
+func (repository *Repository) Load() (int, error) {
+	configs, err := repository.store.All()
+
+	if err != nil {
+		return 0, err
+	}
+
+	repository.lock.Lock()
+	defer repository.lock.Unlock()
+
+	for _, config := range configs {
+		repository.cache[config.ChatId] = config
+	}
+
+	return len(configs), nil
+}
+
+// Get returns the config of a chat, an empty one for chats the store doesn't
+// know. Store errors are returned along with the empty config and aren't
+// cached, the next Get asks the store again.
+func (repository *Repository) Get(chatId int64) (ChatConfig, error) {
+	repository.lock.RLock()
+	config, ok := repository.cache[chatId]
+	repository.lock.RUnlock()
+
+	if ok {
+		return config, nil
+	}
+
+	config, err := repository.store.Get(chatId)
+
+	if err != nil && err != ErrNotFound {
+		return ChatConfig{ChatId: chatId}, err
+	}
+
+	config.ChatId = chatId
+
+	repository.lock.Lock()
+	defer repository.lock.Unlock()
+
+	// an Update may have cached a newer one meanwhile
+	if cached, ok := repository.cache[chatId]; ok {
+		return cached, nil
+	}
+
+	repository.cache[chatId] = config
+
+	return config, nil
+}
+
+// Update hands the config of a chat to fn and upserts the result. The cache
+// keeps the change even if the store fails, the chat goes on with it until
+// the bot restarts.
+func (repository *Repository) Update(chatId int64, fn func(config *ChatConfig)) (ChatConfig, error) {
+	repository.updates.Lock()
+	defer repository.updates.Unlock()
+
+	config, err := repository.Get(chatId)
+
+	if err != nil {
+		return config, err
+	}
+
+	fn(&config)
+	config.ChatId = chatId
+
+	repository.lock.Lock()
+	repository.cache[chatId] = config
+	repository.lock.Unlock()
+
+	return config, repository.store.Upsert(config)
+}
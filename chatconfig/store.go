@@ -0,0 +1,28 @@
+// this package keeps the settings of telegram chats
+package chatconfig
+
+import (
+	"errors"
+)
+
+var ErrNotFound = errors.New("chat config not found")
+
+// ChatConfig is what the bot remembers about a chat
+type ChatConfig struct {
+	ChatId     int64  `bson:"chat_id"     json:"chat_id"`
+	Locale     string `bson:"locale"      json:"locale,omitempty"`
+	Registered bool   `bson:"registered"  json:"registered,omitempty"`
+	Plan       string `bson:"plan"        json:"plan,omitempty"`     // see telegram/quota.go
+	Framing    string `bson:"framing"     json:"framing,omitempty"`  // see telegram/framing.go
+	Timezone   string `bson:"timezone"    json:"timezone,omitempty"` // see telegram/schedule.go
+}
+
+// Store keeps chat configs, one per chat ID
+type Store interface {
+	// Get returns ErrNotFound for chats that weren't stored
+	Get(chatId int64) (ChatConfig, error)
+	// All returns every stored chat config
+	All() ([]ChatConfig, error)
+	// Upsert stores config, replacing the one of the same chat
+	Upsert(config ChatConfig) error
+}
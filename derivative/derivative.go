@@ -0,0 +1,48 @@
+// this package keeps media the bot made itself, e.g. a photo converted to
+// JPEG, in redis. Photo records point at them with a redis: url instead of a
+// telegram file link, so every stage works on the same bytes.
+package derivative
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+const keyPrefix = "derivative:"
+const scheme = "redis:"
+
+// TTL is how long derivatives are kept, telegram file links last way shorter
+const TTL = time.Hour * 24 * 7
+
+var ErrExpired = errors.New("derivative expired")
+
+// Put stores data made of photoId and returns the url to record
+func Put(client *redis.Client, photoId string, data []byte) (string, error) {
+	key := keyPrefix + photoId
+
+	err := client.Set(key, data, TTL).Err()
+
+	if err != nil {
+		return "", err
+	}
+
+	return scheme + key, nil
+}
+
+// Is tells urls of derivatives from telegram file links
+func Is(uri string) bool {
+	return strings.HasPrefix(uri, scheme+keyPrefix)
+}
+
+func Get(client *redis.Client, uri string) ([]byte, error) {
+	data, err := client.Get(strings.TrimPrefix(uri, scheme)).Bytes()
+
+	if err == redis.Nil {
+		return nil, ErrExpired
+	}
+
+	return data, err
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"image"
+	"log"
+
+	"github.com/nuxdie/instabot/derivative"
+	"github.com/nuxdie/instabot/media"
+	"github.com/nuxdie/instabot/metadata"
+	"github.com/nuxdie/instabot/pipeline"
+	"github.com/nuxdie/instabot/retry"
+	"github.com/nuxdie/instabot/shutdown"
+)
+
+type Worker struct {
+	runtime *pipeline.Runtime
+}
+
+func main() {
+	worker := NewWorker()
+	worker.Start()
+}
+
+func NewWorker() *Worker {
+	var worker Worker
+
+	runtimeConfig := pipeline.LoadConfig("frame")
+	worker.runtime = pipeline.New("frame", worker, runtimeConfig, "NEW")
+
+	return &worker
+}
+
+func (worker Worker) Start() {
+	err := worker.runtime.Start(shutdown.Context(context.Background()))
+
+	if err != nil {
+		log.Fatalf("[FATAL] Frame worker stopped: %s", err)
+	}
+}
+
+func (worker Worker) Interested(message metadata.ChannelMessage, photo metadata.PhotoMetadata) bool {
+	if photo.State != metadata.StateNew && photo.State != metadata.StateEnriching {
+		return false
+	}
+
+	// galleries are enriched item by item
+	if photo.IsGallery() {
+		return false
+	}
+
+	return !photo.FramingChecked
+}
+
+func (worker Worker) Persist(job *pipeline.Job, result pipeline.Result) error {
+	return job.Store(result)
+}
+
+func (worker Worker) Process(job *pipeline.Job) (pipeline.Result, error) {
+	result := pipeline.Result{"framing_checked": true}
+
+	// carousels and videos are posted as they are
+	if job.Photo.GalleryId != "" || job.Photo.IsVideo() {
+		return result, nil
+	}
+
+	resp, err := job.Fetch()
+
+	if err != nil {
+		job.Log.Printf("[ERROR] Couldn't get photo: %s", err)
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	img, _, err := image.Decode(resp.Body)
+
+	if err != nil {
+		job.Log.Printf("[ERROR] Couldn't decode photo: %s", err)
+		return nil, retry.Permanent(err)
+	}
+
+	bounds := img.Bounds()
+
+	if media.FitsAspect(bounds.Dx(), bounds.Dy()) {
+		job.Log.Printf("[DEBUG] Photo %s is %dx%d, nothing to frame", job.Photo.PhotoId,
+			bounds.Dx(), bounds.Dy())
+		return result, nil
+	}
+
+	for _, framing := range metadata.Framings {
+		data, err := media.EncodeJPEG(frame(img, framing))
+
+		if err != nil {
+			job.Log.Printf("[ERROR] Couldn't encode %s framing: %s", framing, err)
+			return nil, err
+		}
+
+		url, err := derivative.Put(job.Redis(), job.Photo.PhotoId+":"+framing, data)
+
+		if err != nil {
+			job.Log.Printf("[ERROR] Couldn't store %s framing: %s", framing, err)
+			return nil, err
+		}
+
+		result[framing+"_url"] = url
+	}
+
+	job.Log.Printf("[INFO] Framed photo %s, it's %dx%d", job.Photo.PhotoId, bounds.Dx(), bounds.Dy())
+
+	return result, nil
+}
+
+func frame(img image.Image, framing string) image.Image {
+	switch framing {
+	case metadata.FramingBlur:
+		return media.Pad(img, true)
+	case metadata.FramingSolid:
+		return media.Pad(img, false)
+	}
+
+	return media.SmartCrop(img)
+}
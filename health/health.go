@@ -0,0 +1,151 @@
+// this package serves /healthz and /readyz from the checks a service registers
+package health
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Timeout is how long a single check may take before it counts as failed
+const Timeout = time.Second * 3
+
+// Check returns nil when whatever it checks is fine
+type Check func() error
+
+type named struct {
+	name  string
+	check Check
+}
+
+// Checks holds liveness and readiness checks. A failing liveness check means
+// the process is stuck and should be restarted, a failing readiness check
+// means it can't do its job right now, e.g. because redis is down.
+type Checks struct {
+	lock  sync.Mutex
+	live  []named
+	ready []named
+}
+
+func New() *Checks {
+	return &Checks{}
+}
+
+// Live adds a check to both /healthz and /readyz
+func (checks *Checks) Live(name string, check Check) {
+	checks.lock.Lock()
+	defer checks.lock.Unlock()
+
+	checks.live = append(checks.live, named{name, check})
+}
+
+// Ready adds a check to /readyz
+func (checks *Checks) Ready(name string, check Check) {
+	checks.lock.Lock()
+	defer checks.lock.Unlock()
+
+	checks.ready = append(checks.ready, named{name, check})
+}
+
+// Register adds /healthz and /readyz to mux
+func (checks *Checks) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		checks.serve(w, checks.list(false))
+	})
+
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		checks.serve(w, checks.list(true))
+	})
+}
+
+func (checks *Checks) list(ready bool) []named {
+	checks.lock.Lock()
+	defer checks.lock.Unlock()
+
+	list := append([]named(nil), checks.live...)
+
+	if ready {
+		list = append(list, checks.ready...)
+	}
+
+	return list
+}
+
+// serve runs the checks concurrently and answers 200 when all of them pass,
+// 503 otherwise. The body lists the result of every check.
+func (checks *Checks) serve(w http.ResponseWriter, list []named) {
+	results := make(map[string]string, len(list))
+	errs := make([]error, len(list))
+
+	var wait sync.WaitGroup
+
+	for i, item := range list {
+		wait.Add(1)
+
+		go func(i int, check Check) {
+			defer wait.Done()
+			errs[i] = run(check)
+		}(i, item.check)
+	}
+
+	wait.Wait()
+
+	status := http.StatusOK
+
+	for i, item := range list {
+		results[item.name] = "ok"
+
+		if errs[i] != nil {
+			results[item.name] = errs[i].Error()
+			status = http.StatusServiceUnavailable
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	json.NewEncoder(w).Encode(struct {
+		Status int               `json:"status"`
+		Checks map[string]string `json:"checks"`
+	}{status, results})
+}
+
+// run gives up on check after Timeout, the check itself keeps running
+func run(check Check) error {
+	done := make(chan error, 1)
+
+	go func() {
+		done <- check()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(Timeout):
+		return errors.New("timed out")
+	}
+}
+
+// Cached remembers the result of check for ttl, for checks that are too
+// expensive to run on every probe, like calls to a rate limited API
+func Cached(check Check, ttl time.Duration) Check {
+	var lock sync.Mutex
+	var checked time.Time
+	var result error
+
+	return func() error {
+		lock.Lock()
+		defer lock.Unlock()
+
+		if time.Since(checked) < ttl {
+			return result
+		}
+
+		result = check()
+		checked = time.Now()
+
+		return result
+	}
+}
@@ -1,50 +1,69 @@
 package main
 
 import (
-	"encoding/json"
+	"bytes"
+	"context"
+	"errors"
 	"io"
+	"io/ioutil"
 	"log"
-	"net/http"
-	"net/url"
 	"time"
 
 	"github.com/ahmdrz/goinsta"
 	"github.com/ahmdrz/goinsta/response"
-	"github.com/go-redis/redis"
-	"github.com/mitchellh/mapstructure"
 	"github.com/spf13/viper"
+	"github.com/nuxdie/instabot/account"
+	"github.com/nuxdie/instabot/health"
 	"github.com/nuxdie/instabot/metadata"
-	"github.com/hashicorp/logutils"
-	"os"
-	"fmt"
+	"github.com/nuxdie/instabot/metrics"
+	"github.com/nuxdie/instabot/pipeline"
+	"github.com/nuxdie/instabot/retry"
+	"github.com/nuxdie/instabot/shutdown"
+	"github.com/nuxdie/instabot/vault"
+	"gopkg.in/mgo.v2"
 )
 
-const envLogLevel = "LOG_LEVEL"
-const envWorkerRedisAddr = "WORKER_REDIS_ADDR"
-const envWorkerRedisDb = "WORKER_REDIS_DB"
-const envWorkerRedisPasswd = "WORKER_REDIS_PASSWD"
-const envWorkerRedisChannel = "WORKER_REDIS_CHANNEL"
 const envWorkerInstagramUsername = "WORKER_INSTAGRAM_USERNAME"
 const envWorkerInstagramPassword = "WORKER_INSTAGRAM_PASSWORD"
+const envWorkerVaultKey = "WORKER_VAULT_KEY"
+const envWorkerVaultKeyFile = "WORKER_VAULT_KEY_FILE"
+const envWorkerVaultPreviousKeys = "WORKER_VAULT_PREVIOUS_KEYS"
+const envWorkerVaultStore = "WORKER_VAULT_STORE"
+const envWorkerVaultMongoUrl = "WORKER_VAULT_MONGO_URL"
+const envWorkerVaultMongoDbName = "WORKER_VAULT_MONGO_DB_NAME"
+
+// where sealed secrets are kept: a redis hash or a mongo collection
+const vaultRedisKey = "vault"
+const vaultCollectionName = "vault"
+
+// Instagram doesn't like being asked too often, probes get a cached answer
+const sessionCheckInterval = time.Minute * 5
+
+// JPEG quality Instagram is told about
+const uploadQuality = 87
+
+var errNoAccount = errors.New("no instagram account connected, send /connect to the bot")
 
 type Worker struct {
-	redis *redis.Client
-	insta goinsta.Instagram
+	runtime *pipeline.Runtime
+	accounts *account.Store
+	sessions *sessions
 	config *workerConfig
 }
 
 type workerConfig struct {
-	instagram struct{
+	instagram struct{ // default account, moved to the vault on startup
 		username string
 		password string
 	}
-	redis struct{
-		channel string
-		addr string
-		passwd string
-		db int
+	vault struct{
+		key string // base64, or in keyFile
+		keyFile string
+		previousKeys string // comma separated, secrets sealed with them are sealed again
+		store string // redis or mongo
+		mongoUrl string
+		mongoDbName string
 	}
-	photoLocker map[string]bool // used to make sure we don't do double post
 }
 
 func main() {
@@ -56,225 +75,270 @@ func main() {
 func NewWorker() *Worker {
 	var worker Worker
 
+	runtimeConfig := pipeline.LoadConfig("instagram")
 	worker.config = config()
 
-	worker.redis = redis.NewClient(&redis.Options{
-		Addr: worker.config.redis.addr,
-		Password: worker.config.redis.passwd,
-		DB: worker.config.redis.db,
-	})
-
-	insta, err := worker.loginInstagram()
+	// the runtime hands photos to a pointer, so it sees the fields set below
+	worker.runtime = pipeline.New("instagram", &worker, runtimeConfig, "PUBLISH")
+	worker.accounts = account.NewStore(worker.runtime.Redis(), worker.openVault())
 
-	if err != nil {
-		log.Fatalf("[ERROR] Couldn't login to instagram: %s", err)
+	if worker.config.instagram.password != "" {
+		worker.importDefaultAccount()
 	}
 
-	worker.insta = *insta
+	worker.sessions = newSessions(worker.accounts)
+	defaultAccount, err := worker.accounts.Get(account.Default)
+
+	switch err {
+	case nil:
+		// restores the saved session, or logs in when there's none
+		err = worker.sessions.use(defaultAccount, func(insta *goinsta.Instagram) error {
+			return nil
+		})
+
+		if err != nil {
+			log.Fatalf("[ERROR] Couldn't login to instagram: %s", err)
+		}
 
-	worker.setupRedis()
+		worker.runtime.Health().Ready("instagram", health.Cached(func() error {
+			return worker.checkSession(defaultAccount)
+		}, sessionCheckInterval))
+	case account.ErrNotFound:
+		log.Printf("[INFO] No default instagram account, posting for connected accounts only")
+	default:
+		log.Fatalf("[FATAL] Couldn't get the default instagram account: %s", err)
+	}
 
 	return &worker
 }
 
 func (worker Worker) Start() {
+	err := worker.runtime.Start(shutdown.Context(context.Background()))
 
+	if err != nil {
+		log.Fatalf("[FATAL] Instagram worker stopped: %s", err)
+	}
 }
 
 func config() *workerConfig {
-	viper.AutomaticEnv()
-	viper.SetDefault(envWorkerRedisAddr, "localhost:6379")
-	viper.SetDefault(envWorkerRedisPasswd, "")
-	viper.SetDefault(envWorkerRedisChannel, "message")
-	viper.SetDefault(envWorkerRedisDb, 0)
-	viper.SetDefault(envLogLevel, "WARN")
-
-	filter := &logutils.LevelFilter{
-		Levels: []logutils.LogLevel{"VERBOSE", "DEBUG", "INFO", "WARN", "ERROR", "FATAL"},
-		MinLevel: logutils.LogLevel(viper.GetString(envLogLevel)),
-		Writer: os.Stderr,
-	}
-	log.SetOutput(filter)
-
 	conf := &workerConfig{}
 
-	conf.redis.addr = viper.GetString(envWorkerRedisAddr)
-	conf.redis.passwd = viper.GetString(envWorkerRedisPasswd)
-	conf.redis.channel = viper.GetString(envWorkerRedisChannel)
-	conf.redis.db = viper.GetInt(envWorkerRedisDb)
-
 	conf.instagram.username = viper.GetString(envWorkerInstagramUsername)
 	conf.instagram.password = viper.GetString(envWorkerInstagramPassword)
 
-	conf.photoLocker = make(map[string]bool)
+	if conf.instagram.password != "" && conf.instagram.username == "" {
+		log.Fatalf("[FATAL] Please provide the username of the default instagram account in %s",
+			envWorkerInstagramUsername)
+	}
+
+	viper.SetDefault(envWorkerVaultStore, "redis")
+	viper.SetDefault(envWorkerVaultMongoUrl, "localhost")
+	viper.SetDefault(envWorkerVaultMongoDbName, "instabot")
+
+	conf.vault.key = viper.GetString(envWorkerVaultKey)
+	conf.vault.keyFile = viper.GetString(envWorkerVaultKeyFile)
+	conf.vault.previousKeys = viper.GetString(envWorkerVaultPreviousKeys)
+	conf.vault.store = viper.GetString(envWorkerVaultStore)
+	conf.vault.mongoUrl = viper.GetString(envWorkerVaultMongoUrl)
+	conf.vault.mongoDbName = viper.GetString(envWorkerVaultMongoDbName)
 
 	return conf
 }
 
-func (worker Worker) setupRedis() {
-	pong, err := worker.redis.Ping().Result()
+// Interested takes photos that are to be published. Messages of a photo are
+// handled one at a time, so it's never uploaded twice at once.
+func (worker Worker) Interested(message metadata.ChannelMessage, photo metadata.PhotoMetadata) bool {
+	return photo.State == metadata.StatePublishing
+}
 
-	if err != nil {
-		log.Printf("[ERROR] Couldn't ping redis server %s", err)
-	} else {
-		log.Printf("[DEBUG] got pong from redis %v", pong)
+func (worker Worker) Process(job *pipeline.Job) (pipeline.Result, error) {
+	if job.Photo.IsGallery() {
+		return worker.processGallery(job)
 	}
 
-	pubsub := worker.redis.Subscribe(worker.config.redis.channel)
-	ch := pubsub.Channel()
-
-	status, err := pubsub.ReceiveTimeout(time.Second*time.Duration(10))
+	if job.Photo.IsVideo() {
+		return worker.processVideo(job)
+	}
 
-	defer pubsub.Close()
+	resp, err := job.FetchUpload()
 
 	if err != nil {
-		log.Panicf("[ERROR] Couldn't subscribe to redis channel %s: %s",
-			worker.config.redis.channel, err)
+		job.Log.Printf("[ERROR] Couldn't get photo: %s", err)
+		return nil, err
 	}
 
-	log.Printf("[INFO] redis %v", status)
+	photo, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
 
-	for message := range ch {
-		go func(messageVal *redis.Message) {
-			worker.handleRedis(messageVal)
-		}(message)
+	if err != nil {
+		job.Log.Printf("[ERROR] Couldn't read photo: %s", err)
+		return nil, err
 	}
-}
 
-func (worker Worker) handleRedis(message *redis.Message) {
-	log.Printf("[VERBOSE] Got message from redis channel %s: %v",
-		worker.config.redis.channel, message)
+	res, err := worker.uploadAndDisableComments(job, "upload",
+		func(insta *goinsta.Instagram) (response.UploadPhotoResponse, error) {
+			return insta.UploadPhotoFromReader(bytes.NewReader(photo), job.Photo.FinalCaption,
+				insta.NewUploadID(), uploadQuality, goinsta.Filter_Valencia)
+		})
+
+	return worker.uploaded(job, res, err)
+}
 
-	var updateMsg metadata.ChannelMessage
-	err := json.Unmarshal([]byte(message.Payload), &updateMsg)
+// uploaded turns the outcome of an upload into the result of the stage
+func (worker Worker) uploaded(job *pipeline.Job, res response.UploadPhotoResponse,
+	err error) (pipeline.Result, error) {
 
 	if err != nil {
-		log.Printf("[ERROR] Couldn't decode JSON metadata, %s", message.Payload)
+		job.Log.Printf("[ERROR] Couldn't upload photo %s to Instagram: %s",
+			job.Photo.PhotoId, err)
+		metrics.InstagramUploads.WithLabelValues("error").Inc()
+		return nil, err
 	}
 
-	if updateMsg.Type == "PUBLISH" {
-		log.Printf("[DEBUG] Got message from redis channel %s: %v",
-			worker.config.redis.channel, message)
+	metrics.InstagramUploads.WithLabelValues("ok").Inc()
 
-		metaHGet, err := worker.redis.HGetAll(updateMsg.PhotoId).Result()
+	return pipeline.Result{
+		"published_url":  "https://www.instagram.com/p/" + res.Media.Code,
+		"instagram_id":   res.Media.ID,
+		"instagram_code": res.Media.Code,
+	}, nil
+}
 
-		if err != nil {
-			log.Printf("[ERROR] Couldn't hget from redis for ID %s: %s",
-				updateMsg.PhotoId, err)
-		}
-		log.Printf("[VERBOSE] Got from redis: %v", metaHGet)
+// processGallery posts the items of a gallery as one carousel
+func (worker Worker) processGallery(job *pipeline.Job) (pipeline.Result, error) {
+	items, err := job.Items()
 
-		var metaFromRedis metadata.PhotoMetadata
-		err = mapstructure.WeakDecode(metaHGet, &metaFromRedis)
+	if err != nil {
+		job.Log.Printf("[ERROR] Couldn't get items of gallery %s: %s", job.Photo.PhotoId, err)
+		return nil, err
+	}
 
-		if err != nil {
-			log.Printf("[ERROR] Couldn't map response from API to metadata struct: %s",
-				err)
-			return
-		}
+	photos := make([][]byte, 0, len(items))
 
-		log.Printf("[VERBOSE] got metadata from redis: %v", metaFromRedis)
+	for _, item := range items {
+		resp, err := job.FetchItem(item)
 
-		if metaFromRedis.Published {
-			log.Printf("[INFO] Nothing to do. Already has published status: %s, %b",
-				metaFromRedis.Publish, metaFromRedis.Published)
-			return
+		if err != nil {
+			job.Log.Printf("[ERROR] Couldn't get item %s: %s", item.PhotoId, err)
+			return nil, err
 		}
 
-		log.Printf("[VERBOSE] photoLocker contents %v", worker.config.photoLocker)
+		photo, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
 
-		if worker.config.photoLocker[metaFromRedis.PhotoId] {
-			log.Printf("[INFO] Another upload in progress, aborting %s", metaFromRedis.PhotoId)
-			return
+		if err != nil {
+			job.Log.Printf("[ERROR] Couldn't read item %s: %s", item.PhotoId, err)
+			return nil, err
 		}
 
-		mediaCodeRes, err := worker.process(metaFromRedis)
-
-		if err != nil {
-			log.Printf("[ERROR] Couldn't get status from API: %s", err)
+		photos = append(photos, photo)
+	}
 
-			updateMessage, err := json.Marshal(&metadata.ChannelMessage{
-				Type: "ERROR",
-				PhotoId: metaFromRedis.PhotoId,
-				Message: fmt.Sprintf("[ERROR] %s", err),
+	if len(photos) == 1 {
+		// the other photos of the album never made it, no carousel for one
+		res, err := worker.uploadAndDisableComments(job, "upload",
+			func(insta *goinsta.Instagram) (response.UploadPhotoResponse, error) {
+				return insta.UploadPhotoFromReader(bytes.NewReader(photos[0]), job.Photo.FinalCaption,
+					insta.NewUploadID(), uploadQuality, goinsta.Filter_Valencia)
 			})
 
-			if err != nil {
-				log.Printf("[ERROR] Couldn't encode JSON: %s", err)
-			}
-			_, err = worker.redis.Publish(worker.config.redis.channel, updateMessage).Result()
+		return worker.uploaded(job, res, err)
+	}
 
-			if err != nil {
-				log.Printf("[ERROR] Couldn't publish message to redis channel %s: %s",
-					worker.config.redis.channel, err)
+	res, err := worker.uploadAndDisableComments(job, "upload_album",
+		func(insta *goinsta.Instagram) (response.UploadPhotoResponse, error) {
+			readers := make([]io.Reader, 0, len(photos))
+
+			for _, photo := range photos {
+				readers = append(readers, bytes.NewReader(photo))
 			}
 
-			return
-		}
+			album, err := insta.UploadAlbumFromReaders(readers, job.Photo.FinalCaption,
+				uploadQuality, goinsta.Filter_Valencia)
 
-		status := len(metaHGet) != 0
-		metaFromRedis.Published = status
-		metaFromRedis.PublishedUrl = "https://www.instagram.com/p/" + mediaCodeRes
+			return response.UploadPhotoResponse{StatusResponse: album.StatusResponse,
+				Media: album.Media}, err
+		})
 
-		_, err = worker.redis.HSet(updateMsg.PhotoId, "published", status).Result()
+	return worker.uploaded(job, res, err)
+}
 
-		if err != nil {
-			log.Printf("[ERROR] Couldn't set status in redis for %s: %s",
-				updateMsg.PhotoId, err)
-		}
-		_, err = worker.redis.HSet(updateMsg.PhotoId, "published_url",
-			metaFromRedis.PublishedUrl).Result()
+// processVideo posts a video with its cover frame
+func (worker Worker) processVideo(job *pipeline.Job) (pipeline.Result, error) {
+	resp, err := job.FetchVideo()
 
-		if err != nil {
-			log.Printf("[ERROR] Couldn't set status in redis for %s: %s",
-				updateMsg.PhotoId, err)
-		}
+	if err != nil {
+		job.Log.Printf("[ERROR] Couldn't get video: %s", err)
+		return nil, err
+	}
 
-		updateMessage, err := json.Marshal(&metadata.ChannelMessage{
-			Type: "DONE",
-			PhotoId: metaFromRedis.PhotoId,
-		})
+	video, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
 
-		if err != nil {
-			log.Printf("[ERROR] Couldn't encode JSON: %s", err)
-		}
-		_, err = worker.redis.Publish(worker.config.redis.channel, updateMessage).Result()
+	if err != nil {
+		job.Log.Printf("[ERROR] Couldn't read video: %s", err)
+		return nil, err
+	}
 
-		if err != nil {
-			log.Printf("[ERROR] Couldn't publish message to redis channel %s: %s",
-				worker.config.redis.channel, err)
-		}
-	} else {
-		log.Printf("[VERBOSE] Not interested in this message: %v", updateMsg)
-		return
+	resp, err = job.Fetch()
+
+	if err != nil {
+		job.Log.Printf("[ERROR] Couldn't get cover of the video: %s", err)
+		return nil, err
 	}
-}
 
-func (worker Worker) process(photoMetadata metadata.PhotoMetadata) (string, error) {
-	resp, err := getPhoto(photoMetadata.PhotoUrl)
+	cover, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
 
 	if err != nil {
-		log.Printf("[ERROR] Couldn't get photo: %s", err)
-		return "", err
+		job.Log.Printf("[ERROR] Couldn't read cover of the video: %s", err)
+		return nil, err
 	}
 
-	res, err := worker.uploadAndDisableComments(resp.Body, photoMetadata.FinalCaption, photoMetadata.PhotoId)
+	res, err := worker.uploadAndDisableComments(job, "upload_video",
+		func(insta *goinsta.Instagram) (response.UploadPhotoResponse, error) {
+			return insta.UploadVideoFromReader(bytes.NewReader(video), bytes.NewReader(cover),
+				job.Photo.FinalCaption, job.Photo.Duration)
+		})
+
+	return worker.uploaded(job, res, err)
+}
+
+func (worker Worker) Persist(job *pipeline.Job, result pipeline.Result) error {
+	err := job.Transition(metadata.StatePublishing, metadata.StatePublished, result,
+		metadata.ChannelMessage{Type: "DONE"})
 
 	if err != nil {
-		log.Printf("[ERROR] Couldn't upload photo %s to Instagram: %s",
-			photoMetadata.PhotoId, err)
-		worker.config.photoLocker[photoMetadata.PhotoId] = false
-		return "", err
+		// photo is already on Instagram, retrying the entry would post it twice
+		job.Log.Printf("[ERROR] Couldn't set status in redis for %s: %s",
+			job.Photo.PhotoId, err)
+		return nil
 	}
 
-	return res.Media.Code, nil
+	if arrived := job.Photo.EnteredAt(metadata.StateNew); !arrived.IsZero() {
+		metrics.PublishLatency.Observe(job.Photo.EnteredAt(metadata.StatePublished).Sub(arrived).Seconds())
+	}
+
+	return nil
+}
+
+// checkSession fails when Instagram doesn't accept the session of the
+// default account anymore, and doesn't take its password either
+func (worker Worker) checkSession(defaultAccount account.Account) error {
+	return worker.sessions.use(defaultAccount, func(insta *goinsta.Instagram) error {
+		_, err := insta.GetProfileData()
+
+		return err
+	})
 }
 
-func (worker Worker) disableComments(insta *goinsta.Instagram, uploadPhotoResponse response.UploadPhotoResponse) error {
+func (worker Worker) disableComments(logger *log.Logger, insta *goinsta.Instagram,
+	uploadPhotoResponse response.UploadPhotoResponse) error {
+
 	_, err := insta.DisableComments(uploadPhotoResponse.Media.ID)
 
 	if err != nil {
-		log.Printf("[ERROR] Error trying to disable comments for mediaId %s: %s",
+		logger.Printf("[ERROR] Error trying to disable comments for mediaId %s: %s",
 			uploadPhotoResponse.Media.ID, err)
 		return err
 	}
@@ -282,78 +346,141 @@ func (worker Worker) disableComments(insta *goinsta.Instagram, uploadPhotoRespon
 	return nil
 }
 
-func (worker Worker) loginInstagram() (*goinsta.Instagram, error) {
-	if len(worker.config.instagram.username)*len(worker.config.instagram.password) == 0 {
-		log.Fatalf("[ERROR] Please provide valid instagram username and password")
-	}
+// openVault opens the vault passwords are kept in, sealing the secrets of
+// previous keys with the current one
+func (worker Worker) openVault() *vault.Vault {
+	conf := worker.config.vault
+	key, previousKeys, err := vault.LoadKeys(conf.key, conf.keyFile, conf.previousKeys)
 
-	insta := goinsta.New(worker.config.instagram.username, worker.config.instagram.password)
+	if err != nil {
+		log.Fatalf("[FATAL] Couldn't load vault keys: %s", err)
+	}
 
-	if err := insta.Login(); err != nil {
-		log.Fatalf("[ERROR] Couldn't login to Instagram %s", err)
-		return nil, err
+	if key == nil {
+		log.Fatalf("[FATAL] Please provide a vault key in %s or %s", envWorkerVaultKey, envWorkerVaultKeyFile)
 	}
 
-	log.Printf("[INFO] Logged in to Instagram")
+	var backend vault.Backend
 
-	return insta, nil
-}
+	switch conf.store {
+	case "redis":
+		backend = vault.NewRedisBackend(worker.runtime.Redis(), vaultRedisKey)
+	case "mongo":
+		session, err := mgo.Dial(conf.mongoUrl)
+
+		if err != nil {
+			log.Fatalf("[FATAL] Couldn't connect to mongo, %s", err)
+		}
+
+		backend = vault.NewMongoBackend(session, conf.mongoDbName, vaultCollectionName)
+	default:
+		log.Fatalf("[FATAL] Unknown vault store %s", conf.store)
+	}
 
-func getPhoto(uri string) (*http.Response, error) {
-	parsed, err := url.Parse(uri)
+	secrets, err := vault.New(backend, key, previousKeys...)
 
-	if parsed.Host == "" || err != nil {
-		log.Printf("[ERROR] Incorrect photo url %s provided: %s", uri, err)
-		return nil, err
+	if err != nil {
+		log.Fatalf("[FATAL] Couldn't open vault: %s", err)
+	}
+
+	if len(previousKeys) == 0 {
+		return secrets
 	}
 
-	resp, err := http.Get(uri)
+	rotated, err := secrets.Rotate()
 
 	if err != nil {
-		log.Printf("[ERROR] Could not get the photo by %s", uri)
-		return nil, err
+		log.Fatalf("[FATAL] Couldn't rotate vault keys: %s", err)
 	}
 
-	return resp, nil
+	log.Printf("[INFO] Sealed %d secrets with the current vault key", rotated)
+
+	return secrets
 }
 
+// importDefaultAccount moves the default account from the environment to
+// the vault
+func (worker Worker) importDefaultAccount() {
+	password := []byte(worker.config.instagram.password)
+	defer func() {
+		for i := range password {
+			password[i] = 0
+		}
+	}()
+
+	err := worker.accounts.Put(account.Account{
+		ChatId:      account.Default,
+		Username:    worker.config.instagram.username,
+		ConnectedAt: time.Now(),
+	}, password)
 
-func (worker Worker) uploadAndDisableComments(photo io.ReadCloser, caption string, photoId string) (
-	response.UploadPhotoResponse, error) {
+	if err != nil {
+		log.Fatalf("[FATAL] Couldn't keep the default instagram account in the vault: %s", err)
+	}
 
-	insta, err := worker.loginInstagram()
+	worker.config.instagram.password = ""
 
-	quality := 87
-	uploadId := worker.insta.NewUploadID()
-	filterType := goinsta.Filter_Valencia
+	log.Printf("[WARN] The password of instagram account %s is in the vault now, please remove %s",
+		worker.config.instagram.username, envWorkerInstagramPassword)
+}
 
-	var uploadPhotoResponse response.UploadPhotoResponse
+// account picks the account a photo is posted to: the one its chat
+// connected, or else the default one
+func (worker Worker) account(job *pipeline.Job) (account.Account, error) {
+	connected, err := worker.accounts.Get(job.Photo.ChatId)
 
-	if worker.config.photoLocker[photoId] {
-		log.Printf("[INFO] Another upload in progress, aborting %s", photoId)
-		defer insta.Logout()
-		return uploadPhotoResponse, fmt.Errorf("[ERROR] Another upload in progress, aborting")
+	if err == account.ErrNotFound {
+		connected, err = worker.accounts.Get(account.Default)
 	}
-	worker.config.photoLocker[photoId] = true
 
-	uploadPhotoResponse, err = insta.UploadPhotoFromReader(photo,
-		caption, uploadId, quality, filterType)
+	if err == account.ErrNotFound {
+		return connected, retry.Permanent(errNoAccount)
+	}
+
+	return connected, err
+}
+
+// uploadAndDisableComments posts with upload on the session of the account
+// of the photo, api names the call in the metrics. upload is made again
+// when the session turns out to be gone, it must read the photo anew.
+func (worker Worker) uploadAndDisableComments(job *pipeline.Job, api string,
+	upload func(insta *goinsta.Instagram) (response.UploadPhotoResponse, error)) (response.UploadPhotoResponse, error) {
+
+	logger := job.Log
+	photoId := job.Photo.PhotoId
+
+	var uploadPhotoResponse response.UploadPhotoResponse
+
+	credentials, err := worker.account(job)
 
 	if err != nil {
-		log.Printf("[ERROR] Couldn't upload photo to instagram: %s", err)
+		logger.Printf("[ERROR] Couldn't find the instagram account of chat %d: %s", job.Photo.ChatId, err)
 		return uploadPhotoResponse, err
 	}
 
-	log.Printf("[DEBUG] Disabling comments for %s", photoId)
+	err = worker.sessions.use(credentials, func(insta *goinsta.Instagram) error {
+		var err error
+		start := time.Now()
+		uploadPhotoResponse, err = upload(insta)
 
-	worker.disableComments(insta, uploadPhotoResponse)
+		if err != nil {
+			metrics.ObserveAPI("instagram", api, start, "error")
+			return err
+		}
+
+		metrics.ObserveAPI("instagram", api, start, uploadPhotoResponse.Status)
+
+		// the photo is up, a failure from here on mustn't post it again
+		logger.Printf("[DEBUG] Disabling comments for %s", photoId)
+		worker.disableComments(logger, insta, uploadPhotoResponse)
+
+		return nil
+	})
 
 	if err != nil {
-		log.Printf("[ERROR] Couldn't disable comments: %s", err)
+		logger.Printf("[ERROR] Couldn't upload photo to instagram: %s", err)
 		return uploadPhotoResponse, err
 	}
 
-	defer insta.Logout()
-
 	return uploadPhotoResponse, nil
-}
\ No newline at end of file
+}
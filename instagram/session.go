@@ -0,0 +1,127 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ahmdrz/goinsta"
+	"github.com/nuxdie/instabot/account"
+	"github.com/nuxdie/instabot/metrics"
+)
+
+// Logging in for every photo looks like a bot to instagram and takes
+// seconds, so sessions are saved in the vault and every upload restores the
+// latest one, which other workers may have saved. A saved session is taken as
+// it is, a new login only happens once instagram answers login_required.
+
+type sessions struct {
+	accounts *account.Store
+	lock     sync.Mutex
+	chats    map[int64]*sync.Mutex // one request of a chat at a time
+}
+
+func newSessions(accounts *account.Store) *sessions {
+	return &sessions{
+		accounts: accounts,
+		chats:    make(map[int64]*sync.Mutex),
+	}
+}
+
+// use makes request with the session of credentials, logging in when there's
+// none. A request instagram answers login_required is made again once on a
+// new login, it mustn't have posted anything then. goinsta isn't safe for
+// concurrent use, requests of a chat wait for each other.
+func (sessions *sessions) use(credentials account.Account,
+	request func(insta *goinsta.Instagram) error) error {
+
+	lock := sessions.chatLock(credentials.ChatId)
+	lock.Lock()
+	defer lock.Unlock()
+
+	insta, err := sessions.accounts.Session(credentials)
+
+	if err != nil && err != account.ErrNoSession {
+		log.Printf("[WARN] Couldn't restore the Instagram session of %s: %s", credentials.Username, err)
+	}
+
+	if err != nil {
+		insta, err = sessions.login(credentials)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	err = request(insta)
+
+	if loginRequired(err) {
+		log.Printf("[WARN] Instagram dropped the session of %s, logging in again", credentials.Username)
+		insta, err = sessions.login(credentials)
+
+		if err != nil {
+			return err
+		}
+
+		err = request(insta)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	// instagram hands out new cookies along the way
+	sessions.save(credentials, insta)
+
+	return nil
+}
+
+func (sessions *sessions) chatLock(chatId int64) *sync.Mutex {
+	sessions.lock.Lock()
+	defer sessions.lock.Unlock()
+
+	lock, ok := sessions.chats[chatId]
+
+	if !ok {
+		lock = &sync.Mutex{}
+		sessions.chats[chatId] = lock
+	}
+
+	return lock
+}
+
+// login starts a new session and saves it
+func (sessions *sessions) login(credentials account.Account) (*goinsta.Instagram, error) {
+	start := time.Now()
+	insta, err := sessions.accounts.Login(credentials)
+
+	if err != nil {
+		metrics.ObserveAPI("instagram", "login", start, "error")
+		log.Printf("[ERROR] Couldn't login to Instagram as %s: %s", credentials.Username, err)
+		return nil, err
+	}
+
+	metrics.ObserveAPI("instagram", "login", start, "ok")
+	log.Printf("[INFO] Logged in to Instagram as %s", credentials.Username)
+
+	sessions.save(credentials, insta)
+
+	return insta, nil
+}
+
+// save keeps the session for the next request, without it the next one logs
+// in again
+func (sessions *sessions) save(credentials account.Account, insta *goinsta.Instagram) {
+	err := sessions.accounts.SaveSession(credentials, insta)
+
+	if err != nil {
+		log.Printf("[WARN] Couldn't save the Instagram session of %s: %s", credentials.Username, err)
+	}
+}
+
+// loginRequired tells whether instagram refused a request because it doesn't
+// take the session anymore
+func loginRequired(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "login_required")
+}
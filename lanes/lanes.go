@@ -0,0 +1,74 @@
+// this package runs work on a fixed number of goroutines. Work with the same
+// key always goes to the same lane, so it runs one at a time and in order.
+package lanes
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+type Pool struct {
+	lanes []chan func()
+	once  sync.Once
+}
+
+// New starts size lanes, each queueing up to queue functions
+func New(size, queue int) *Pool {
+	if size < 1 {
+		size = 1
+	}
+
+	pool := &Pool{
+		lanes: make([]chan func(), size),
+	}
+
+	for i := range pool.lanes {
+		pool.lanes[i] = make(chan func(), queue)
+		go run(pool.lanes[i])
+	}
+
+	return pool
+}
+
+// Submit queues fn on the lane of key. While that lane is full it blocks,
+// which is how back-pressure reaches whoever feeds the pool, unless stop is
+// closed first. false means fn was dropped.
+func (pool *Pool) Submit(stop <-chan struct{}, key string, fn func()) bool {
+	lane := pool.lanes[index(key, len(pool.lanes))]
+
+	select {
+	case lane <- fn:
+		return true
+	default:
+	}
+
+	select {
+	case lane <- fn:
+		return true
+	case <-stop:
+		return false
+	}
+}
+
+// Close lets the lanes exit once they ran everything queued. Nothing may be
+// submitted afterwards.
+func (pool *Pool) Close() {
+	pool.once.Do(func() {
+		for _, lane := range pool.lanes {
+			close(lane)
+		}
+	})
+}
+
+func run(lane chan func()) {
+	for fn := range lane {
+		fn()
+	}
+}
+
+func index(key string, size int) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+
+	return int(hash.Sum32() % uint32(size))
+}
@@ -0,0 +1,173 @@
+// this package turns the "[LEVEL] message" lines services write through the
+// standard log package into JSON lines, tagged with the photo they're about
+package logging
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/nuxdie/instabot/metadata"
+)
+
+// Levels in increasing order of severity, lines without a level are INFO
+var Levels = []string{"VERBOSE", "DEBUG", "INFO", "WARN", "ERROR", "FATAL"}
+
+const defaultLevel = "INFO"
+
+// Fields are added to every line of a logger, empty ones are left out
+type Fields struct {
+	Stage         string `json:"stage,omitempty"`
+	PhotoId       string `json:"photo_id,omitempty"`
+	ChatId        int64  `json:"chat_id,omitempty"`
+	CorrelationId string `json:"correlation_id,omitempty"`
+}
+
+type line struct {
+	Time  string `json:"time"`
+	Level string `json:"level"`
+	Fields
+	Message string `json:"msg"`
+}
+
+var config = struct {
+	sync.Mutex
+	output   io.Writer
+	minLevel int
+	stage    string
+}{
+	output:   os.Stderr,
+	minLevel: rank(defaultLevel),
+}
+
+// Setup makes the standard logger write JSON lines of at least minLevel
+// tagged with stage, which is also the default stage of every other logger
+func Setup(stage, minLevel string) {
+	config.Lock()
+	config.stage = stage
+	config.minLevel = rank(minLevel)
+	config.Unlock()
+
+	log.SetFlags(0)
+	log.SetPrefix("")
+	log.SetOutput(writer{})
+}
+
+// New returns a logger adding fields to every line
+func New(fields Fields) *log.Logger {
+	return log.New(writer{fields: fields}, "", 0)
+}
+
+// ForMessage returns a logger for everything done on behalf of message
+func ForMessage(message metadata.ChannelMessage) *log.Logger {
+	return New(MessageFields(message))
+}
+
+// ForPhoto returns a logger for everything done to photo
+func ForPhoto(photo metadata.PhotoMetadata) *log.Logger {
+	return New(PhotoFields(photo))
+}
+
+// MessageFields are the fields of ForMessage, to add a stage to
+func MessageFields(message metadata.ChannelMessage) Fields {
+	return Fields{
+		PhotoId:       message.PhotoId,
+		ChatId:        message.ChatId,
+		CorrelationId: message.CorrelationId,
+	}
+}
+
+// PhotoFields are the fields of ForPhoto, to add a stage to
+func PhotoFields(photo metadata.PhotoMetadata) Fields {
+	return Fields{
+		PhotoId:       photo.PhotoId,
+		ChatId:        photo.ChatId,
+		CorrelationId: photo.CorrelationId,
+	}
+}
+
+// NewCorrelationId returns a random ID to follow a photo through the services
+func NewCorrelationId() string {
+	id := make([]byte, 8)
+
+	_, err := rand.Read(id)
+
+	if err != nil {
+		return time.Now().UTC().Format("20060102150405.000000000")
+	}
+
+	return hex.EncodeToString(id)
+}
+
+type writer struct {
+	fields Fields
+}
+
+func (writer writer) Write(text []byte) (int, error) {
+	level, message := parse(text)
+
+	config.Lock()
+	defer config.Unlock()
+
+	if rank(level) < config.minLevel {
+		return len(text), nil
+	}
+
+	entry := line{
+		Time:    time.Now().UTC().Format(time.RFC3339Nano),
+		Level:   level,
+		Fields:  writer.fields,
+		Message: message,
+	}
+
+	if entry.Stage == "" {
+		entry.Stage = config.stage
+	}
+
+	encoded, err := json.Marshal(&entry)
+
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = config.output.Write(append(encoded, '\n'))
+
+	if err != nil {
+		return 0, err
+	}
+
+	return len(text), nil
+}
+
+// parse splits "[LEVEL] message\n" into its parts
+func parse(text []byte) (string, string) {
+	text = bytes.TrimRight(text, "\n")
+
+	if len(text) > 0 && text[0] == '[' {
+		if end := bytes.IndexByte(text, ']'); end > 0 {
+			level := string(text[1:end])
+
+			if rank(level) >= 0 {
+				return level, string(bytes.TrimLeft(text[end+1:], " "))
+			}
+		}
+	}
+
+	return defaultLevel, string(text)
+}
+
+func rank(level string) int {
+	for i, known := range Levels {
+		if known == level {
+			return i
+		}
+	}
+
+	return -1
+}
@@ -0,0 +1,73 @@
+package media
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ffmpeg gets that long to extract a frame
+const frameTimeout = 30 * time.Second
+
+var ErrNoFrame = errors.New("video has no frame at that offset")
+
+// ExtractFrame grabs the frame of a video at offset with ffmpeg, which has to
+// be in PATH, and returns it as a JPEG Instagram takes as it is. The video is
+// written to a temporary file first, MP4 files may keep their headers at the
+// end where ffmpeg can't get at them through a pipe.
+func ExtractFrame(video []byte, offset time.Duration) ([]byte, error) {
+	file, err := ioutil.TempFile("", "video")
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer os.Remove(file.Name())
+
+	_, err = file.Write(video)
+
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), frameTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+
+	command := exec.CommandContext(ctx, "ffmpeg", "-v", "error",
+		"-ss", strconv.FormatFloat(offset.Seconds(), 'f', 3, 64), "-i", file.Name(),
+		"-frames:v", "1", "-f", "image2pipe", "-c:v", "png", "pipe:1")
+	command.Stdout = &stdout
+	command.Stderr = &stderr
+
+	err = command.Run()
+
+	if err != nil {
+		return nil, fmt.Errorf("ffmpeg failed: %s %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	if stdout.Len() == 0 {
+		return nil, ErrNoFrame
+	}
+
+	frame, err := png.Decode(&stdout)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return EncodeJPEG(frame)
+}
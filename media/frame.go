@@ -0,0 +1,227 @@
+package media
+
+import (
+	"image"
+	"math"
+
+	"golang.org/x/image/draw"
+)
+
+// aspect ratios framed photos get: the limits, rounded to whole pixels at
+// Instagram's width so scaling doesn't push them out again
+var minFrameAspect = InstagramWidth / math.Floor(InstagramWidth/MinAspect)
+var maxFrameAspect = InstagramWidth / math.Ceil(InstagramWidth/MaxAspect)
+
+// SmartCrop looks for details at this width, it's plenty for brightness
+const saliencyWidth = 256
+
+// blurred backgrounds are scaled down to that width and back up
+const blurWidth = 24
+
+// entropy of a line is taken over that many brightness levels
+const entropyBins = 32
+
+// FitsAspect tells whether Instagram takes a photo of that size as it is
+func FitsAspect(width, height int) bool {
+	aspect := float64(width) / float64(height)
+
+	return aspect >= MinAspect && aspect <= MaxAspect
+}
+
+// cropSize is the largest part of an image with an aspect ratio Instagram
+// takes
+func cropSize(width, height int) (int, int) {
+	aspect := float64(width) / float64(height)
+
+	switch {
+	case aspect < MinAspect:
+		return width, int(float64(width) / minFrameAspect)
+	case aspect > MaxAspect:
+		return int(float64(height) * maxFrameAspect), height
+	}
+
+	return width, height
+}
+
+// padSize is the smallest canvas with an aspect ratio Instagram takes that
+// holds an image
+func padSize(width, height int) (int, int) {
+	aspect := float64(width) / float64(height)
+
+	switch {
+	case aspect < MinAspect:
+		return int(math.Ceil(float64(height) * minFrameAspect)), height
+	case aspect > MaxAspect:
+		return width, int(math.Ceil(float64(width) / maxFrameAspect))
+	}
+
+	return width, height
+}
+
+// SmartCrop cuts img to the closest aspect ratio Instagram takes. Of all the
+// parts of that size it keeps the one with the most detail, measured as the
+// entropy of the brightness of its rows or columns, and the middle one when
+// there's nothing to tell them apart.
+func SmartCrop(img image.Image) image.Image {
+	bounds := img.Bounds()
+	width, height := cropSize(bounds.Dx(), bounds.Dy())
+
+	if width == bounds.Dx() && height == bounds.Dy() {
+		return img
+	}
+
+	scale := float64(saliencyWidth) / float64(bounds.Dx())
+	grayHeight := int(float64(bounds.Dy())*scale + 0.5)
+
+	if grayHeight < 1 {
+		grayHeight = 1
+	}
+
+	gray := image.NewGray(image.Rect(0, 0, saliencyWidth, grayHeight))
+	draw.ApproxBiLinear.Scale(gray, gray.Bounds(), img, bounds, draw.Src, nil)
+
+	offset := image.Point{}
+
+	if height < bounds.Dy() {
+		start := bestWindow(lineEntropy(gray, true), int(float64(height)*scale))
+		offset.Y = clamp(int(float64(start)/scale+0.5), bounds.Dy()-height)
+	} else {
+		start := bestWindow(lineEntropy(gray, false), int(float64(width)*scale))
+		offset.X = clamp(int(float64(start)/scale+0.5), bounds.Dx()-width)
+	}
+
+	cropped := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(cropped, cropped.Bounds(), img, bounds.Min.Add(offset), draw.Src)
+
+	return cropped
+}
+
+// Pad puts img in the middle of the smallest canvas with an aspect ratio
+// Instagram takes. The rest is covered with a blurred, enlarged copy of img
+// or, when blur is false, white.
+func Pad(img image.Image, blur bool) image.Image {
+	bounds := img.Bounds()
+	width, height := padSize(bounds.Dx(), bounds.Dy())
+
+	if width == bounds.Dx() && height == bounds.Dy() {
+		return img
+	}
+
+	canvas := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	if blur {
+		blurInto(canvas, img)
+	} else {
+		draw.Draw(canvas, canvas.Bounds(), image.White, image.Point{}, draw.Src)
+	}
+
+	offset := image.Pt((width-bounds.Dx())/2, (height-bounds.Dy())/2)
+	draw.Draw(canvas, bounds.Sub(bounds.Min).Add(offset), img, bounds.Min, draw.Over)
+
+	return canvas
+}
+
+// blurInto covers canvas with the middle of img, blurred by scaling it down
+// to a few pixels and back up
+func blurInto(canvas *image.RGBA, img image.Image) {
+	bounds := img.Bounds()
+	canvasWidth, canvasHeight := canvas.Bounds().Dx(), canvas.Bounds().Dy()
+
+	// the largest part of img shaped like the canvas
+	width, height := bounds.Dx(), bounds.Dx()*canvasHeight/canvasWidth
+
+	if height > bounds.Dy() {
+		width, height = bounds.Dy()*canvasWidth/canvasHeight, bounds.Dy()
+	}
+
+	corner := bounds.Min.Add(image.Pt((bounds.Dx()-width)/2, (bounds.Dy()-height)/2))
+	cover := image.Rectangle{Min: corner, Max: corner.Add(image.Pt(width, height))}
+
+	smallHeight := blurWidth * canvasHeight / canvasWidth
+
+	if smallHeight < 1 {
+		smallHeight = 1
+	}
+
+	small := image.NewRGBA(image.Rect(0, 0, blurWidth, smallHeight))
+	draw.ApproxBiLinear.Scale(small, small.Bounds(), img, cover, draw.Src, nil)
+	draw.BiLinear.Scale(canvas, canvas.Bounds(), small, small.Bounds(), draw.Src, nil)
+}
+
+// lineEntropy is the entropy of the brightness of every row of gray, or of
+// every column when rows is false
+func lineEntropy(gray *image.Gray, rows bool) []float64 {
+	bounds := gray.Bounds()
+	lines, length := bounds.Dy(), bounds.Dx()
+
+	if !rows {
+		lines, length = length, lines
+	}
+
+	entropy := make([]float64, lines)
+
+	for line := 0; line < lines; line++ {
+		var histogram [entropyBins]int
+
+		for i := 0; i < length; i++ {
+			x, y := i, line
+
+			if !rows {
+				x, y = line, i
+			}
+
+			histogram[int(gray.GrayAt(bounds.Min.X+x, bounds.Min.Y+y).Y)*entropyBins/256]++
+		}
+
+		for _, count := range histogram {
+			if count > 0 {
+				p := float64(count) / float64(length)
+				entropy[line] -= p * math.Log2(p)
+			}
+		}
+	}
+
+	return entropy
+}
+
+// bestWindow is where size consecutive scores add up to the most, the
+// middle unless another window beats it
+func bestWindow(scores []float64, size int) int {
+	if size >= len(scores) {
+		return 0
+	}
+
+	if size < 1 {
+		size = 1
+	}
+
+	sums := make([]float64, len(scores)+1)
+
+	for i, score := range scores {
+		sums[i+1] = sums[i] + score
+	}
+
+	best := (len(scores) - size) / 2
+	bestSum := sums[best+size] - sums[best]
+
+	for start := 0; start+size <= len(scores); start++ {
+		// rounding errors of the sums mustn't move it off the middle
+		if sum := sums[start+size] - sums[start]; sum-bestSum > 1e-9 {
+			best, bestSum = start, sum
+		}
+	}
+
+	return best
+}
+
+func clamp(value, limit int) int {
+	if value < 0 {
+		return 0
+	}
+
+	if value > limit {
+		return limit
+	}
+
+	return value
+}
@@ -0,0 +1,114 @@
+package media
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestBestWindow(t *testing.T) {
+	tests := []struct {
+		name   string
+		scores []float64
+		size   int
+		want   int
+	}{
+		{"flat keeps the middle", []float64{1, 1, 1, 1, 1, 1}, 2, 2},
+		{"flat odd keeps the middle", []float64{1, 1, 1, 1, 1}, 2, 1},
+		{"detail at the start", []float64{5, 5, 0, 0, 0, 0}, 2, 0},
+		{"detail at the end", []float64{0, 0, 0, 0, 5, 5}, 2, 4},
+		{"detail in between", []float64{0, 4, 4, 1, 0, 0, 0, 0}, 3, 1},
+		{"ties keep the middle", []float64{2, 0, 2, 0, 2}, 1, 2},
+		{"earliest of equal windows off the middle", []float64{0, 2, 0, 0, 0, 0, 2, 0}, 2, 0},
+		{"window as large as the scores", []float64{1, 2, 3}, 3, 0},
+		{"window larger than the scores", []float64{1, 2, 3}, 5, 0},
+		{"empty window", []float64{0, 0, 9, 0}, 0, 2},
+	}
+
+	for _, test := range tests {
+		if got := bestWindow(test.scores, test.size); got != test.want {
+			t.Errorf("%s: got %d, want %d", test.name, got, test.want)
+		}
+	}
+}
+
+// stripes makes an image of width x height with black and white stripes in
+// the rows or columns from start to end. The other lines are plain, each in
+// a colour of its own so crops can be told apart.
+func stripes(width, height, start, end int, rows bool) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			line, across := y, x
+
+			if !rows {
+				line, across = x, y
+			}
+
+			pixel := color.RGBA{uint8(line % 256), uint8(line / 256), 0, 255}
+
+			if line >= start && line < end && across%2 == 0 {
+				pixel = color.RGBA{0, 0, 0, 255}
+			}
+
+			img.Set(x, y, pixel)
+		}
+	}
+
+	return img
+}
+
+// a detailed part must end up in the crop, a plain image is cropped in the
+// middle
+func TestSmartCrop(t *testing.T) {
+	tests := []struct {
+		name    string
+		img     image.Image
+		width   int
+		height  int
+		offsetX int
+		offsetY int
+	}{
+		{"tall plain", stripes(400, 1000, 0, 0, true), 400, 500, 0, 250},
+		{"tall detail at the top", stripes(400, 1000, 0, 300, true), 400, 500, 0, 0},
+		{"tall detail at the bottom", stripes(400, 1000, 700, 1000, true), 400, 500, 0, 500},
+		{"wide plain", stripes(1000, 400, 0, 0, false), 763, 400, 117, 0},
+		{"wide detail on the left", stripes(1000, 400, 0, 300, false), 763, 400, 0, 0},
+		{"wide detail on the right", stripes(1000, 400, 800, 1000, false), 763, 400, 237, 0},
+	}
+
+	for _, test := range tests {
+		cropped := SmartCrop(test.img)
+		bounds := cropped.Bounds()
+
+		if bounds.Dx() != test.width || bounds.Dy() != test.height {
+			t.Errorf("%s: got %dx%d, want %dx%d", test.name, bounds.Dx(), bounds.Dy(), test.width,
+				test.height)
+			continue
+		}
+
+		if !FitsAspect(bounds.Dx(), bounds.Dy()) {
+			t.Errorf("%s: %dx%d doesn't fit Instagram", test.name, bounds.Dx(), bounds.Dy())
+		}
+
+		// the crop must be the part of the image at the offset
+		for _, point := range []image.Point{{0, 0}, {1, 0}, {0, 1}, {bounds.Dx() - 1, bounds.Dy() - 1}} {
+			want := color.RGBAModel.Convert(test.img.At(point.X+test.offsetX, point.Y+test.offsetY))
+
+			if got := color.RGBAModel.Convert(cropped.At(point.X, point.Y)); got != want {
+				t.Errorf("%s: pixel %v is %v, want %v of the offset %d,%d", test.name, point, got, want,
+					test.offsetX, test.offsetY)
+				break
+			}
+		}
+	}
+}
+
+func TestSmartCropFitting(t *testing.T) {
+	img := stripes(800, 800, 0, 800, true)
+
+	if cropped := SmartCrop(img); cropped != img {
+		t.Errorf("square image was cropped to %v", cropped.Bounds())
+	}
+}
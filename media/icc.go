@@ -0,0 +1,464 @@
+package media
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"image"
+	"io"
+	"io/ioutil"
+	"math"
+
+	"golang.org/x/image/draw"
+)
+
+// Images may carry an ICC profile telling what their colours mean, e.g.
+// Display P3 or Adobe RGB. Instagram takes them as sRGB, so matrix/TRC
+// profiles of RGB and gray images, which is what cameras, phones and photo
+// editors embed, are converted. Anything else is turned down rather than
+// posted with wrong colours.
+
+var ErrColorProfile = errors.New("image has a colour profile that can't be converted to sRGB")
+
+// profiles larger than that aren't matrix/TRC profiles anyway
+const maxProfileSize = 4 << 20
+
+// linear light to sRGB is looked up with that many steps
+const encodeSteps = 4096
+
+// xyzToSRGB turns XYZ relative to D50, the profile connection space, into
+// linear sRGB, Bradford adapted to D65
+var xyzToSRGB = [3][3]float64{
+	{3.1338561, -1.6168667, -0.4906146},
+	{-0.9787684, 1.9161415, 0.0334540},
+	{0.0719453, -0.2289914, 1.4052427},
+}
+
+// colorTransform converts 8 bit values of a profile to sRGB
+type colorTransform struct {
+	gray   bool
+	curves [3][256]float64 // linear light of every value of each channel
+	matrix [3][3]float64   // linear channels to linear sRGB
+}
+
+// embeddedProfile extracts the ICC profile of a JPEG, PNG or WebP image, nil
+// when it has none
+func embeddedProfile(format string, data []byte) ([]byte, error) {
+	switch format {
+	case "jpeg":
+		return jpegProfile(data)
+	case "png":
+		return pngProfile(data)
+	case "webp":
+		return webpProfile(data)
+	}
+
+	return nil, nil
+}
+
+// jpegProfile joins the ICC_PROFILE chunks of the APP2 segments before the
+// image data
+func jpegProfile(data []byte) ([]byte, error) {
+	chunks := make(map[int][]byte)
+	count := 0
+
+	for i := 2; i+4 <= len(data) && data[i] == 0xff; {
+		marker := data[i+1]
+
+		switch {
+		case marker == 0xff: // fill byte
+			i++
+			continue
+		case marker == 0x01 || marker >= 0xd0 && marker <= 0xd8: // no payload
+			i += 2
+			continue
+		}
+
+		// start of scan and end of image, profiles come before that
+		if marker == 0xda || marker == 0xd9 {
+			break
+		}
+
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+
+		if length < 2 || i+2+length > len(data) {
+			return nil, ErrColorProfile
+		}
+
+		segment := data[i+4 : i+2+length]
+
+		if marker == 0xe2 && len(segment) > 14 && string(segment[:12]) == "ICC_PROFILE\x00" {
+			chunks[int(segment[12])] = segment[14:]
+			count = int(segment[13])
+		}
+
+		i += 2 + length
+	}
+
+	if len(chunks) == 0 {
+		return nil, nil
+	}
+
+	var profile []byte
+
+	for sequence := 1; sequence <= count; sequence++ {
+		chunk, ok := chunks[sequence]
+
+		if !ok {
+			return nil, ErrColorProfile
+		}
+
+		profile = append(profile, chunk...)
+	}
+
+	return profile, nil
+}
+
+// pngProfile inflates the iCCP chunk, it comes before the image data
+func pngProfile(data []byte) ([]byte, error) {
+	for i := 8; i+12 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[i:]))
+		kind := string(data[i+4 : i+8])
+
+		if length < 0 || i+12+length > len(data) {
+			return nil, ErrColorProfile
+		}
+
+		chunk := data[i+8 : i+8+length]
+
+		switch kind {
+		case "iCCP":
+			// profile name, a null byte and the compression method
+			name := bytes.IndexByte(chunk, 0)
+
+			if name < 0 || name+2 > len(chunk) {
+				return nil, ErrColorProfile
+			}
+
+			reader, err := zlib.NewReader(bytes.NewReader(chunk[name+2:]))
+
+			if err != nil {
+				return nil, ErrColorProfile
+			}
+
+			defer reader.Close()
+
+			profile, err := ioutil.ReadAll(io.LimitReader(reader, maxProfileSize))
+
+			if err != nil {
+				return nil, ErrColorProfile
+			}
+
+			return profile, nil
+		case "IDAT", "IEND":
+			return nil, nil
+		}
+
+		i += 12 + length
+	}
+
+	return nil, nil
+}
+
+// webpProfile returns the ICCP chunk of an extended WebP
+func webpProfile(data []byte) ([]byte, error) {
+	for i := 12; i+8 <= len(data); {
+		kind := string(data[i : i+4])
+		length := int(binary.LittleEndian.Uint32(data[i+4:]))
+
+		if length < 0 || i+8+length > len(data) {
+			return nil, ErrColorProfile
+		}
+
+		if kind == "ICCP" {
+			return data[i+8 : i+8+length], nil
+		}
+
+		// chunks are padded to an even size
+		i += 8 + length + length%2
+	}
+
+	return nil, nil
+}
+
+// parseProfile reads a matrix/TRC profile, a nil transform means its colours
+// are sRGB already
+func parseProfile(profile []byte) (*colorTransform, error) {
+	if len(profile) < 132 || string(profile[20:24]) != "XYZ " {
+		return nil, ErrColorProfile
+	}
+
+	tags := make(map[string][]byte)
+	count := int(binary.BigEndian.Uint32(profile[128:]))
+
+	for i := 0; i < count && 132+12*(i+1) <= len(profile); i++ {
+		entry := profile[132+12*i:]
+		offset := int(binary.BigEndian.Uint32(entry[4:]))
+		size := int(binary.BigEndian.Uint32(entry[8:]))
+
+		if offset < 0 || size < 0 || offset+size > len(profile) {
+			return nil, ErrColorProfile
+		}
+
+		tags[string(entry[:4])] = profile[offset : offset+size]
+	}
+
+	transform := &colorTransform{}
+
+	switch string(profile[16:20]) {
+	case "GRAY":
+		curve, err := parseCurve(tags["kTRC"])
+
+		if err != nil {
+			return nil, err
+		}
+
+		transform.gray = true
+		fillCurve(&transform.curves[0], curve)
+	case "RGB ":
+		var columns [3][3]float64
+
+		for channel, prefix := range []string{"r", "g", "b"} {
+			xyz, err := parseXYZ(tags[prefix+"XYZ"])
+
+			if err != nil {
+				return nil, err
+			}
+
+			curve, err := parseCurve(tags[prefix+"TRC"])
+
+			if err != nil {
+				return nil, err
+			}
+
+			columns[channel] = xyz
+			fillCurve(&transform.curves[channel], curve)
+		}
+
+		for row := 0; row < 3; row++ {
+			for column := 0; column < 3; column++ {
+				for i := 0; i < 3; i++ {
+					transform.matrix[row][column] += xyzToSRGB[row][i] * columns[column][i]
+				}
+			}
+		}
+	default:
+		return nil, ErrColorProfile
+	}
+
+	if transform.isSRGB() {
+		return nil, nil
+	}
+
+	return transform, nil
+}
+
+func parseXYZ(tag []byte) ([3]float64, error) {
+	var xyz [3]float64
+
+	if len(tag) < 20 || string(tag[:4]) != "XYZ " {
+		return xyz, ErrColorProfile
+	}
+
+	for i := range xyz {
+		xyz[i] = s15Fixed16(tag[8+4*i:])
+	}
+
+	return xyz, nil
+}
+
+// parseCurve reads a curv or para tone curve, mapping values from 0 to 1 to
+// linear light
+func parseCurve(tag []byte) (func(float64) float64, error) {
+	if len(tag) < 12 {
+		return nil, ErrColorProfile
+	}
+
+	switch string(tag[:4]) {
+	case "curv":
+		count := int(binary.BigEndian.Uint32(tag[8:]))
+
+		switch {
+		case count == 0:
+			return func(x float64) float64 { return x }, nil
+		case count == 1 && len(tag) >= 14:
+			gamma := float64(binary.BigEndian.Uint16(tag[12:])) / 256
+
+			return func(x float64) float64 { return math.Pow(x, gamma) }, nil
+		case count < 0 || len(tag) < 12+2*count:
+			return nil, ErrColorProfile
+		}
+
+		table := make([]float64, count)
+
+		for i := range table {
+			table[i] = float64(binary.BigEndian.Uint16(tag[12+2*i:])) / 65535
+		}
+
+		return func(x float64) float64 {
+			position := x * float64(count-1)
+			i := int(position)
+
+			if i >= count-1 {
+				return table[count-1]
+			}
+
+			return table[i] + (table[i+1]-table[i])*(position-float64(i))
+		}, nil
+	case "para":
+		kind := int(binary.BigEndian.Uint16(tag[8:]))
+		counts := []int{1, 3, 4, 5, 7}
+
+		if kind >= len(counts) || len(tag) < 12+4*counts[kind] {
+			return nil, ErrColorProfile
+		}
+
+		// g, a, b, c, d, e and f, as many as the function type has
+		p := [7]float64{1, 1, 0, 0, 0, 0, 0}
+
+		for i := 0; i < counts[kind]; i++ {
+			p[i] = s15Fixed16(tag[12+4*i:])
+		}
+
+		g, a, b, c, d, e, f := p[0], p[1], p[2], p[3], p[4], p[5], p[6]
+
+		return func(x float64) float64 {
+			switch kind {
+			case 0:
+				return math.Pow(x, g)
+			case 1:
+				if a*x+b < 0 {
+					return 0
+				}
+
+				return math.Pow(a*x+b, g)
+			case 2:
+				if a*x+b < 0 {
+					return c
+				}
+
+				return math.Pow(a*x+b, g) + c
+			case 3:
+				if x < d {
+					return c * x
+				}
+
+				return math.Pow(a*x+b, g)
+			}
+
+			if x < d {
+				return c*x + f
+			}
+
+			return math.Pow(a*x+b, g) + e
+		}, nil
+	}
+
+	return nil, ErrColorProfile
+}
+
+func s15Fixed16(data []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(data))) / 65536
+}
+
+func fillCurve(lut *[256]float64, curve func(float64) float64) {
+	for value := range lut {
+		lut[value] = curve(float64(value) / 255)
+	}
+}
+
+// isSRGB tells whether the transform leaves colours as they are, give or take
+// rounding
+func (transform *colorTransform) isSRGB() bool {
+	channels := 3
+
+	if transform.gray {
+		channels = 1
+	} else {
+		for row := 0; row < 3; row++ {
+			for column := 0; column < 3; column++ {
+				identity := 0.0
+
+				if row == column {
+					identity = 1
+				}
+
+				if math.Abs(transform.matrix[row][column]-identity) > 0.02 {
+					return false
+				}
+			}
+		}
+	}
+
+	for channel := 0; channel < channels; channel++ {
+		for value, linear := range transform.curves[channel] {
+			if math.Abs(linear-srgbToLinear(float64(value)/255)) > 0.01 {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// apply converts the colours of img to sRGB
+func (transform *colorTransform) apply(img image.Image) image.Image {
+	bounds := img.Bounds()
+	out := image.NewNRGBA(bounds)
+	draw.Draw(out, bounds, img, bounds.Min, draw.Src)
+
+	var encode [encodeSteps + 1]uint8
+
+	for i := range encode {
+		encode[i] = uint8(linearToSRGB(float64(i)/encodeSteps)*255 + 0.5)
+	}
+
+	lookup := func(linear float64) uint8 {
+		if linear <= 0 {
+			return encode[0]
+		}
+
+		if linear >= 1 {
+			return encode[encodeSteps]
+		}
+
+		return encode[int(linear*encodeSteps+0.5)]
+	}
+
+	for i := 0; i+3 < len(out.Pix); i += 4 {
+		pixel := out.Pix[i : i+3 : i+3]
+
+		if transform.gray {
+			value := lookup(transform.curves[0][pixel[0]])
+			pixel[0], pixel[1], pixel[2] = value, value, value
+			continue
+		}
+
+		r := transform.curves[0][pixel[0]]
+		g := transform.curves[1][pixel[1]]
+		b := transform.curves[2][pixel[2]]
+
+		for channel, row := range transform.matrix {
+			pixel[channel] = lookup(row[0]*r + row[1]*g + row[2]*b)
+		}
+	}
+
+	return out
+}
+
+func srgbToLinear(value float64) float64 {
+	if value <= 0.04045 {
+		return value / 12.92
+	}
+
+	return math.Pow((value+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(linear float64) float64 {
+	if linear <= 0.0031308 {
+		return linear * 12.92
+	}
+
+	return 1.055*math.Pow(linear, 1/2.4) - 0.055
+}
@@ -0,0 +1,319 @@
+package media
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"sort"
+	"testing"
+)
+
+// testProfile builds an ICC profile of colour space with the given tags
+func testProfile(space string, tags map[string][]byte) []byte {
+	names := make([]string, 0, len(tags))
+
+	for name := range tags {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	header := make([]byte, 132+12*len(names))
+	copy(header[16:], space)
+	copy(header[20:], "XYZ ")
+	binary.BigEndian.PutUint32(header[128:], uint32(len(names)))
+
+	offset := len(header)
+
+	for i, name := range names {
+		entry := header[132+12*i:]
+		copy(entry, name)
+		binary.BigEndian.PutUint32(entry[4:], uint32(offset))
+		binary.BigEndian.PutUint32(entry[8:], uint32(len(tags[name])))
+		offset += len(tags[name])
+	}
+
+	profile := header
+
+	for _, name := range names {
+		profile = append(profile, tags[name]...)
+	}
+
+	binary.BigEndian.PutUint32(profile, uint32(len(profile)))
+
+	return profile
+}
+
+func fixed(value float64) []byte {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, uint32(int32(value*65536)))
+
+	return data
+}
+
+func xyzTag(x, y, z float64) []byte {
+	tag := append([]byte("XYZ \x00\x00\x00\x00"), fixed(x)...)
+	tag = append(tag, fixed(y)...)
+
+	return append(tag, fixed(z)...)
+}
+
+func gammaTag(gamma float64) []byte {
+	tag := []byte("curv\x00\x00\x00\x00\x00\x00\x00\x01\x00\x00")
+	binary.BigEndian.PutUint16(tag[12:], uint16(gamma*256))
+
+	return tag
+}
+
+// the sRGB tone curve as a parametric curve
+func srgbCurveTag() []byte {
+	tag := []byte("para\x00\x00\x00\x00\x00\x03\x00\x00")
+
+	for _, value := range []float64{2.4, 1 / 1.055, 0.055 / 1.055, 1 / 12.92, 0.04045} {
+		tag = append(tag, fixed(value)...)
+	}
+
+	return tag
+}
+
+func rgbProfile(red, green, blue [3]float64, curve []byte) []byte {
+	return testProfile("RGB ", map[string][]byte{
+		"rXYZ": xyzTag(red[0], red[1], red[2]),
+		"gXYZ": xyzTag(green[0], green[1], green[2]),
+		"bXYZ": xyzTag(blue[0], blue[1], blue[2]),
+		"rTRC": curve,
+		"gTRC": curve,
+		"bTRC": curve,
+	})
+}
+
+// primaries adapted to D50
+var srgbProfile = rgbProfile([3]float64{0.4360747, 0.2225045, 0.0139322},
+	[3]float64{0.3850649, 0.7168786, 0.0971045}, [3]float64{0.1430804, 0.0606169, 0.7141733}, srgbCurveTag())
+
+var displayP3Profile = rgbProfile([3]float64{0.5151, 0.2412, -0.0011},
+	[3]float64{0.2920, 0.6922, 0.0419}, [3]float64{0.1571, 0.0666, 0.7841}, srgbCurveTag())
+
+var grayProfile = testProfile("GRAY", map[string][]byte{"kTRC": gammaTag(1.8)})
+
+func near(got, want color.NRGBA, tolerance int) bool {
+	for _, pair := range [][2]uint8{{got.R, want.R}, {got.G, want.G}, {got.B, want.B}, {got.A, want.A}} {
+		if diff := int(pair[0]) - int(pair[1]); diff > tolerance || diff < -tolerance {
+			return false
+		}
+	}
+
+	return true
+}
+
+func TestParseProfile(t *testing.T) {
+	tests := []struct {
+		name    string
+		profile []byte
+		err     error
+		srgb    bool
+	}{
+		{"sRGB", srgbProfile, nil, true},
+		{"Display P3", displayP3Profile, nil, false},
+		{"gray gamma 1.8", grayProfile, nil, false},
+		{"CMYK", testProfile("CMYK", map[string][]byte{"A2B0": []byte("mft2")}), ErrColorProfile, false},
+		{"RGB without matrix", testProfile("RGB ", map[string][]byte{"A2B0": []byte("mft2")}),
+			ErrColorProfile, false},
+		{"truncated", srgbProfile[:100], ErrColorProfile, false},
+	}
+
+	for _, test := range tests {
+		transform, err := parseProfile(test.profile)
+
+		if err != test.err {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.err)
+			continue
+		}
+
+		if err == nil && (transform == nil) != test.srgb {
+			t.Errorf("%s: got transform %v, want sRGB %v", test.name, transform, test.srgb)
+		}
+	}
+}
+
+func TestColorTransform(t *testing.T) {
+	tests := []struct {
+		name    string
+		profile []byte
+		in      color.NRGBA
+		want    color.NRGBA
+	}{
+		// P3 red is out of the sRGB gamut, it's clipped
+		{"P3 red", displayP3Profile, color.NRGBA{255, 0, 0, 255}, color.NRGBA{255, 0, 0, 255}},
+		// sRGB red as P3
+		{"P3 sRGB red", displayP3Profile, color.NRGBA{234, 51, 35, 255}, color.NRGBA{255, 0, 0, 255}},
+		{"P3 gray", displayP3Profile, color.NRGBA{128, 128, 128, 255}, color.NRGBA{128, 128, 128, 255}},
+		{"P3 alpha", displayP3Profile, color.NRGBA{128, 128, 128, 100}, color.NRGBA{128, 128, 128, 100}},
+		{"gray 1.8", grayProfile, color.NRGBA{128, 128, 128, 255}, color.NRGBA{147, 147, 147, 255}},
+		{"gray black", grayProfile, color.NRGBA{0, 0, 0, 255}, color.NRGBA{0, 0, 0, 255}},
+	}
+
+	for _, test := range tests {
+		transform, err := parseProfile(test.profile)
+
+		if err != nil || transform == nil {
+			t.Fatalf("%s: got %v, %v", test.name, transform, err)
+		}
+
+		img := image.NewNRGBA(image.Rect(0, 0, 2, 2))
+		img.SetNRGBA(1, 1, test.in)
+
+		got := transform.apply(img).(*image.NRGBA).NRGBAAt(1, 1)
+
+		if !near(got, test.want, 3) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+// withJPEGProfile puts profile into APP2 segments of two chunks after the
+// start of image
+func withJPEGProfile(data, profile []byte) []byte {
+	half := len(profile) / 2
+	out := append([]byte(nil), data[:2]...)
+
+	for i, chunk := range [][]byte{profile[:half], profile[half:]} {
+		segment := append([]byte("ICC_PROFILE\x00"), byte(i+1), 2)
+		segment = append(segment, chunk...)
+		out = append(out, 0xff, 0xe2, byte((len(segment)+2)>>8), byte(len(segment)+2))
+		out = append(out, segment...)
+	}
+
+	return append(out, data[2:]...)
+}
+
+// withPNGProfile puts profile into an iCCP chunk after the header chunk
+func withPNGProfile(data, profile []byte) []byte {
+	var compressed bytes.Buffer
+	writer := zlib.NewWriter(&compressed)
+	writer.Write(profile)
+	writer.Close()
+
+	chunk := append([]byte("iCCPtest\x00\x00"), compressed.Bytes()...)
+	length := make([]byte, 4)
+	binary.BigEndian.PutUint32(length, uint32(len(chunk)-4))
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(chunk))
+
+	// signature and the 25 bytes of the header chunk
+	out := append([]byte(nil), data[:33]...)
+	out = append(out, length...)
+	out = append(out, chunk...)
+	out = append(out, crc...)
+
+	return append(out, data[33:]...)
+}
+
+func solid(pixel color.NRGBA) image.Image {
+	img := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			img.SetNRGBA(x, y, pixel)
+		}
+	}
+
+	return img
+}
+
+func TestEmbeddedProfile(t *testing.T) {
+	var jpegData, pngData bytes.Buffer
+	jpeg.Encode(&jpegData, solid(color.NRGBA{255, 0, 0, 255}), nil)
+	png.Encode(&pngData, solid(color.NRGBA{255, 0, 0, 255}))
+
+	webpData := []byte("RIFF\x00\x00\x00\x00WEBPVP8X\x0a\x00\x00\x00\x20\x00\x00\x00\x00\x00\x00\x00\x00\x00")
+	iccp := make([]byte, 8)
+	copy(iccp, "ICCP")
+	binary.LittleEndian.PutUint32(iccp[4:], uint32(len(displayP3Profile)))
+	webpData = append(append(webpData, iccp...), displayP3Profile...)
+
+	tests := []struct {
+		format string
+		data   []byte
+		want   []byte
+	}{
+		{"jpeg", jpegData.Bytes(), nil},
+		{"jpeg", withJPEGProfile(jpegData.Bytes(), displayP3Profile), displayP3Profile},
+		{"png", pngData.Bytes(), nil},
+		{"png", withPNGProfile(pngData.Bytes(), displayP3Profile), displayP3Profile},
+		{"webp", webpData, displayP3Profile},
+		{"gif", []byte("GIF89a"), nil},
+	}
+
+	for _, test := range tests {
+		got, err := embeddedProfile(test.format, test.data)
+
+		if err != nil || !bytes.Equal(got, test.want) {
+			t.Errorf("%s: got %d bytes, %v, want %d bytes", test.format, len(got), err, len(test.want))
+		}
+	}
+
+	// one chunk of two
+	broken := withJPEGProfile(jpegData.Bytes(), displayP3Profile)
+	broken[2+4+12] = 3
+
+	if _, err := embeddedProfile("jpeg", broken); err != ErrColorProfile {
+		t.Errorf("incomplete profile: got %v, want %v", err, ErrColorProfile)
+	}
+}
+
+func TestNormalizeImageProfile(t *testing.T) {
+	var pngData bytes.Buffer
+	png.Encode(&pngData, solid(color.NRGBA{234, 51, 35, 255}))
+
+	cmyk := testProfile("CMYK", map[string][]byte{"A2B0": []byte("mft2")})
+
+	tests := []struct {
+		name    string
+		profile []byte
+		want    color.NRGBA
+		err     error
+	}{
+		{"no profile", nil, color.NRGBA{234, 51, 35, 255}, nil},
+		{"sRGB", srgbProfile, color.NRGBA{234, 51, 35, 255}, nil},
+		{"Display P3", displayP3Profile, color.NRGBA{255, 0, 0, 255}, nil},
+		{"CMYK", cmyk, color.NRGBA{}, ErrColorProfile},
+	}
+
+	for _, test := range tests {
+		data := pngData.Bytes()
+
+		if test.profile != nil {
+			data = withPNGProfile(data, test.profile)
+		}
+
+		out, err := NormalizeImage(data)
+
+		if err != test.err {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.err)
+			continue
+		}
+
+		if err != nil {
+			continue
+		}
+
+		img, err := jpeg.Decode(bytes.NewReader(out))
+
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+
+		got := color.NRGBAModel.Convert(img.At(540, 540)).(color.NRGBA)
+
+		// JPEG isn't lossless
+		if !near(got, test.want, 6) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
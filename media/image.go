@@ -0,0 +1,96 @@
+package media
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// InstagramWidth is the width Instagram stores photos at
+const InstagramWidth = 1080
+
+const jpegQuality = 90
+
+// decoding more than that would take too much memory
+const maxPixels = 50 * 1000 * 1000
+
+var ErrImageTooLarge = errors.New("image has too many pixels")
+
+// IsStillImage tells whether NormalizeImage takes images of mimeType
+func IsStillImage(mimeType string) bool {
+	switch mimeType {
+	case "image/jpeg", "image/jpg", "image/png", "image/webp", "image/gif":
+		return true
+	}
+
+	return false
+}
+
+// NormalizeImage turns a JPEG, PNG, WebP or GIF image into an Instagram ready
+// JPEG: 8 bit sRGB, 1080 pixels wide, with transparency flattened onto white.
+// Embedded colour profiles are converted to sRGB, see icc.go, images with one
+// that can't be get ErrColorProfile. Animated GIFs give their first frame.
+func NormalizeImage(data []byte) ([]byte, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if config.Width <= 0 || config.Height <= 0 || config.Width*config.Height > maxPixels {
+		return nil, ErrImageTooLarge
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+
+	if err != nil {
+		return nil, err
+	}
+
+	profile, err := embeddedProfile(format, data)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if profile != nil {
+		transform, err := parseProfile(profile)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if transform != nil {
+			src = transform.apply(src)
+		}
+	}
+
+	return EncodeJPEG(src)
+}
+
+// EncodeJPEG scales img to 1080 pixels wide, flattens it onto white and
+// encodes it as JPEG
+func EncodeJPEG(img image.Image) ([]byte, error) {
+	bounds := img.Bounds()
+	height := (bounds.Dy()*InstagramWidth + bounds.Dx()/2) / bounds.Dx()
+
+	if height < 1 {
+		height = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, InstagramWidth, height))
+	draw.Draw(dst, dst.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, draw.Over, nil)
+
+	var out bytes.Buffer
+
+	err := jpeg.Encode(&out, dst, &jpeg.Options{Quality: jpegQuality})
+
+	return out.Bytes(), err
+}
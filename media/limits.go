@@ -0,0 +1,100 @@
+package media
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Instagram feed videos, photos have to keep to the same aspect ratios
+const MinDuration = time.Second * 3
+const MaxDuration = time.Second * 60
+const MinAspect = 4.0 / 5.0
+const MaxAspect = 1.91
+
+// MaxSize is the largest file a bot may download from telegram, Instagram
+// would take bigger ones
+const MaxSize = 20 * 1024 * 1024
+
+// what a LimitError is about
+const LimitTooShort = "too_short"
+const LimitTooLong = "too_long"
+const LimitTooBig = "too_big"
+const LimitAspect = "aspect"
+
+// LimitError tells which limit a video breaks, all values are formatted to
+// be shown to users
+type LimitError struct {
+	Limit string
+	Value string
+	Min   string
+	Max   string
+}
+
+func (err *LimitError) Error() string {
+	return fmt.Sprintf("video is %s: %s, allowed %s to %s", err.Limit, err.Value, err.Min, err.Max)
+}
+
+// CheckSize fails for files a bot can't download, so nothing has to be
+// downloaded to turn them down
+func CheckSize(size int64) error {
+	if size > MaxSize {
+		return &LimitError{
+			Limit: LimitTooBig,
+			Value: megabytes(size),
+			Min:   megabytes(0),
+			Max:   megabytes(MaxSize),
+		}
+	}
+
+	return nil
+}
+
+// Validate checks a video of size bytes against the limits of Instagram
+func Validate(info Info, size int64) error {
+	err := CheckSize(size)
+
+	if err != nil {
+		return err
+	}
+
+	if info.Duration < MinDuration || info.Duration > MaxDuration {
+		limit := LimitTooShort
+
+		if info.Duration > MaxDuration {
+			limit = LimitTooLong
+		}
+
+		return &LimitError{
+			Limit: limit,
+			Value: seconds(info.Duration),
+			Min:   seconds(MinDuration),
+			Max:   seconds(MaxDuration),
+		}
+	}
+
+	if info.Width <= 0 || info.Height <= 0 {
+		return ErrNotMP4
+	}
+
+	aspect := float64(info.Width) / float64(info.Height)
+
+	if aspect < MinAspect || aspect > MaxAspect {
+		return &LimitError{
+			Limit: LimitAspect,
+			Value: fmt.Sprintf("%dx%d", info.Width, info.Height),
+			Min:   "4:5",
+			Max:   "1.91:1",
+		}
+	}
+
+	return nil
+}
+
+func megabytes(size int64) string {
+	return fmt.Sprintf("%.1f MB", float64(size)/1024/1024)
+}
+
+func seconds(duration time.Duration) string {
+	return strconv.FormatFloat(duration.Seconds(), 'f', -1, 64) + "s"
+}
@@ -0,0 +1,135 @@
+// this package knows about the videos Instagram takes: it reads duration and
+// dimensions from MP4 headers and checks them against Instagram's limits
+package media
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+var ErrNotMP4 = errors.New("not an MP4 video")
+
+// Info is what Instagram cares about in a video
+type Info struct {
+	Duration time.Duration
+	Width    int
+	Height   int
+}
+
+// ProbeMP4 reads the movie and the first video track header of an MP4 file
+func ProbeMP4(data []byte) (Info, error) {
+	var info Info
+
+	found, err := walk(data, &info)
+
+	if err != nil {
+		return info, err
+	}
+
+	if !found {
+		return info, ErrNotMP4
+	}
+
+	return info, nil
+}
+
+// walk goes through the boxes of data, descending into the movie and its
+// tracks. true means a movie header was found.
+func walk(data []byte, info *Info) (bool, error) {
+	found := false
+
+	for len(data) >= 8 {
+		size := uint64(binary.BigEndian.Uint32(data[0:4]))
+		kind := string(data[4:8])
+		header := uint64(8)
+
+		switch size {
+		case 0: // up to the end of the file
+			size = uint64(len(data))
+		case 1: // 64 bit size
+			if len(data) < 16 {
+				return found, ErrNotMP4
+			}
+
+			size = binary.BigEndian.Uint64(data[8:16])
+			header = 16
+		}
+
+		if size < header || size > uint64(len(data)) {
+			return found, ErrNotMP4
+		}
+
+		body := data[header:size]
+
+		switch kind {
+		case "moov", "trak":
+			inner, err := walk(body, info)
+
+			if err != nil {
+				return found, err
+			}
+
+			found = found || inner
+		case "mvhd":
+			err := movieHeader(body, info)
+
+			if err != nil {
+				return found, err
+			}
+
+			found = true
+		case "tkhd":
+			trackHeader(body, info)
+		}
+
+		data = data[size:]
+	}
+
+	return found, nil
+}
+
+func movieHeader(body []byte, info *Info) error {
+	var timescale, duration uint64
+
+	switch {
+	case len(body) >= 20 && body[0] == 0:
+		timescale = uint64(binary.BigEndian.Uint32(body[12:16]))
+		duration = uint64(binary.BigEndian.Uint32(body[16:20]))
+	case len(body) >= 32 && body[0] == 1:
+		timescale = uint64(binary.BigEndian.Uint32(body[20:24]))
+		duration = binary.BigEndian.Uint64(body[24:32])
+	default:
+		return ErrNotMP4
+	}
+
+	if timescale == 0 {
+		return ErrNotMP4
+	}
+
+	info.Duration = time.Duration(duration) * time.Second / time.Duration(timescale)
+
+	return nil
+}
+
+// trackHeader takes the dimensions of the first track that has any, audio
+// tracks have none
+func trackHeader(body []byte, info *Info) {
+	if info.Width != 0 {
+		return
+	}
+
+	offset := 76
+
+	if len(body) > 0 && body[0] == 1 {
+		offset = 88
+	}
+
+	if len(body) < offset+8 {
+		return
+	}
+
+	// 16.16 fixed point
+	info.Width = int(binary.BigEndian.Uint32(body[offset:offset+4]) >> 16)
+	info.Height = int(binary.BigEndian.Uint32(body[offset+4:offset+8]) >> 16)
+}
@@ -0,0 +1,85 @@
+package metadata
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// StageAttempts returns how often stage failed the photo since it last
+// succeeded
+func (photo PhotoMetadata) StageAttempts(stage string) int {
+	return photo.stageAttempts()[stage]
+}
+
+// CountAttempt counts a failed attempt of stage and returns the attempts it
+// has made. Attempts and FailedStage tell about the latest failure.
+func (photo *PhotoMetadata) CountAttempt(stage string) int {
+	attempts := photo.stageAttempts()
+	attempts[stage]++
+	photo.setStageAttempts(attempts)
+
+	photo.Attempts = attempts[stage]
+	photo.FailedStage = stage
+
+	return photo.Attempts
+}
+
+// ResetAttempts forgets the failed attempts of stage once it succeeded
+func (photo *PhotoMetadata) ResetAttempts(stage string) {
+	attempts := photo.stageAttempts()
+	delete(attempts, stage)
+	photo.setStageAttempts(attempts)
+
+	if photo.FailedStage == stage {
+		photo.Attempts = 0
+		photo.Error = ""
+		photo.FailedStage = ""
+	}
+}
+
+// ClearAttempts forgets the failed attempts of every stage
+func (photo *PhotoMetadata) ClearAttempts() {
+	photo.AttemptsByStage = ""
+	photo.Attempts = 0
+	photo.Error = ""
+	photo.FailedStage = ""
+}
+
+// stageAttempts parses "<stage>:<attempts>,..."
+func (photo PhotoMetadata) stageAttempts() map[string]int {
+	attempts := make(map[string]int)
+
+	if photo.AttemptsByStage == "" {
+		return attempts
+	}
+
+	for _, entry := range strings.Split(photo.AttemptsByStage, ",") {
+		parts := strings.SplitN(entry, ":", 2)
+
+		if len(parts) != 2 {
+			continue
+		}
+
+		count, err := strconv.Atoi(parts[1])
+
+		if err == nil {
+			attempts[parts[0]] = count
+		}
+	}
+
+	return attempts
+}
+
+func (photo *PhotoMetadata) setStageAttempts(attempts map[string]int) {
+	entries := make([]string, 0, len(attempts))
+
+	for stage, count := range attempts {
+		entries = append(entries, stage+":"+strconv.Itoa(count))
+	}
+
+	// the same attempts always encode the same, Update writes changed fields only
+	sort.Strings(entries)
+
+	photo.AttemptsByStage = strings.Join(entries, ",")
+}
@@ -0,0 +1,48 @@
+package metadata
+
+import "testing"
+
+func TestStageAttempts(t *testing.T) {
+	photo := PhotoMetadata{PhotoId: "photo"}
+
+	photo.CountAttempt("caption")
+	photo.CountAttempt("hashtag")
+	photo.CountAttempt("caption")
+
+	tests := []struct {
+		stage string
+		want  int
+	}{
+		{"caption", 2},
+		{"hashtag", 1},
+		{"nsfw", 0},
+	}
+
+	for _, test := range tests {
+		if got := photo.StageAttempts(test.stage); got != test.want {
+			t.Errorf("%s: got %d attempts, want %d", test.stage, got, test.want)
+		}
+	}
+
+	if photo.FailedStage != "caption" || photo.Attempts != 2 {
+		t.Errorf("latest failure is %s after %d attempts, want caption after 2", photo.FailedStage,
+			photo.Attempts)
+	}
+
+	photo.ResetAttempts("hashtag")
+
+	if photo.StageAttempts("hashtag") != 0 || photo.StageAttempts("caption") != 2 {
+		t.Errorf("reset of hashtag left %q", photo.AttemptsByStage)
+	}
+
+	if photo.FailedStage != "caption" {
+		t.Errorf("reset of hashtag cleared the failure of %s", photo.FailedStage)
+	}
+
+	photo.ResetAttempts("caption")
+
+	if photo.AttemptsByStage != "" || photo.FailedStage != "" || photo.Attempts != 0 {
+		t.Errorf("reset of caption left %q, %s after %d attempts", photo.AttemptsByStage,
+			photo.FailedStage, photo.Attempts)
+	}
+}
@@ -0,0 +1,95 @@
+package metadata
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+
+	"github.com/mitchellh/mapstructure"
+)
+
+// DecodeError is returned when a stored record can't be mapped to
+// PhotoMetadata, retrying won't help with it
+type DecodeError struct {
+	PhotoId string
+	Err     error
+}
+
+func (err *DecodeError) Error() string {
+	return fmt.Sprintf("couldn't decode photo %s: %s", err.PhotoId, err.Err)
+}
+
+func IsDecodeError(err error) bool {
+	_, ok := err.(*DecodeError)
+	return ok
+}
+
+// encode flattens photo to hash fields the same way go-redis would write them
+func encode(photo PhotoMetadata) map[string]string {
+	fields := make(map[string]string)
+	value := reflect.ValueOf(photo)
+	kind := value.Type()
+
+	for i := 0; i < kind.NumField(); i++ {
+		name := kind.Field(i).Tag.Get("mapstructure")
+
+		if name == "" {
+			continue
+		}
+
+		field := value.Field(i)
+
+		switch field.Kind() {
+		case reflect.String:
+			fields[name] = field.String()
+		case reflect.Int, reflect.Int64:
+			fields[name] = strconv.FormatInt(field.Int(), 10)
+		case reflect.Bool:
+			if field.Bool() {
+				fields[name] = "1"
+			} else {
+				fields[name] = "0"
+			}
+		default:
+			panic(fmt.Sprintf("metadata: can't encode field %s of kind %s", name, field.Kind()))
+		}
+	}
+
+	return fields
+}
+
+func decode(photoId string, fields map[string]string) (PhotoMetadata, error) {
+	var photo PhotoMetadata
+
+	err := mapstructure.WeakDecode(fields, &photo)
+
+	if err != nil {
+		return photo, &DecodeError{PhotoId: photoId, Err: err}
+	}
+
+	return photo, nil
+}
+
+// Apply copies fields, e.g. a stage result, onto photo
+func (photo *PhotoMetadata) Apply(fields map[string]interface{}) error {
+	err := mapstructure.WeakDecode(fields, photo)
+
+	if err != nil {
+		return &DecodeError{PhotoId: photo.PhotoId, Err: err}
+	}
+
+	return nil
+}
+
+// changed returns fields of after that differ from before
+func changed(before, after map[string]string) map[string]interface{} {
+	diff := make(map[string]interface{})
+
+	for key, value := range after {
+		if old, ok := before[key]; !ok || old != value {
+			diff[key] = value
+		}
+	}
+
+	return diff
+}
@@ -0,0 +1,47 @@
+package metadata
+
+// Framing values, how a photo Instagram wouldn't take as it is gets fitted
+const FramingCrop = "crop"
+const FramingBlur = "blur"
+const FramingSolid = "solid"
+
+// Framings lists every framing in the order they're offered
+var Framings = []string{FramingCrop, FramingBlur, FramingSolid}
+
+// FramedUrl is the version of the photo framed that way, empty when there's
+// none
+func (photo PhotoMetadata) FramedUrl(framing string) string {
+	switch framing {
+	case FramingCrop:
+		return photo.CropUrl
+	case FramingBlur:
+		return photo.BlurUrl
+	case FramingSolid:
+		return photo.SolidUrl
+	}
+
+	return ""
+}
+
+// Framings lists the framed versions there are of the photo, none when
+// Instagram takes it as it is
+func (photo PhotoMetadata) Framings() []string {
+	framings := make([]string, 0, len(Framings))
+
+	for _, framing := range Framings {
+		if photo.FramedUrl(framing) != "" {
+			framings = append(framings, framing)
+		}
+	}
+
+	return framings
+}
+
+// UploadUrl is what gets posted: the chosen framed version or the photo
+func (photo PhotoMetadata) UploadUrl() string {
+	if framed := photo.FramedUrl(photo.Framing); framed != "" {
+		return framed
+	}
+
+	return photo.PhotoUrl
+}
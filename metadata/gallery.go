@@ -0,0 +1,65 @@
+package metadata
+
+import (
+	"strconv"
+	"strings"
+)
+
+// MaxGalleryItems is the most photos Instagram takes in one carousel
+const MaxGalleryItems = 10
+
+const galleryPrefix = "gallery:"
+
+// GalleryId names the gallery of a telegram album, media group IDs are only
+// unique within a chat
+func GalleryId(chatId int64, mediaGroupId string) string {
+	return galleryPrefix + strconv.FormatInt(chatId, 10) + ":" + mediaGroupId
+}
+
+// IsGallery tells a gallery record from a photo record. Galleries have no
+// photo of their own, they're published as a carousel of their items.
+func (photo PhotoMetadata) IsGallery() bool {
+	return strings.HasPrefix(photo.PhotoId, galleryPrefix)
+}
+
+// ItemIds returns the photo IDs of the gallery items in album order
+func (photo PhotoMetadata) ItemIds() []string {
+	if photo.Items == "" {
+		return nil
+	}
+
+	return strings.Split(photo.Items, ",")
+}
+
+// AddItem appends a photo to the gallery, false means it's full
+func (photo *PhotoMetadata) AddItem(photoId string) bool {
+	itemIds := photo.ItemIds()
+
+	for _, itemId := range itemIds {
+		if itemId == photoId {
+			return true
+		}
+	}
+
+	if len(itemIds) >= MaxGalleryItems {
+		return false
+	}
+
+	photo.Items = strings.Join(append(itemIds, photoId), ",")
+
+	return true
+}
+
+// RemoveItem drops a photo from the gallery
+func (photo *PhotoMetadata) RemoveItem(photoId string) {
+	itemIds := photo.ItemIds()
+	kept := itemIds[:0]
+
+	for _, itemId := range itemIds {
+		if itemId != photoId {
+			kept = append(kept, itemId)
+		}
+	}
+
+	photo.Items = strings.Join(kept, ",")
+}
@@ -0,0 +1,19 @@
+package metadata
+
+// MediaType values, records without one are photos
+const MediaPhoto = "photo"
+const MediaVideo = "video"
+
+func (photo PhotoMetadata) IsVideo() bool {
+	return photo.MediaType == MediaVideo
+}
+
+// ImageUrl is the image stages look at: the photo itself or the cover frame
+// of a video
+func (photo PhotoMetadata) ImageUrl() string {
+	if photo.IsVideo() {
+		return photo.CoverUrl
+	}
+
+	return photo.PhotoUrl
+}
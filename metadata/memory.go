@@ -0,0 +1,101 @@
+package metadata
+
+import (
+	"sync"
+)
+
+// MemoryStore is a Store kept in process memory. Records go through the
+// same encoding as in redis, so it behaves the same way for handler tests
+// and single process setups.
+type MemoryStore struct {
+	lock     sync.Mutex
+	records  map[string]map[string]string
+	messages []ChannelMessage
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		records: make(map[string]map[string]string),
+	}
+}
+
+func (store *MemoryStore) Get(photoId string) (PhotoMetadata, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	fields, ok := store.records[photoId]
+
+	if !ok {
+		return PhotoMetadata{}, ErrNotFound
+	}
+
+	return decode(photoId, fields)
+}
+
+func (store *MemoryStore) Create(photo PhotoMetadata, messages ...ChannelMessage) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	var version int64
+
+	if fields, ok := store.records[photo.PhotoId]; ok {
+		old, err := decode(photo.PhotoId, fields)
+
+		if err == nil && !old.State.Final() {
+			return ErrExists
+		}
+
+		version = old.Version
+	}
+
+	record := newRecord(photo, version)
+	store.records[photo.PhotoId] = encode(record)
+	store.publish(record, messages)
+
+	return nil
+}
+
+func (store *MemoryStore) Update(photoId string, fn func(photo *PhotoMetadata) error,
+	messages ...ChannelMessage) (PhotoMetadata, error) {
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	fields, ok := store.records[photoId]
+
+	if !ok {
+		return PhotoMetadata{}, ErrNotFound
+	}
+
+	photo, err := decode(photoId, fields)
+
+	if err != nil {
+		return photo, err
+	}
+
+	err = fn(&photo)
+
+	if err != nil {
+		return photo, err
+	}
+
+	photo.Version++
+	store.records[photoId] = encode(photo)
+	store.publish(photo, messages)
+
+	return photo, nil
+}
+
+// Messages returns everything published so far
+func (store *MemoryStore) Messages() []ChannelMessage {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	return append([]ChannelMessage(nil), store.messages...)
+}
+
+func (store *MemoryStore) publish(photo PhotoMetadata, messages []ChannelMessage) {
+	for _, message := range messages {
+		store.messages = append(store.messages, photo.address(message))
+	}
+}
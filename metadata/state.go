@@ -0,0 +1,130 @@
+package metadata
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// State is a step of the photo lifecycle, stored in the "state" hash field
+type State string
+
+const (
+	StateNew              State = "NEW"
+	StateEnriching        State = "ENRICHING"
+	StateAwaitingApproval State = "AWAITING_APPROVAL"
+	StateScheduled        State = "SCHEDULED"
+	StateReady            State = "READY"
+	StatePublishing       State = "PUBLISHING"
+	StatePublished        State = "PUBLISHED"
+	StateFailed           State = "FAILED"
+	StateRejected         State = "REJECTED"
+)
+
+var transitions = map[State][]State{
+	StateNew:              {StateEnriching, StateFailed, StateRejected},
+	StateEnriching:        {StateAwaitingApproval, StateReady, StateFailed, StateRejected},
+	StateAwaitingApproval: {StateReady, StateScheduled, StateFailed, StateRejected},
+	StateScheduled:        {StatePublishing, StateFailed, StateRejected},
+	StateReady:            {StatePublishing, StateFailed, StateRejected},
+	StatePublishing:       {StatePublished, StateFailed, StateReady},
+	StateFailed:           {StateNew, StateEnriching, StateReady, StateRejected},
+}
+
+// CanTransition tells whether a photo in state from may be moved to state to
+func (from State) CanTransition(to State) bool {
+	for _, allowed := range transitions[from] {
+		if allowed == to {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Final states can't be left any more
+func (state State) Final() bool {
+	return len(transitions[state]) == 0
+}
+
+// TimestampField is the hash field holding the unix time state was entered
+func (state State) TimestampField() string {
+	return strings.ToLower(string(state)) + "_at"
+}
+
+// EnteredAt returns when the photo entered state, zero time if it never did
+func (photo PhotoMetadata) EnteredAt(state State) time.Time {
+	at := photo.stamp(state)
+
+	if at == nil || *at == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(*at, 0)
+}
+
+// Transition moves the photo from one state to another and stamps the time
+// it entered the new one. Called from Store.Update it's a compare-and-set:
+// whoever moved the photo first wins, everybody else gets a TransitionError.
+func (photo *PhotoMetadata) Transition(from, to State) error {
+	if photo.State != from || !from.CanTransition(to) {
+		return &TransitionError{PhotoId: photo.PhotoId, From: from, To: to, Actual: photo.State}
+	}
+
+	photo.State = to
+
+	if at := photo.stamp(to); at != nil {
+		*at = time.Now().Unix()
+	}
+
+	return nil
+}
+
+func (photo *PhotoMetadata) stamp(state State) *int64 {
+	switch state {
+	case StateNew:
+		return &photo.NewAt
+	case StateEnriching:
+		return &photo.EnrichingAt
+	case StateAwaitingApproval:
+		return &photo.AwaitingApprovalAt
+	case StateScheduled:
+		return &photo.ScheduledAt
+	case StateReady:
+		return &photo.ReadyAt
+	case StatePublishing:
+		return &photo.PublishingAt
+	case StatePublished:
+		return &photo.PublishedAt
+	case StateFailed:
+		return &photo.FailedAt
+	case StateRejected:
+		return &photo.RejectedAt
+	}
+
+	return nil
+}
+
+// TransitionError is returned when a photo can't be moved, either because the
+// transition isn't allowed or because someone else moved it first
+type TransitionError struct {
+	PhotoId string
+	From    State
+	To      State
+	Actual  State
+}
+
+func (err *TransitionError) Error() string {
+	if err.Actual != err.From {
+		return fmt.Sprintf("photo %s is %s, expected %s to move to %s",
+			err.PhotoId, err.Actual, err.From, err.To)
+	}
+
+	return fmt.Sprintf("photo %s can't move from %s to %s", err.PhotoId, err.From, err.To)
+}
+
+// IsTransitionError tells callers a lost race apart from redis failures
+func IsTransitionError(err error) bool {
+	_, ok := err.(*TransitionError)
+	return ok
+}
@@ -0,0 +1,98 @@
+package metadata
+
+import "testing"
+
+func TestCanTransition(t *testing.T) {
+	tests := []struct {
+		from State
+		to   State
+		want bool
+	}{
+		{StateNew, StateEnriching, true},
+		{StateNew, StateReady, false},
+		{StateEnriching, StateAwaitingApproval, true},
+		{StateEnriching, StateReady, true},
+		{StateAwaitingApproval, StateScheduled, true},
+		{StateAwaitingApproval, StateFailed, true},
+		{StateAwaitingApproval, StatePublishing, false},
+		{StateScheduled, StatePublishing, true},
+		{StateScheduled, StateFailed, true},
+		{StateReady, StatePublishing, true},
+		{StateReady, StateFailed, true},
+		{StatePublishing, StatePublished, true},
+		{StatePublishing, StateReady, true},
+		{StatePublishing, StateRejected, false},
+		{StateFailed, StateNew, true},
+		{StateFailed, StatePublishing, false},
+		{StatePublished, StateNew, false},
+		{StatePublished, StateFailed, false},
+		{StateRejected, StateNew, false},
+		{State("UNKNOWN"), StateNew, false},
+	}
+
+	for _, test := range tests {
+		if got := test.from.CanTransition(test.to); got != test.want {
+			t.Errorf("%s -> %s: got %v, want %v", test.from, test.to, got, test.want)
+		}
+	}
+}
+
+func TestFinal(t *testing.T) {
+	tests := []struct {
+		state State
+		want  bool
+	}{
+		{StateNew, false},
+		{StateFailed, false},
+		{StatePublishing, false},
+		{StatePublished, true},
+		{StateRejected, true},
+	}
+
+	for _, test := range tests {
+		if got := test.state.Final(); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.state, got, test.want)
+		}
+	}
+}
+
+func TestTransition(t *testing.T) {
+	tests := []struct {
+		name   string
+		actual State
+		from   State
+		to     State
+		ok     bool
+	}{
+		{"allowed", StateReady, StateReady, StatePublishing, true},
+		{"not allowed", StateReady, StateReady, StatePublished, false},
+		{"moved meanwhile", StatePublishing, StateReady, StatePublishing, false},
+	}
+
+	for _, test := range tests {
+		photo := PhotoMetadata{PhotoId: "photo", State: test.actual}
+
+		err := photo.Transition(test.from, test.to)
+
+		if test.ok {
+			if err != nil {
+				t.Errorf("%s: unexpected error %s", test.name, err)
+			}
+
+			if photo.State != test.to || photo.EnteredAt(test.to).IsZero() {
+				t.Errorf("%s: photo is %s entered at %s, want %s", test.name, photo.State,
+					photo.EnteredAt(test.to), test.to)
+			}
+
+			continue
+		}
+
+		if !IsTransitionError(err) {
+			t.Errorf("%s: got %v, want a TransitionError", test.name, err)
+		}
+
+		if photo.State != test.actual {
+			t.Errorf("%s: photo moved to %s", test.name, photo.State)
+		}
+	}
+}
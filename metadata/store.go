@@ -0,0 +1,187 @@
+package metadata
+
+import (
+	"errors"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+var ErrNotFound = errors.New("photo not found")
+var ErrExists = errors.New("photo is already in progress")
+var ErrConflict = errors.New("photo keeps changing, giving up")
+
+// maxUpdateRetries bounds how often Update re-runs on concurrent writes
+const maxUpdateRetries = 10
+
+// Store keeps photo records. Every write bumps Version and is atomic together
+// with the messages it announces.
+type Store interface {
+	// Get returns ErrNotFound for unknown photos and *DecodeError for broken
+	// records
+	Get(photoId string) (PhotoMetadata, error)
+	// Create stores photo in StateNew. A photo that is still in progress
+	// isn't replaced, ErrExists is returned instead.
+	Create(photo PhotoMetadata, messages ...ChannelMessage) error
+	// Update loads the photo and hands it to fn, then writes back the fields
+	// fn changed along with messages. Nothing is written when fn fails, its
+	// error is returned as is. fn may be called more than once if somebody
+	// else writes the photo meanwhile.
+	Update(photoId string, fn func(photo *PhotoMetadata) error,
+		messages ...ChannelMessage) (PhotoMetadata, error)
+}
+
+// Outbox queues message on pipe, see bus.Bus.Outbox
+type Outbox func(pipe redis.Pipeliner, message ChannelMessage) error
+
+// RedisStore keeps every photo in a hash named after its ID. Writes WATCH
+// the hash and go through MULTI/EXEC, so concurrent updates are retried
+// instead of overwriting each other.
+type RedisStore struct {
+	redis  *redis.Client
+	outbox Outbox
+}
+
+// NewRedisStore returns a store publishing messages through outbox, which
+// may be nil for read only use
+func NewRedisStore(client *redis.Client, outbox Outbox) *RedisStore {
+	return &RedisStore{
+		redis:  client,
+		outbox: outbox,
+	}
+}
+
+func (store *RedisStore) Get(photoId string) (PhotoMetadata, error) {
+	return store.get(store.redis, photoId)
+}
+
+func (store *RedisStore) Create(photo PhotoMetadata, messages ...ChannelMessage) error {
+	return store.retry(photo.PhotoId, func(tx *redis.Tx) error {
+		old, err := store.get(tx, photo.PhotoId)
+
+		if err != nil && err != ErrNotFound && !IsDecodeError(err) {
+			return err
+		}
+
+		if err == nil && !old.State.Final() {
+			return ErrExists
+		}
+
+		record := newRecord(photo, old.Version)
+
+		_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
+			pipe.Del(photo.PhotoId)
+			pipe.HMSet(photo.PhotoId, changed(encode(PhotoMetadata{}), encode(record)))
+
+			return store.publish(pipe, record, messages)
+		})
+
+		return err
+	})
+}
+
+func (store *RedisStore) Update(photoId string, fn func(photo *PhotoMetadata) error,
+	messages ...ChannelMessage) (PhotoMetadata, error) {
+
+	var photo PhotoMetadata
+
+	err := store.retry(photoId, func(tx *redis.Tx) error {
+		var err error
+		photo, err = store.get(tx, photoId)
+
+		if err != nil {
+			return err
+		}
+
+		before := encode(photo)
+		err = fn(&photo)
+
+		if err != nil {
+			return err
+		}
+
+		photo.Version++
+
+		_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
+			pipe.HMSet(photoId, changed(before, encode(photo)))
+
+			return store.publish(pipe, photo, messages)
+		})
+
+		return err
+	})
+
+	return photo, err
+}
+
+// retry runs fn watching photoId until it gets through without conflicts
+func (store *RedisStore) retry(photoId string, fn func(tx *redis.Tx) error) error {
+	for i := 0; i < maxUpdateRetries; i++ {
+		err := store.redis.Watch(fn, photoId)
+
+		if err != redis.TxFailedErr {
+			return err
+		}
+	}
+
+	return ErrConflict
+}
+
+func (store *RedisStore) get(client redis.Cmdable, photoId string) (PhotoMetadata, error) {
+	fields, err := client.HGetAll(photoId).Result()
+
+	if err != nil {
+		return PhotoMetadata{}, err
+	}
+
+	if len(fields) == 0 {
+		return PhotoMetadata{}, ErrNotFound
+	}
+
+	return decode(photoId, fields)
+}
+
+func (store *RedisStore) publish(pipe redis.Pipeliner, photo PhotoMetadata,
+	messages []ChannelMessage) error {
+
+	if len(messages) != 0 && store.outbox == nil {
+		return errors.New("store has no outbox to publish messages to")
+	}
+
+	for _, message := range messages {
+		err := store.outbox(pipe, photo.address(message))
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// address fills in whatever message leaves out about photo
+func (photo PhotoMetadata) address(message ChannelMessage) ChannelMessage {
+	if message.PhotoId == "" {
+		message.PhotoId = photo.PhotoId
+	}
+
+	if message.ChatId == 0 {
+		message.ChatId = photo.ChatId
+	}
+
+	if message.CorrelationId == "" {
+		message.CorrelationId = photo.CorrelationId
+	}
+
+	return message
+}
+
+// newRecord prepares photo to be stored as a fresh record replacing one of
+// the given version
+func newRecord(photo PhotoMetadata, version int64) PhotoMetadata {
+	photo.State = StateNew
+	photo.NewAt = time.Now().Unix()
+	photo.Version = version + 1
+
+	return photo
+}
@@ -0,0 +1,212 @@
+package metadata
+
+import (
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/go-redis/redis"
+)
+
+const testPhotoId = "test:metadata:photo"
+const testOutboxKey = "test:metadata:outbox"
+
+// testStore is a store under test and the number of messages it published
+type testStore struct {
+	name     string
+	store    Store
+	messages func() int
+}
+
+// testStores returns a memory store and, with TEST_REDIS_ADDR set, a redis
+// store. The redis store counts the messages it publishes in testOutboxKey,
+// that key and the test photo are removed first.
+func testStores(t *testing.T) []testStore {
+	memory := NewMemoryStore()
+	stores := []testStore{{"memory", memory, func() int { return len(memory.Messages()) }}}
+
+	addr := os.Getenv("TEST_REDIS_ADDR")
+
+	if addr == "" {
+		t.Log("TEST_REDIS_ADDR isn't set, testing the memory store only")
+		return stores
+	}
+
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	client.Del(testPhotoId, testOutboxKey)
+
+	outbox := func(pipe redis.Pipeliner, message ChannelMessage) error {
+		return pipe.Incr(testOutboxKey).Err()
+	}
+
+	return append(stores, testStore{"redis", NewRedisStore(client, outbox), func() int {
+		count, _ := client.Get(testOutboxKey).Int64()
+		return int(count)
+	}})
+}
+
+func TestStoreCreate(t *testing.T) {
+	tests := []struct {
+		name  string
+		state State
+		want  error
+	}{
+		{"in progress", StateEnriching, ErrExists},
+		{"failed", StateFailed, ErrExists},
+		{"published", StatePublished, nil},
+		{"rejected", StateRejected, nil},
+	}
+
+	for _, test := range tests {
+		for _, store := range testStores(t) {
+			store.store.Create(PhotoMetadata{PhotoId: testPhotoId})
+
+			_, err := store.store.Update(testPhotoId, func(photo *PhotoMetadata) error {
+				photo.State = test.state
+				return nil
+			})
+
+			if err != nil {
+				t.Fatalf("%s %s: %s", store.name, test.name, err)
+			}
+
+			err = store.store.Create(PhotoMetadata{PhotoId: testPhotoId})
+
+			if err != test.want {
+				t.Errorf("%s %s: got %v, want %v", store.name, test.name, err, test.want)
+			}
+		}
+	}
+}
+
+// only one of the callers racing for a transition may win it, the others get
+// a TransitionError and their messages aren't published
+func TestStoreUpdateConflict(t *testing.T) {
+	for _, store := range testStores(t) {
+		store.store.Create(PhotoMetadata{PhotoId: testPhotoId})
+
+		const callers = 20
+		var wg sync.WaitGroup
+		errs := make(chan error, callers)
+
+		for i := 0; i < callers; i++ {
+			wg.Add(1)
+
+			go func(store Store) {
+				defer wg.Done()
+
+				_, err := store.Update(testPhotoId, func(photo *PhotoMetadata) error {
+					return photo.Transition(StateNew, StateEnriching)
+				}, ChannelMessage{Type: "ENRICHING"})
+
+				errs <- err
+			}(store.store)
+		}
+
+		wg.Wait()
+		close(errs)
+
+		won := 0
+
+		for err := range errs {
+			switch {
+			case err == nil:
+				won++
+			case !IsTransitionError(err):
+				t.Errorf("%s: unexpected error %s", store.name, err)
+			}
+		}
+
+		if won != 1 {
+			t.Errorf("%s: %d callers won the transition, want 1", store.name, won)
+		}
+
+		if messages := store.messages(); messages != 1 {
+			t.Errorf("%s: published %d messages, want one", store.name, messages)
+		}
+
+		photo, err := store.store.Get(testPhotoId)
+
+		if err != nil {
+			t.Fatalf("%s: %s", store.name, err)
+		}
+
+		// one write by Create, one by the winner
+		if photo.State != StateEnriching || photo.Version != 2 {
+			t.Errorf("%s: photo is %s at version %d, want %s at version 2", store.name, photo.State,
+				photo.Version, StateEnriching)
+		}
+	}
+}
+
+func TestStoreUpdateNotFound(t *testing.T) {
+	for _, store := range testStores(t) {
+		_, err := store.store.Update(testPhotoId, func(photo *PhotoMetadata) error {
+			return nil
+		})
+
+		if err != ErrNotFound {
+			t.Errorf("%s: got %v, want %v", store.name, err, ErrNotFound)
+		}
+	}
+}
+
+// a failing fn writes nothing and publishes nothing
+func TestStoreUpdateFails(t *testing.T) {
+	for _, store := range testStores(t) {
+		store.store.Create(PhotoMetadata{PhotoId: testPhotoId, Caption: "cat"})
+
+		_, err := store.store.Update(testPhotoId, func(photo *PhotoMetadata) error {
+			photo.Caption = "dog"
+			return ErrConflict
+		}, ChannelMessage{Type: "DONE"})
+
+		if err != ErrConflict {
+			t.Errorf("%s: got %v, want %v", store.name, err, ErrConflict)
+		}
+
+		photo, err := store.store.Get(testPhotoId)
+
+		if err != nil || photo.Caption != "cat" || photo.Version != 1 || store.messages() != 0 {
+			t.Errorf("%s: got %q at version %d, %d messages, %v", store.name, photo.Caption,
+				photo.Version, store.messages(), err)
+		}
+	}
+}
+
+func TestRedisStoreDecodeError(t *testing.T) {
+	stores := testStores(t)
+
+	if len(stores) == 1 {
+		t.Skip("TEST_REDIS_ADDR isn't set")
+	}
+
+	store := stores[1].store.(*RedisStore)
+	store.redis.HMSet(testPhotoId, map[string]interface{}{"state": "NEW", "attempts": "many"})
+
+	_, err := store.Get(testPhotoId)
+
+	if !IsDecodeError(err) {
+		t.Errorf("got %v, want a DecodeError", err)
+	}
+
+	// a broken record is replaced by a new one
+	err = store.Create(PhotoMetadata{PhotoId: testPhotoId})
+
+	if err != nil {
+		t.Errorf("got %v creating over a broken record", err)
+	}
+}
+
+// messages are addressed to the photo they're published with
+func TestStoreAddress(t *testing.T) {
+	store := NewMemoryStore()
+	store.Create(PhotoMetadata{PhotoId: testPhotoId, ChatId: 42, CorrelationId: "abc"},
+		ChannelMessage{Type: "NEW"})
+
+	want := ChannelMessage{Type: "NEW", PhotoId: testPhotoId, ChatId: 42, CorrelationId: "abc"}
+
+	if messages := store.Messages(); len(messages) != 1 || messages[0] != want {
+		t.Errorf("published %v, want %v", messages, want)
+	}
+}
@@ -11,15 +11,75 @@ type PhotoMetadata struct {
 	Hashtag      string `json:"hashtag"       mapstructure:"hashtag"`
 	HashtagRu    string `json:"hashtag_ru"    mapstructure:"hashtag_ru"`
 	StyledUrl    string `json:"styled_url"    mapstructure:"styled_url"`
-	Publish      bool   `json:"publish"       mapstructure:"publish"`
-	Published    bool   `json:"published"     mapstructure:"published"`
 	PublishedUrl string `json:"published_url" mapstructure:"published_url"`
 	NSFW         bool   `json:"nsfw"          mapstructure:"nsfw"`
 	NSFWChecked  bool   `json:"nsfw_checked"  mapstructure:"nsfw_checked"`
+	Error        string `json:"error"         mapstructure:"error"`
+	FailedStage  string `json:"failed_stage"  mapstructure:"failed_stage"`
+	Attempts     int    `json:"attempts"      mapstructure:"attempts"`
+
+	// failed attempts per stage since it last succeeded, see attempts.go
+	AttemptsByStage string `json:"attempts_by_stage" mapstructure:"attempts_by_stage"`
+
+	// set when the photo arrives, carried by every message about it
+	CorrelationId string `json:"correlation_id" mapstructure:"correlation_id"`
+
+	// telegram messages: the one the photo came with and the approval preview
+	MessageId        int `json:"message_id"         mapstructure:"message_id"`
+	PreviewMessageId int `json:"preview_message_id" mapstructure:"preview_message_id"`
+
+	// the telegram user who sent the photo, 0 for records from before
+	UserId int64 `json:"user_id" mapstructure:"user_id"`
+
+	// galleries, see gallery.go: items of a gallery name it, a gallery lists
+	// its items
+	GalleryId string `json:"gallery_id" mapstructure:"gallery_id"`
+	Items     string `json:"items"      mapstructure:"items"`
+
+	// media, see media.go: photo_url is the video for videos, stages look at
+	// the cover frame instead
+	MediaType string `json:"media_type" mapstructure:"media_type"`
+	CoverUrl  string `json:"cover_url"  mapstructure:"cover_url"`
+	Duration  int    `json:"duration"   mapstructure:"duration"` // seconds
+
+	// framing, see framing.go: versions of a photo fitted to the aspect
+	// ratios Instagram takes and the one to post
+	FramingChecked bool   `json:"framing_checked" mapstructure:"framing_checked"`
+	CropUrl        string `json:"crop_url"        mapstructure:"crop_url"`
+	BlurUrl        string `json:"blur_url"        mapstructure:"blur_url"`
+	SolidUrl       string `json:"solid_url"       mapstructure:"solid_url"`
+	Framing        string `json:"framing"         mapstructure:"framing"`
+
+	// the post on instagram, set when the photo is PUBLISHED
+	InstagramId   string `json:"instagram_id"   mapstructure:"instagram_id"`
+	InstagramCode string `json:"instagram_code" mapstructure:"instagram_code"`
+
+	// when a SCHEDULED photo is published, unix time
+	PublishAt int64 `json:"publish_at" mapstructure:"publish_at"`
+
+	// lifecycle, see state.go
+	State              State `json:"state"                mapstructure:"state"`
+	NewAt              int64 `json:"new_at"               mapstructure:"new_at"`
+	EnrichingAt        int64 `json:"enriching_at"         mapstructure:"enriching_at"`
+	AwaitingApprovalAt int64 `json:"awaiting_approval_at" mapstructure:"awaiting_approval_at"`
+	ScheduledAt        int64 `json:"scheduled_at"         mapstructure:"scheduled_at"`
+	ReadyAt            int64 `json:"ready_at"             mapstructure:"ready_at"`
+	PublishingAt       int64 `json:"publishing_at"        mapstructure:"publishing_at"`
+	PublishedAt        int64 `json:"published_at"         mapstructure:"published_at"`
+	FailedAt           int64 `json:"failed_at"            mapstructure:"failed_at"`
+	RejectedAt         int64 `json:"rejected_at"          mapstructure:"rejected_at"`
+
+	// bumped by every Store write
+	Version int64 `json:"version" mapstructure:"version"`
 }
 
 type ChannelMessage struct {
-	Type				 string `json:"type"      	  mapstructure:"type"`
+	Type         string `json:"type"          mapstructure:"type"`
 	PhotoId      string `json:"photo_id"      mapstructure:"photo_id"`
 	Message      string `json:"message"       mapstructure:"message"`
-}
\ No newline at end of file
+
+	// filled in from the photo by the store, so every line logged about the
+	// message carries them
+	ChatId        int64  `json:"chat_id,omitempty"        mapstructure:"chat_id"`
+	CorrelationId string `json:"correlation_id,omitempty" mapstructure:"correlation_id"`
+}
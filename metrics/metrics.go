@@ -0,0 +1,128 @@
+// this package holds the prometheus metrics every service exposes on /metrics
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "instabot"
+
+var (
+	// Messages counts bus messages by the stage that got them and their
+	// ChannelMessage.Type (NEW, DONE, PUBLISH, ERROR)
+	Messages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_total",
+		Help:      "Bus messages received, by stage and message type.",
+	}, []string{"stage", "type"})
+
+	InFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "handlers_in_flight",
+		Help:      "Message handler goroutines currently running, by stage.",
+	}, []string{"stage"})
+
+	// StageDuration measures Processor.Process, outcome is ok or error
+	StageDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "stage_duration_seconds",
+		Help:      "Time spent processing a photo, by stage and outcome.",
+		Buckets:   []float64{.1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"stage", "outcome"})
+
+	// Failures counts failed attempts by what happened next: retry or dead
+	Failures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "failures_total",
+		Help:      "Failed photo processing attempts, by stage and whether they're retried.",
+	}, []string{"stage", "outcome"})
+
+	APIDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "api_request_duration_seconds",
+		Help:      "Latency of external API requests, by stage and API.",
+		Buckets:   []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	}, []string{"stage", "api"})
+
+	// APIRequests counts requests by HTTP status code, or "error" when no
+	// response came back at all
+	APIRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "api_requests_total",
+		Help:      "External API requests, by stage, API and response code.",
+	}, []string{"stage", "api", "code"})
+
+	TelegramUpdates = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "telegram_updates_total",
+		Help:      "Telegram updates received, by type.",
+	}, []string{"type"})
+
+	// Photos counts photos by outcome (accepted or rejected) and reason
+	Photos = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "photos_total",
+		Help:      "Photos accepted or rejected by the bot, by reason.",
+	}, []string{"outcome", "reason"})
+
+	InstagramUploads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "instagram_uploads_total",
+		Help:      "Instagram uploads, by outcome.",
+	}, []string{"outcome"})
+
+	PublishLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "photo_publish_seconds",
+		Help:      "Time from a photo arriving (NEW) to it being published (PUBLISHED).",
+		Buckets:   []float64{5, 10, 30, 60, 120, 300, 600, 1800, 3600},
+	})
+)
+
+func init() {
+	prometheus.MustRegister(Messages, InFlight, StageDuration, Failures, APIDuration,
+		APIRequests, TelegramUpdates, Photos, InstagramUploads, PublishLatency)
+}
+
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// ObserveAPI records a request to api made by stage, code is the HTTP status
+// or anything else describing the result, e.g. "ok" or "error"
+func ObserveAPI(stage, api string, start time.Time, code string) {
+	APIDuration.WithLabelValues(stage, api).Observe(time.Since(start).Seconds())
+	APIRequests.WithLabelValues(stage, api, code).Inc()
+}
+
+// Client returns an HTTP client recording every request it makes to api
+func Client(stage, api string) *http.Client {
+	return &http.Client{
+		Transport: &transport{stage: stage, api: api, next: http.DefaultTransport},
+	}
+}
+
+type transport struct {
+	stage string
+	api   string
+	next  http.RoundTripper
+}
+
+func (transport *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := transport.next.RoundTrip(req)
+
+	if err != nil {
+		ObserveAPI(transport.stage, transport.api, start, "error")
+		return resp, err
+	}
+
+	ObserveAPI(transport.stage, transport.api, start, strconv.Itoa(resp.StatusCode))
+
+	return resp, nil
+}
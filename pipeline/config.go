@@ -0,0 +1,94 @@
+package pipeline
+
+import (
+	"time"
+
+	"github.com/nuxdie/instabot/logging"
+	"github.com/nuxdie/instabot/retry"
+	"github.com/spf13/viper"
+)
+
+const envLogLevel = "LOG_LEVEL"
+const envWorkerRedisAddr = "WORKER_REDIS_ADDR"
+const envWorkerRedisDb = "WORKER_REDIS_DB"
+const envWorkerRedisPasswd = "WORKER_REDIS_PASSWD"
+const envWorkerRedisStream = "WORKER_REDIS_STREAM"
+const envWorkerRedisGroup = "WORKER_REDIS_GROUP"
+const envWorkerRedisConsumer = "WORKER_REDIS_CONSUMER"
+const envWorkerRedisClaimIdle = "WORKER_REDIS_CLAIM_IDLE"
+const envWorkerRedisMaxDeliveries = "WORKER_REDIS_MAX_DELIVERIES"
+const envWorkerRetryMaxAttempts = "WORKER_RETRY_MAX_ATTEMPTS"
+const envWorkerRetryBackoff = "WORKER_RETRY_BACKOFF"
+const envWorkerRetryMaxBackoff = "WORKER_RETRY_MAX_BACKOFF"
+const envWorkerRetryJitter = "WORKER_RETRY_JITTER"
+const envWorkerHttpAddr = "WORKER_HTTP_ADDR"
+const envWorkerShutdownTimeout = "WORKER_SHUTDOWN_TIMEOUT"
+const envWorkerPoolSize = "WORKER_POOL_SIZE"
+
+// Config holds everything the runtime needs, stage specific settings are
+// read by the stage itself through viper
+type Config struct {
+	Stage string // tags every line logged about a photo
+	Redis struct {
+		Addr          string
+		Passwd        string
+		Db            int
+		Stream        string
+		Group         string
+		Consumer      string
+		ClaimIdle     time.Duration
+		MaxDeliveries int
+	}
+	Retry retry.Policy
+	HTTP  struct {
+		Addr string // serves /metrics, /healthz and /readyz
+	}
+	ShutdownTimeout time.Duration // how long running handlers get to finish
+	PoolSize        int           // photos processed at once
+}
+
+// LoadConfig reads WORKER_* variables and sets up JSON logging. stage is
+// used as default consumer group name and tags every log line.
+func LoadConfig(stage string) *Config {
+	viper.AutomaticEnv()
+	viper.SetDefault(envWorkerRedisAddr, "localhost:6379")
+	viper.SetDefault(envWorkerRedisPasswd, "")
+	viper.SetDefault(envWorkerRedisDb, 0)
+	viper.SetDefault(envWorkerRedisStream, "message")
+	viper.SetDefault(envWorkerRedisGroup, stage)
+	viper.SetDefault(envWorkerRedisConsumer, "")
+	viper.SetDefault(envWorkerRedisClaimIdle, 60)
+	viper.SetDefault(envWorkerRedisMaxDeliveries, 5)
+	viper.SetDefault(envWorkerRetryMaxAttempts, 5)
+	viper.SetDefault(envWorkerRetryBackoff, 5)
+	viper.SetDefault(envWorkerRetryMaxBackoff, 300)
+	viper.SetDefault(envWorkerRetryJitter, 0.2)
+	viper.SetDefault(envWorkerHttpAddr, ":8080")
+	viper.SetDefault(envWorkerShutdownTimeout, 20)
+	viper.SetDefault(envWorkerPoolSize, 4)
+	viper.SetDefault(envLogLevel, "WARN")
+
+	logging.Setup(stage, viper.GetString(envLogLevel))
+
+	conf := &Config{Stage: stage}
+
+	conf.Redis.Addr = viper.GetString(envWorkerRedisAddr)
+	conf.Redis.Passwd = viper.GetString(envWorkerRedisPasswd)
+	conf.Redis.Db = viper.GetInt(envWorkerRedisDb)
+	conf.Redis.Stream = viper.GetString(envWorkerRedisStream)
+	conf.Redis.Group = viper.GetString(envWorkerRedisGroup)
+	conf.Redis.Consumer = viper.GetString(envWorkerRedisConsumer)
+	conf.Redis.ClaimIdle = time.Second * time.Duration(viper.GetInt(envWorkerRedisClaimIdle))
+	conf.Redis.MaxDeliveries = viper.GetInt(envWorkerRedisMaxDeliveries)
+
+	conf.Retry.MaxAttempts = viper.GetInt(envWorkerRetryMaxAttempts)
+	conf.Retry.Backoff = time.Second * time.Duration(viper.GetInt(envWorkerRetryBackoff))
+	conf.Retry.MaxBackoff = time.Second * time.Duration(viper.GetInt(envWorkerRetryMaxBackoff))
+	conf.Retry.Jitter = viper.GetFloat64(envWorkerRetryJitter)
+
+	conf.HTTP.Addr = viper.GetString(envWorkerHttpAddr)
+	conf.ShutdownTimeout = time.Second * time.Duration(viper.GetInt(envWorkerShutdownTimeout))
+	conf.PoolSize = viper.GetInt(envWorkerPoolSize)
+
+	return conf
+}
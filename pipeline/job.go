@@ -0,0 +1,200 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+
+	"github.com/go-redis/redis"
+	"github.com/nuxdie/instabot/derivative"
+	"github.com/nuxdie/instabot/metadata"
+	"github.com/nuxdie/instabot/metrics"
+	"github.com/nuxdie/instabot/retry"
+)
+
+var errSettled = errors.New("photo is published or rejected already")
+
+// Job is a single message being handled by a stage
+type Job struct {
+	Context context.Context
+	Message metadata.ChannelMessage
+	Photo   metadata.PhotoMetadata
+	Log     *log.Logger // tags lines with the photo, chat, stage and correlation ID
+	runtime *Runtime
+}
+
+func (job *Job) Redis() *redis.Client {
+	return job.runtime.redis
+}
+
+// HTTPClient returns a client recording latency and response codes of the
+// requests the stage makes to api
+func (job *Job) HTTPClient(api string) *http.Client {
+	return metrics.Client(job.runtime.name, api)
+}
+
+// Fetch downloads the photo, or the cover frame of a video. The caller must
+// close the body.
+func (job *Job) Fetch() (*http.Response, error) {
+	return job.fetch(job.Photo.PhotoId, job.Photo.ImageUrl())
+}
+
+// FetchVideo downloads the video itself, the caller must close the body
+func (job *Job) FetchVideo() (*http.Response, error) {
+	return job.fetch(job.Photo.PhotoId, job.Photo.PhotoUrl)
+}
+
+// FetchUpload downloads what gets posted, the framed version of the photo
+// when one was chosen. The caller must close the body.
+func (job *Job) FetchUpload() (*http.Response, error) {
+	return job.fetch(job.Photo.PhotoId, job.Photo.UploadUrl())
+}
+
+// Items reads the item records of a gallery, in album order
+func (job *Job) Items() ([]metadata.PhotoMetadata, error) {
+	itemIds := job.Photo.ItemIds()
+	items := make([]metadata.PhotoMetadata, 0, len(itemIds))
+
+	for _, itemId := range itemIds {
+		item, err := job.runtime.store.Get(itemId)
+
+		if err == metadata.ErrNotFound || metadata.IsDecodeError(err) {
+			return nil, retry.Permanent(fmt.Errorf("couldn't get item %s of gallery %s: %s",
+				itemId, job.Photo.PhotoId, err))
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		items = append(items, item)
+	}
+
+	return items, nil
+}
+
+// FetchItem downloads a gallery item, the caller must close the body
+func (job *Job) FetchItem(item metadata.PhotoMetadata) (*http.Response, error) {
+	return job.fetch(item.PhotoId, item.ImageUrl())
+}
+
+func (job *Job) fetch(photoId, uri string) (*http.Response, error) {
+	if derivative.Is(uri) {
+		return job.fetchDerivative(photoId, uri)
+	}
+
+	parsed, err := url.Parse(uri)
+
+	if err != nil || parsed.Host == "" {
+		job.Log.Printf("[ERROR] Incorrect photo url %s provided: %v", uri, err)
+		return nil, retry.Permanent(fmt.Errorf("incorrect photo url %s", uri))
+	}
+
+	req, err := http.NewRequest("GET", uri, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := job.HTTPClient("telegram_file").Do(req.WithContext(job.Context))
+
+	if err != nil {
+		job.Log.Printf("[ERROR] Could not get the photo by %s", uri)
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		err = fmt.Errorf("couldn't get photo %s: %s", photoId, resp.Status)
+
+		// telegram file links expire, asking again won't bring them back
+		if resp.StatusCode >= 400 && resp.StatusCode < 500 {
+			return nil, retry.Permanent(err)
+		}
+
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// fetchDerivative serves media the bot made itself like it was downloaded
+func (job *Job) fetchDerivative(photoId, uri string) (*http.Response, error) {
+	data, err := derivative.Get(job.runtime.redis, uri)
+
+	if err == derivative.ErrExpired {
+		return nil, retry.Permanent(fmt.Errorf("couldn't get photo %s: %s", photoId, err))
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		ContentLength: int64(len(data)),
+		Body:          ioutil.NopCloser(bytes.NewReader(data)),
+	}, nil
+}
+
+// Store writes result into the photo record and announces it with DONE,
+// both in one MULTI/EXEC, and resets the failed attempts of the stage. This
+// is what enrichment stages persist with. Results for photos that were
+// cancelled meanwhile are dropped.
+func (job *Job) Store(result Result) error {
+	photo, err := job.runtime.store.Update(job.Photo.PhotoId, func(photo *metadata.PhotoMetadata) error {
+		if photo.State.Final() {
+			return errSettled
+		}
+
+		photo.ResetAttempts(job.runtime.name)
+
+		return photo.Apply(result)
+	}, metadata.ChannelMessage{Type: "DONE"})
+
+	if err == errSettled {
+		job.Log.Printf("[INFO] Photo %s was settled meanwhile, dropping %s result",
+			job.Photo.PhotoId, job.runtime.name)
+		return nil
+	}
+
+	if err != nil {
+		job.Log.Printf("[ERROR] Couldn't store %s result for %s: %s",
+			job.runtime.name, job.Photo.PhotoId, err)
+		return err
+	}
+
+	job.Photo = photo
+
+	return nil
+}
+
+// Transition moves the photo to another state, storing result and
+// publishing message in the same step
+func (job *Job) Transition(from, to metadata.State, result Result,
+	message metadata.ChannelMessage) error {
+
+	photo, err := job.runtime.store.Update(job.Photo.PhotoId, func(photo *metadata.PhotoMetadata) error {
+		err := photo.Transition(from, to)
+
+		if err != nil {
+			return err
+		}
+
+		return photo.Apply(result)
+	}, message)
+
+	if err != nil {
+		return err
+	}
+
+	job.Photo = photo
+
+	return nil
+}
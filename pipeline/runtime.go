@@ -0,0 +1,381 @@
+// this package is the shared runtime of every pipeline worker: it loads the
+// config, subscribes to the bus, fetches photo records and stores results,
+// so a stage only has to implement Processor
+package pipeline
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/nuxdie/instabot/bus"
+	"github.com/nuxdie/instabot/health"
+	"github.com/nuxdie/instabot/logging"
+	"github.com/nuxdie/instabot/metadata"
+	"github.com/nuxdie/instabot/metrics"
+	"github.com/nuxdie/instabot/retry"
+)
+
+// Result holds the photo fields a stage produced
+type Result map[string]interface{}
+
+// Processor is a single pipeline stage
+type Processor interface {
+	// Interested decides whether the stage has anything to do for photo
+	Interested(message metadata.ChannelMessage, photo metadata.PhotoMetadata) bool
+	// Process does the actual work. A failure is retried according to the
+	// retry policy unless it's wrapped with retry.Permanent.
+	Process(job *Job) (Result, error)
+	// Persist stores the result, see Job.Store and Job.Transition
+	Persist(job *Job, result Result) error
+}
+
+type Runtime struct {
+	name      string
+	types     map[string]bool
+	processor Processor
+	config    *Config
+	redis     *redis.Client
+	bus       *bus.Bus
+	store     metadata.Store
+	queue     *retry.Queue
+	dead      *retry.DeadLetters
+	mux       *http.ServeMux
+	health    *health.Checks
+	cancel    context.CancelFunc
+	lock      sync.Mutex
+}
+
+// New creates a runtime for processor that is fed messages of the given
+// types. It doesn't connect to anything until Start is called.
+func New(name string, processor Processor, config *Config, types ...string) *Runtime {
+	runtime := &Runtime{
+		name:      name,
+		types:     make(map[string]bool),
+		processor: processor,
+		config:    config,
+		mux:       http.NewServeMux(),
+		health:    health.New(),
+	}
+
+	for _, messageType := range types {
+		runtime.types[messageType] = true
+	}
+
+	runtime.redis = redis.NewClient(&redis.Options{
+		Addr:     config.Redis.Addr,
+		Password: config.Redis.Passwd,
+		DB:       config.Redis.Db,
+	})
+
+	runtime.bus = bus.New(runtime.redis, bus.Config{
+		Stream:        config.Redis.Stream,
+		Group:         config.Redis.Group,
+		Consumer:      config.Redis.Consumer,
+		ClaimIdle:     config.Redis.ClaimIdle,
+		MaxDeliveries: int64(config.Redis.MaxDeliveries),
+		Handlers:      config.PoolSize,
+	})
+
+	runtime.store = metadata.NewRedisStore(runtime.redis, runtime.bus.Outbox)
+	runtime.queue = retry.NewQueue(runtime.redis, runtime.bus.Outbox)
+	runtime.dead = retry.NewDeadLetters(runtime.redis, runtime.store)
+
+	runtime.health.Live("subscription", runtime.bus.Alive)
+	runtime.health.Ready("redis", func() error {
+		return runtime.redis.Ping().Err()
+	})
+	runtime.health.Ready("stream", runtime.bus.Ready)
+
+	runtime.mux.Handle("/metrics", metrics.Handler())
+	runtime.health.Register(runtime.mux)
+
+	return runtime
+}
+
+func (runtime *Runtime) Redis() *redis.Client {
+	return runtime.redis
+}
+
+func (runtime *Runtime) Bus() *bus.Bus {
+	return runtime.bus
+}
+
+func (runtime *Runtime) Store() metadata.Store {
+	return runtime.store
+}
+
+// Health lets a stage add its own checks to /healthz and /readyz
+func (runtime *Runtime) Health() *health.Checks {
+	return runtime.health
+}
+
+// interruptGrace is how long handlers get to give up once their context is
+// cancelled at the end of a shutdown
+const interruptGrace = time.Second * 5
+
+// Start blocks handling messages until ctx is cancelled or Stop is called.
+// It then stops reading, waits up to Config.ShutdownTimeout for running
+// handlers and interrupts the rest, see interrupt.
+func (runtime *Runtime) Start(ctx context.Context) error {
+	runtime.lock.Lock()
+	ctx, runtime.cancel = context.WithCancel(ctx)
+	runtime.lock.Unlock()
+
+	pong, err := runtime.redis.Ping().Result()
+
+	if err != nil {
+		log.Printf("[ERROR] Couldn't ping redis server %s", err)
+	} else {
+		log.Printf("[DEBUG] got pong from redis %v", pong)
+	}
+
+	// handlers outlive ctx, their own context is only cancelled when they
+	// don't finish in time
+	work, abort := context.WithCancel(context.Background())
+	defer abort()
+
+	go runtime.queue.Run(ctx.Done())
+	go runtime.serve(work)
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- runtime.bus.Subscribe(func(message metadata.ChannelMessage) error {
+			return runtime.handle(work, message)
+		})
+	}()
+
+	select {
+	case <-ctx.Done():
+		runtime.bus.Close()
+		err = <-done
+	case err = <-done:
+		if err != nil {
+			log.Printf("[ERROR] Couldn't subscribe to redis stream %s: %s",
+				runtime.config.Redis.Stream, err)
+			return err
+		}
+	}
+
+	runtime.drain(abort)
+	runtime.bus.Unsubscribe()
+
+	return err
+}
+
+func (runtime *Runtime) drain(abort context.CancelFunc) {
+	log.Printf("[INFO] %s stopped reading, waiting up to %s for running handlers",
+		runtime.name, runtime.config.ShutdownTimeout)
+
+	if runtime.bus.Wait(runtime.config.ShutdownTimeout) {
+		return
+	}
+
+	log.Printf("[WARN] %s handlers still running after %s, interrupting them",
+		runtime.name, runtime.config.ShutdownTimeout)
+
+	abort()
+
+	if !runtime.bus.Wait(interruptGrace) {
+		// their entries stay pending, another consumer claims them
+		log.Printf("[ERROR] %s handlers didn't stop, leaving them behind", runtime.name)
+	}
+}
+
+func (runtime *Runtime) Stop() {
+	runtime.lock.Lock()
+	defer runtime.lock.Unlock()
+
+	if runtime.cancel != nil {
+		runtime.cancel()
+	}
+}
+
+// serve answers /metrics, /healthz and /readyz on config.HTTP.Addr until ctx
+// is cancelled
+func (runtime *Runtime) serve(ctx context.Context) {
+	server := &http.Server{
+		Addr:    runtime.config.HTTP.Addr,
+		Handler: runtime.mux,
+	}
+
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	err := server.ListenAndServe()
+
+	if err != nil && err != http.ErrServerClosed {
+		log.Printf("[ERROR] Couldn't serve HTTP on %s: %s", runtime.config.HTTP.Addr, err)
+	}
+}
+
+func (runtime *Runtime) handle(ctx context.Context, message metadata.ChannelMessage) error {
+	logger := runtime.logger(logging.MessageFields(message))
+
+	logger.Printf("[VERBOSE] %s got message from redis stream %s: %v",
+		runtime.name, runtime.config.Redis.Stream, message)
+
+	if !runtime.types[message.Type] {
+		logger.Printf("[VERBOSE] Not interested in this message: %v", message)
+		return nil
+	}
+
+	photo, err := runtime.getPhoto(logger, message.PhotoId)
+
+	if err != nil {
+		return err
+	}
+
+	if photo == nil {
+		logger.Printf("[WARN] Photo %s from message %v doesn't exist", message.PhotoId, message)
+		return nil
+	}
+
+	// messages published before correlation IDs existed don't carry one
+	if photo.CorrelationId == "" {
+		photo.CorrelationId = message.CorrelationId
+	}
+
+	logger = runtime.logger(logging.PhotoFields(*photo))
+	logger.Printf("[DEBUG] got metadata from redis: %v", *photo)
+
+	if !runtime.processor.Interested(message, *photo) {
+		logger.Printf("[INFO] Nothing to do for %s. Photo %s is %s",
+			runtime.name, photo.PhotoId, photo.State)
+		return nil
+	}
+
+	job := &Job{
+		Context: ctx,
+		Message: message,
+		Photo:   *photo,
+		Log:     logger,
+		runtime: runtime,
+	}
+
+	start := time.Now()
+	result, err := runtime.processor.Process(job)
+
+	if err != nil && ctx.Err() != nil {
+		return runtime.interrupt(job, err)
+	}
+
+	if err != nil {
+		metrics.StageDuration.WithLabelValues(runtime.name, "error").
+			Observe(time.Since(start).Seconds())
+		logger.Printf("[ERROR] %s couldn't process photo %s: %s", runtime.name, photo.PhotoId, err)
+		return runtime.fail(job, err)
+	}
+
+	metrics.StageDuration.WithLabelValues(runtime.name, "ok").Observe(time.Since(start).Seconds())
+
+	return runtime.processor.Persist(job, result)
+}
+
+// logger adds the stage to fields
+func (runtime *Runtime) logger(fields logging.Fields) *log.Logger {
+	fields.Stage = runtime.config.Stage
+
+	return logging.New(fields)
+}
+
+// interrupt makes a photo cut off by a shutdown retryable right away. It's
+// not the photo's fault, so the attempt isn't counted against it.
+func (runtime *Runtime) interrupt(job *Job, cause error) error {
+	job.Log.Printf("[WARN] %s was interrupted processing photo %s, retrying it: %s",
+		runtime.name, job.Photo.PhotoId, cause)
+
+	err := runtime.queue.Schedule(job.Message, time.Now())
+
+	if err != nil {
+		job.Log.Printf("[ERROR] Couldn't retry interrupted photo %s: %s", job.Photo.PhotoId, err)
+	}
+
+	return err
+}
+
+// fail counts the failed attempt of the stage and schedules another one, or
+// gives up on the photo once the retry policy is exhausted: it's moved to the
+// dead letters and FAILED, and telegram is told with ERROR. Every stage has
+// its own attempts, they're reset once it succeeds.
+func (runtime *Runtime) fail(job *Job, cause error) error {
+	photo, err := runtime.store.Update(job.Photo.PhotoId, func(photo *metadata.PhotoMetadata) error {
+		photo.CountAttempt(runtime.name)
+		photo.Error = cause.Error()
+
+		return nil
+	})
+
+	if err != nil {
+		// leave the message pending, the bus delivers it again
+		job.Log.Printf("[ERROR] Couldn't count failed attempt of %s: %s", job.Photo.PhotoId, err)
+		return err
+	}
+
+	policy := runtime.config.Retry
+
+	if !retry.IsPermanent(cause) && !policy.Exhausted(photo.Attempts) {
+		delay := policy.Delay(photo.Attempts)
+
+		job.Log.Printf("[WARN] %s failed photo %s %d of %d times, retrying in %s",
+			runtime.name, photo.PhotoId, photo.Attempts, policy.MaxAttempts, delay)
+
+		metrics.Failures.WithLabelValues(runtime.name, "retry").Inc()
+
+		return runtime.queue.Schedule(job.Message, time.Now().Add(delay))
+	}
+
+	job.Log.Printf("[ERROR] %s gives up on photo %s after %d attempts: %s",
+		runtime.name, photo.PhotoId, photo.Attempts, cause)
+
+	metrics.Failures.WithLabelValues(runtime.name, "dead").Inc()
+
+	err = runtime.dead.Add(photo)
+
+	if err != nil {
+		job.Log.Printf("[ERROR] Couldn't add %s to dead letters: %s", photo.PhotoId, err)
+		return err
+	}
+
+	// photos are failed from whatever state the stage found them in, so
+	// /retry and the dead letter list see every one of them
+	_, err = runtime.store.Update(photo.PhotoId, func(photo *metadata.PhotoMetadata) error {
+		return photo.Transition(photo.State, metadata.StateFailed)
+	}, metadata.ChannelMessage{Type: "ERROR", Message: cause.Error()})
+
+	if metadata.IsTransitionError(err) {
+		// already failed by another stage, or settled meanwhile
+		job.Log.Printf("[WARN] %s", err)
+		return nil
+	}
+
+	return err
+}
+
+// getPhoto reads the photo record, nil means there's no such photo
+func (runtime *Runtime) getPhoto(logger *log.Logger, photoId string) (*metadata.PhotoMetadata, error) {
+	photo, err := runtime.store.Get(photoId)
+
+	if err == metadata.ErrNotFound {
+		return nil, nil
+	}
+
+	if metadata.IsDecodeError(err) {
+		// a broken record won't get any better with retries
+		logger.Printf("[ERROR] %s", err)
+		return nil, nil
+	}
+
+	if err != nil {
+		logger.Printf("[ERROR] Couldn't read photo %s: %s", photoId, err)
+		return nil, err
+	}
+
+	return &photo, nil
+}
@@ -0,0 +1,195 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/nuxdie/instabot/metadata"
+	"github.com/nuxdie/instabot/retry"
+)
+
+const testPhotoId = "test:pipeline:photo"
+const testChatId = -5
+
+// the sorted sets of retry.Queue and retry.DeadLetters
+const retryQueueKey = "retry:queue"
+const deadKey = "retry:dead"
+
+var errStage = errors.New("stage failed")
+
+// stage captions every photo, or fails with err
+type stage struct {
+	err error
+}
+
+func (stage stage) Interested(message metadata.ChannelMessage, photo metadata.PhotoMetadata) bool {
+	return true
+}
+
+func (stage stage) Process(job *Job) (Result, error) {
+	if stage.err != nil {
+		return nil, stage.err
+	}
+
+	return Result{"caption": "a cat"}, nil
+}
+
+func (stage stage) Persist(job *Job, result Result) error {
+	return job.Store(result)
+}
+
+// testRuntime connects to the redis in TEST_REDIS_ADDR, the tests are
+// skipped without one. The test photo is created again, it failed the stage
+// once before, and its retries and dead letters are removed by the returned
+// func.
+func testRuntime(t *testing.T, processor Processor, policy retry.Policy) (*Runtime, func()) {
+	addr := os.Getenv("TEST_REDIS_ADDR")
+
+	if addr == "" {
+		t.Skip("TEST_REDIS_ADDR isn't set")
+	}
+
+	config := &Config{Retry: policy, ShutdownTimeout: time.Second}
+	config.Redis.Addr = addr
+	config.Redis.Stream = "test:pipeline"
+	config.Redis.Group = "test"
+
+	runtime := New("test", processor, config, "NEW")
+	clean := func() {
+		payload, _ := json.Marshal(testMessage)
+		runtime.redis.ZRem(retryQueueKey, string(payload))
+		runtime.redis.ZRem(deadKey, testPhotoId)
+		runtime.redis.Del(testPhotoId, config.Redis.Stream, deadKey+":"+strconv.Itoa(testChatId))
+	}
+
+	clean()
+
+	err := runtime.store.Create(metadata.PhotoMetadata{PhotoId: testPhotoId, ChatId: testChatId})
+
+	if err == nil {
+		_, err = runtime.store.Update(testPhotoId, func(photo *metadata.PhotoMetadata) error {
+			photo.CountAttempt("test")
+			return photo.Transition(metadata.StateNew, metadata.StateEnriching)
+		})
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return runtime, clean
+}
+
+var testMessage = metadata.ChannelMessage{Type: "NEW", PhotoId: testPhotoId}
+
+// queued tells whether the test message is waiting in the retry queue
+func queued(runtime *Runtime) bool {
+	payload, _ := json.Marshal(testMessage)
+	err := runtime.redis.ZScore(retryQueueKey, string(payload)).Err()
+
+	return err != redis.Nil
+}
+
+func TestHandle(t *testing.T) {
+	policy := retry.Policy{MaxAttempts: 3, Backoff: time.Minute}
+	exhausted := retry.Policy{MaxAttempts: 2}
+
+	tests := []struct {
+		name      string
+		err       error
+		cancelled bool // the handler was interrupted by a shutdown
+		policy    retry.Policy
+		state     metadata.State
+		attempts  int
+		queued    bool
+		dead      bool
+	}{
+		// the earlier failure of the stage is forgotten
+		{"done", nil, false, policy, metadata.StateEnriching, 0, false, false},
+		{"retried", errStage, false, policy, metadata.StateEnriching, 2, true, false},
+		{"exhausted", errStage, false, exhausted, metadata.StateFailed, 2, false, true},
+		{"permanent", retry.Permanent(errStage), false, policy, metadata.StateFailed, 2, false, true},
+		// not counted, retried right away
+		{"interrupted", context.Canceled, true, policy, metadata.StateEnriching, 1, true, false},
+	}
+
+	for _, test := range tests {
+		runtime, clean := testRuntime(t, stage{err: test.err}, test.policy)
+		ctx, cancel := context.WithCancel(context.Background())
+
+		if test.cancelled {
+			cancel()
+		}
+
+		err := runtime.handle(ctx, testMessage)
+		cancel()
+
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		}
+
+		photo, err := runtime.store.Get(testPhotoId)
+
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+
+		if photo.State != test.state || photo.StageAttempts("test") != test.attempts {
+			t.Errorf("%s: photo is %s after %d attempts, want %s after %d", test.name, photo.State,
+				photo.StageAttempts("test"), test.state, test.attempts)
+		}
+
+		if test.err == nil && photo.Caption != "a cat" {
+			t.Errorf("%s: result wasn't stored, caption is %q", test.name, photo.Caption)
+		}
+
+		if got := queued(runtime); got != test.queued {
+			t.Errorf("%s: queued %v, want %v", test.name, got, test.queued)
+		}
+
+		dead, err := runtime.dead.List(testChatId, 10)
+
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+
+		if got := len(dead) == 1; got != test.dead {
+			t.Errorf("%s: dead letters %v, want dead %v", test.name, dead, test.dead)
+		}
+
+		clean()
+	}
+}
+
+// results of photos that were settled meanwhile are dropped
+func TestStoreSettled(t *testing.T) {
+	runtime, clean := testRuntime(t, stage{}, retry.Policy{MaxAttempts: 3})
+	defer clean()
+
+	_, err := runtime.store.Update(testPhotoId, func(photo *metadata.PhotoMetadata) error {
+		return photo.Transition(metadata.StateEnriching, metadata.StateRejected)
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = runtime.handle(context.Background(), testMessage)
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	photo, err := runtime.store.Get(testPhotoId)
+
+	if err != nil || photo.State != metadata.StateRejected || photo.Caption != "" {
+		t.Errorf("photo is %s with caption %q, %v, want it %s without one", photo.State,
+			photo.Caption, err, metadata.StateRejected)
+	}
+}
@@ -0,0 +1,224 @@
+// this package counts the photos chats send against the quota of their plan
+package quota
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// plans chats can be on
+const Demo = "demo"
+const Basic = "basic"
+const Pro = "pro"
+
+const keyPrefix = "quota:"
+
+var ErrBadLimits = errors.New("limits must be <per day>,<per month>, 0 for no limit")
+
+// Plan limits the photos a chat may send a day and a month, UTC. A limit of
+// 0 doesn't limit.
+type Plan struct {
+	Name  string
+	Day   int
+	Month int
+}
+
+// ParsePlan reads the limits of plan name from "<per day>,<per month>"
+func ParsePlan(name, limits string) (Plan, error) {
+	parts := strings.Split(limits, ",")
+
+	if len(parts) != 2 {
+		return Plan{}, ErrBadLimits
+	}
+
+	day, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+
+	if err != nil || day < 0 {
+		return Plan{}, ErrBadLimits
+	}
+
+	month, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+
+	if err != nil || month < 0 {
+		return Plan{}, ErrBadLimits
+	}
+
+	return Plan{Name: name, Day: day, Month: month}, nil
+}
+
+// Usage is what a chat used of its plan in the current day and month
+type Usage struct {
+	Plan          Plan
+	Day           int
+	Month         int
+	DayResetsAt   time.Time
+	MonthResetsAt time.Time
+}
+
+// DayLeft is the number of photos the chat may still send today, -1 for no
+// limit
+func (usage Usage) DayLeft() int {
+	return left(usage.Plan.Day, usage.Day)
+}
+
+// MonthLeft is the number of photos the chat may still send this month, -1
+// for no limit
+func (usage Usage) MonthLeft() int {
+	return left(usage.Plan.Month, usage.Month)
+}
+
+func left(limit, used int) int {
+	if limit == 0 {
+		return -1
+	}
+
+	if used > limit {
+		return 0
+	}
+
+	return limit - used
+}
+
+// ResetsAt is when the chat may send photos again once it ran out
+func (usage Usage) ResetsAt() time.Time {
+	if usage.MonthLeft() == 0 {
+		return usage.MonthResetsAt
+	}
+
+	return usage.DayResetsAt
+}
+
+// takes a photo when both counters are below their limits, a limit of 0
+// doesn't limit. Counters expire once their period is over.
+// KEYS: day counter, month counter
+// ARGV: day limit, month limit, unix time the day and the month reset
+var takeScript = redis.NewScript(`
+local day = tonumber(redis.call("GET", KEYS[1]) or "0")
+local month = tonumber(redis.call("GET", KEYS[2]) or "0")
+local dayLimit = tonumber(ARGV[1])
+local monthLimit = tonumber(ARGV[2])
+
+if (dayLimit > 0 and day >= dayLimit) or (monthLimit > 0 and month >= monthLimit) then
+	return {0, day, month}
+end
+
+day = redis.call("INCR", KEYS[1])
+month = redis.call("INCR", KEYS[2])
+redis.call("EXPIREAT", KEYS[1], ARGV[3])
+redis.call("EXPIREAT", KEYS[2], ARGV[4])
+
+return {1, day, month}
+`)
+
+// gives back a photo taken in the same periods, counters don't go below 0
+// KEYS: day counter, month counter
+var giveScript = redis.NewScript(`
+for _, key in ipairs(KEYS) do
+	if tonumber(redis.call("GET", key) or "0") > 0 then
+		redis.call("DECR", key)
+	end
+end
+
+return 0
+`)
+
+// Counter counts photos per chat in redis, under a key per day and one per
+// month, so counts survive restarts and are shared by every bot
+type Counter struct {
+	redis *redis.Client
+}
+
+func NewCounter(client *redis.Client) *Counter {
+	return &Counter{
+		redis: client,
+	}
+}
+
+// periods of now, the keys of their counters and when they reset
+func periods(chatId int64, now time.Time) (string, string, time.Time, time.Time) {
+	now = now.UTC()
+	prefix := keyPrefix + strconv.FormatInt(chatId, 10)
+	dayResetsAt := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC).AddDate(0, 0, 1)
+	monthResetsAt := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC).AddDate(0, 1, 0)
+
+	return prefix + ":day:" + now.Format("20060102"), prefix + ":month:" + now.Format("200601"),
+		dayResetsAt, monthResetsAt
+}
+
+// Take counts a photo of chatId against plan if it has quota left, in one
+// step so bots taking photos at once can't go over it. false means the
+// quota is used up and nothing was counted.
+func (counter *Counter) Take(chatId int64, plan Plan) (Usage, bool, error) {
+	return counter.take(chatId, plan, time.Now())
+}
+
+func (counter *Counter) take(chatId int64, plan Plan, now time.Time) (Usage, bool, error) {
+	dayKey, monthKey, dayResetsAt, monthResetsAt := periods(chatId, now)
+	usage := Usage{Plan: plan, DayResetsAt: dayResetsAt, MonthResetsAt: monthResetsAt}
+
+	result, err := takeScript.Run(counter.redis, []string{dayKey, monthKey}, plan.Day, plan.Month,
+		dayResetsAt.Unix(), monthResetsAt.Unix()).Result()
+
+	if err != nil {
+		return usage, false, err
+	}
+
+	values, ok := result.([]interface{})
+
+	if !ok || len(values) != 3 {
+		return usage, false, fmt.Errorf("unexpected quota script result %v", result)
+	}
+
+	taken, _ := values[0].(int64)
+	day, _ := values[1].(int64)
+	month, _ := values[2].(int64)
+	usage.Day = int(day)
+	usage.Month = int(month)
+
+	return usage, taken == 1, nil
+}
+
+// Give takes back a photo of chatId that was counted but couldn't be
+// accepted after all
+func (counter *Counter) Give(chatId int64) error {
+	return counter.give(chatId, time.Now())
+}
+
+func (counter *Counter) give(chatId int64, now time.Time) error {
+	dayKey, monthKey, _, _ := periods(chatId, now)
+
+	return giveScript.Run(counter.redis, []string{dayKey, monthKey}).Err()
+}
+
+// Usage tells what chatId used of plan so far
+func (counter *Counter) Usage(chatId int64, plan Plan) (Usage, error) {
+	return counter.usage(chatId, plan, time.Now())
+}
+
+func (counter *Counter) usage(chatId int64, plan Plan, now time.Time) (Usage, error) {
+	dayKey, monthKey, dayResetsAt, monthResetsAt := periods(chatId, now)
+	usage := Usage{Plan: plan, DayResetsAt: dayResetsAt, MonthResetsAt: monthResetsAt}
+
+	counts, err := counter.redis.MGet(dayKey, monthKey).Result()
+
+	if err != nil {
+		return usage, err
+	}
+
+	usage.Day = count(counts[0])
+	usage.Month = count(counts[1])
+
+	return usage, nil
+}
+
+func count(value interface{}) int {
+	text, _ := value.(string)
+	n, _ := strconv.Atoi(text)
+
+	return n
+}
@@ -0,0 +1,225 @@
+package quota
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+func TestParsePlan(t *testing.T) {
+	tests := []struct {
+		limits string
+		want   Plan
+		err    error
+	}{
+		{"3,3", Plan{Name: "demo", Day: 3, Month: 3}, nil},
+		{" 10 , 100 ", Plan{Name: "demo", Day: 10, Month: 100}, nil},
+		{"0,0", Plan{Name: "demo"}, nil},
+		{"10", Plan{}, ErrBadLimits},
+		{"10,100,1000", Plan{}, ErrBadLimits},
+		{"ten,100", Plan{}, ErrBadLimits},
+		{"10,", Plan{}, ErrBadLimits},
+		{"-1,100", Plan{}, ErrBadLimits},
+		{"10,-1", Plan{}, ErrBadLimits},
+	}
+
+	for _, test := range tests {
+		got, err := ParsePlan("demo", test.limits)
+
+		if got != test.want || err != test.err {
+			t.Errorf("%q: got %v, %v, want %v, %v", test.limits, got, err, test.want, test.err)
+		}
+	}
+}
+
+func TestUsageLeft(t *testing.T) {
+	tests := []struct {
+		usage     Usage
+		dayLeft   int
+		monthLeft int
+		resetsAt  string
+	}{
+		{Usage{Plan: Plan{Day: 3, Month: 10}, Day: 1, Month: 5}, 2, 5, "day"},
+		{Usage{Plan: Plan{Day: 3, Month: 10}, Day: 3, Month: 5}, 0, 5, "day"},
+		{Usage{Plan: Plan{Day: 3, Month: 10}, Day: 2, Month: 10}, 1, 0, "month"},
+		{Usage{Plan: Plan{Day: 3, Month: 10}, Day: 5, Month: 12}, 0, 0, "month"},
+		{Usage{Plan: Plan{Day: 0, Month: 10}, Day: 50, Month: 5}, -1, 5, "day"},
+		{Usage{Plan: Plan{}, Day: 50, Month: 500}, -1, -1, "day"},
+	}
+
+	dayResetsAt := time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)
+	monthResetsAt := time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC)
+
+	for _, test := range tests {
+		test.usage.DayResetsAt = dayResetsAt
+		test.usage.MonthResetsAt = monthResetsAt
+
+		if got := test.usage.DayLeft(); got != test.dayLeft {
+			t.Errorf("%v: got %d left today, want %d", test.usage, got, test.dayLeft)
+		}
+
+		if got := test.usage.MonthLeft(); got != test.monthLeft {
+			t.Errorf("%v: got %d left this month, want %d", test.usage, got, test.monthLeft)
+		}
+
+		want := dayResetsAt
+
+		if test.resetsAt == "month" {
+			want = monthResetsAt
+		}
+
+		if got := test.usage.ResetsAt(); !got.Equal(want) {
+			t.Errorf("%v: resets at %s, want %s", test.usage, got, want)
+		}
+	}
+}
+
+func TestPeriods(t *testing.T) {
+	moscow := time.FixedZone("MSK", 3*60*60)
+
+	tests := []struct {
+		now           time.Time
+		dayKey        string
+		monthKey      string
+		dayResetsAt   time.Time
+		monthResetsAt time.Time
+	}{
+		{
+			time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC),
+			"quota:42:day:20261017", "quota:42:month:202610",
+			time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC), time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			time.Date(2026, 10, 31, 23, 59, 59, 0, time.UTC),
+			"quota:42:day:20261031", "quota:42:month:202610",
+			time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC), time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			time.Date(2026, 12, 31, 23, 0, 0, 0, time.UTC),
+			"quota:42:day:20261231", "quota:42:month:202612",
+			time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC),
+		},
+		// periods are UTC whatever the zone of now
+		{
+			time.Date(2026, 11, 1, 1, 0, 0, 0, moscow),
+			"quota:42:day:20261031", "quota:42:month:202610",
+			time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC), time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC),
+		},
+	}
+
+	for _, test := range tests {
+		dayKey, monthKey, dayResetsAt, monthResetsAt := periods(42, test.now)
+
+		if dayKey != test.dayKey || monthKey != test.monthKey {
+			t.Errorf("%s: got keys %s and %s, want %s and %s", test.now, dayKey, monthKey, test.dayKey,
+				test.monthKey)
+		}
+
+		if !dayResetsAt.Equal(test.dayResetsAt) || !monthResetsAt.Equal(test.monthResetsAt) {
+			t.Errorf("%s: got resets at %s and %s, want %s and %s", test.now, dayResetsAt, monthResetsAt,
+				test.dayResetsAt, test.monthResetsAt)
+		}
+	}
+}
+
+// testCounter connects to the redis in TEST_REDIS_ADDR, tests of the scripts
+// are skipped without one. The keys of chatId are removed before and by the
+// returned func.
+func testCounter(t *testing.T, chatId int64, times ...time.Time) (*Counter, func()) {
+	addr := os.Getenv("TEST_REDIS_ADDR")
+
+	if addr == "" {
+		t.Skip("TEST_REDIS_ADDR isn't set")
+	}
+
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	clean := func() {
+		for _, now := range times {
+			dayKey, monthKey, _, _ := periods(chatId, now)
+			client.Del(dayKey, monthKey)
+		}
+	}
+
+	clean()
+
+	return NewCounter(client), clean
+}
+
+// the counters of a period start over once it's over, counters of the
+// periods are kept apart in redis. Times are in the future, the counters
+// expire when their period is over.
+func TestTakeRollover(t *testing.T) {
+	year := time.Now().UTC().Year() + 1
+	plan := Plan{Name: Basic, Day: 2, Month: 3}
+
+	steps := []struct {
+		now   time.Time
+		taken bool
+		day   int
+		month int
+	}{
+		{time.Date(year, 1, 30, 10, 0, 0, 0, time.UTC), true, 1, 1},
+		{time.Date(year, 1, 30, 23, 59, 0, 0, time.UTC), true, 2, 2},
+		// over the day limit
+		{time.Date(year, 1, 30, 23, 59, 59, 0, time.UTC), false, 2, 2},
+		// next day, the month goes on
+		{time.Date(year, 1, 31, 0, 0, 0, 0, time.UTC), true, 1, 3},
+		// over the month limit
+		{time.Date(year, 1, 31, 12, 0, 0, 0, time.UTC), false, 1, 3},
+		// next month
+		{time.Date(year, 2, 1, 0, 0, 0, 0, time.UTC), true, 1, 1},
+	}
+
+	var times []time.Time
+
+	for _, step := range steps {
+		times = append(times, step.now)
+	}
+
+	counter, clean := testCounter(t, -1, times...)
+	defer clean()
+
+	for _, step := range steps {
+		usage, taken, err := counter.take(-1, plan, step.now)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if taken != step.taken || usage.Day != step.day || usage.Month != step.month {
+			t.Errorf("%s: got taken %v, %d today, %d this month, want %v, %d and %d", step.now, taken,
+				usage.Day, usage.Month, step.taken, step.day, step.month)
+		}
+	}
+}
+
+func TestGive(t *testing.T) {
+	now := time.Date(time.Now().UTC().Year()+1, 3, 15, 12, 0, 0, 0, time.UTC)
+	plan := Plan{Name: Demo, Day: 3, Month: 3}
+	counter, clean := testCounter(t, -2, now)
+	defer clean()
+
+	counter.take(-2, plan, now)
+	counter.take(-2, plan, now)
+
+	// twice as many as were taken, counters stop at 0
+	for i := 0; i < 4; i++ {
+		err := counter.give(-2, now)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	usage, err := counter.usage(-2, plan, now)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if usage.Day != 0 || usage.Month != 0 {
+		t.Errorf("got %d today and %d this month, want 0", usage.Day, usage.Month)
+	}
+}
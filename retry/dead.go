@@ -0,0 +1,114 @@
+package retry
+
+import (
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/nuxdie/instabot/metadata"
+)
+
+const deadKey = "retry:dead"
+
+// DeadLetters indexes photos that ran out of attempts, globally and per
+// chat. The photo record itself is the source of truth: entries of photos
+// that aren't FAILED any more are dropped when listed.
+type DeadLetters struct {
+	redis *redis.Client
+	store metadata.Store
+}
+
+func NewDeadLetters(client *redis.Client, store metadata.Store) *DeadLetters {
+	return &DeadLetters{
+		redis: client,
+		store: store,
+	}
+}
+
+// Add indexes photo, it's expected to be moved to FAILED right after
+func (dead *DeadLetters) Add(photo metadata.PhotoMetadata) error {
+	member := redis.Z{Score: float64(time.Now().Unix()), Member: photo.PhotoId}
+
+	_, err := dead.redis.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(deadKey, member)
+		pipe.ZAdd(chatKey(photo.ChatId), member)
+		return nil
+	})
+
+	return err
+}
+
+// List returns up to limit failed photos, latest failures first. chatId 0
+// lists every chat.
+func (dead *DeadLetters) List(chatId int64, limit int64) ([]metadata.PhotoMetadata, error) {
+	key := deadKey
+
+	if chatId != 0 {
+		key = chatKey(chatId)
+	}
+
+	ids, err := dead.redis.ZRevRange(key, 0, limit-1).Result()
+
+	if err != nil {
+		return nil, err
+	}
+
+	var photos []metadata.PhotoMetadata
+
+	for _, photoId := range ids {
+		photo, err := dead.store.Get(photoId)
+
+		if err == metadata.ErrNotFound || err == nil && photo.State != metadata.StateFailed {
+			dead.remove(photoId, photo.ChatId)
+			continue
+		}
+
+		if err != nil {
+			log.Printf("[ERROR] Couldn't get dead letter %s: %s", photoId, err)
+			continue
+		}
+
+		photos = append(photos, photo)
+	}
+
+	return photos, nil
+}
+
+// Requeue resets the attempts of a failed photo and sends it through the
+// whole pipeline again, stages that already left their result skip it
+func (dead *DeadLetters) Requeue(photoId string) (metadata.PhotoMetadata, error) {
+	photo, err := dead.store.Update(photoId, func(photo *metadata.PhotoMetadata) error {
+		err := photo.Transition(metadata.StateFailed, metadata.StateNew)
+
+		photo.ClearAttempts()
+
+		return err
+	}, metadata.ChannelMessage{Type: "NEW"})
+
+	if err == nil || err == metadata.ErrNotFound || metadata.IsTransitionError(err) {
+		dead.remove(photoId, photo.ChatId)
+	}
+
+	return photo, err
+}
+
+func (dead *DeadLetters) remove(photoId string, chatId int64) {
+	_, err := dead.redis.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.ZRem(deadKey, photoId)
+
+		if chatId != 0 {
+			pipe.ZRem(chatKey(chatId), photoId)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		log.Printf("[ERROR] Couldn't remove dead letter %s: %s", photoId, err)
+	}
+}
+
+func chatKey(chatId int64) string {
+	return deadKey + ":" + strconv.FormatInt(chatId, 10)
+}
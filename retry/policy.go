@@ -0,0 +1,60 @@
+// this package decides when a failed stage is tried again: it holds the
+// backoff policy, the queue of delayed messages and the dead letters
+package retry
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Policy is the retry policy of a single stage
+type Policy struct {
+	MaxAttempts int           // failed attempts before the photo goes to the dead letters
+	Backoff     time.Duration // delay after the first failure, doubled after each next one
+	MaxBackoff  time.Duration // upper bound of the delay
+	Jitter      float64       // random share of the delay, 0.2 means +/-20%
+}
+
+// Exhausted tells whether a photo that failed attempts times should be given up
+func (policy Policy) Exhausted(attempts int) bool {
+	return attempts >= policy.MaxAttempts
+}
+
+// Delay returns how long to wait before the attempt following attempts failures
+func (policy Policy) Delay(attempts int) time.Duration {
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	delay := float64(policy.Backoff) * math.Pow(2, float64(attempts-1))
+
+	if policy.MaxBackoff > 0 && delay > float64(policy.MaxBackoff) {
+		delay = float64(policy.MaxBackoff)
+	}
+
+	if policy.Jitter > 0 {
+		delay += delay * policy.Jitter * (rand.Float64()*2 - 1)
+	}
+
+	return time.Duration(delay)
+}
+
+type permanent struct {
+	err error
+}
+
+func (err permanent) Error() string {
+	return err.err.Error()
+}
+
+// Permanent marks err as one that won't go away with retries, such a
+// failure sends the photo to the dead letters right away
+func Permanent(err error) error {
+	return permanent{err: err}
+}
+
+func IsPermanent(err error) bool {
+	_, ok := err.(permanent)
+	return ok
+}
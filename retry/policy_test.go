@@ -0,0 +1,99 @@
+package retry
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPolicyDelay(t *testing.T) {
+	policy := Policy{MaxAttempts: 5, Backoff: time.Second, MaxBackoff: 10 * time.Second}
+
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{0, time.Second},
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 8 * time.Second},
+		{5, 10 * time.Second},
+		{60, 10 * time.Second},
+	}
+
+	for _, test := range tests {
+		if got := policy.Delay(test.attempts); got != test.want {
+			t.Errorf("after %d attempts: got %s, want %s", test.attempts, got, test.want)
+		}
+	}
+}
+
+func TestPolicyDelayWithoutMax(t *testing.T) {
+	policy := Policy{Backoff: time.Second}
+
+	if got := policy.Delay(11); got != 1024*time.Second {
+		t.Errorf("got %s, want %s", got, 1024*time.Second)
+	}
+}
+
+func TestPolicyDelayJitter(t *testing.T) {
+	policy := Policy{Backoff: time.Second, MaxBackoff: 10 * time.Second, Jitter: 0.2}
+
+	tests := []struct {
+		attempts int
+		min      time.Duration
+		max      time.Duration
+	}{
+		{1, 800 * time.Millisecond, 1200 * time.Millisecond},
+		{3, 3200 * time.Millisecond, 4800 * time.Millisecond},
+		{10, 8 * time.Second, 12 * time.Second},
+	}
+
+	for _, test := range tests {
+		for i := 0; i < 100; i++ {
+			got := policy.Delay(test.attempts)
+
+			if got < test.min || got > test.max {
+				t.Fatalf("after %d attempts: got %s, want between %s and %s", test.attempts, got,
+					test.min, test.max)
+			}
+		}
+	}
+}
+
+func TestPolicyExhausted(t *testing.T) {
+	policy := Policy{MaxAttempts: 3}
+
+	tests := []struct {
+		attempts int
+		want     bool
+	}{
+		{0, false},
+		{2, false},
+		{3, true},
+		{4, true},
+	}
+
+	for _, test := range tests {
+		if got := policy.Exhausted(test.attempts); got != test.want {
+			t.Errorf("after %d attempts: got %v, want %v", test.attempts, got, test.want)
+		}
+	}
+}
+
+func TestPermanent(t *testing.T) {
+	err := errors.New("broken")
+
+	if IsPermanent(err) {
+		t.Errorf("%s is permanent", err)
+	}
+
+	if !IsPermanent(Permanent(err)) {
+		t.Errorf("Permanent(%s) isn't permanent", err)
+	}
+
+	if Permanent(err).Error() != err.Error() {
+		t.Errorf("got %q, want %q", Permanent(err).Error(), err.Error())
+	}
+}
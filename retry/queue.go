@@ -0,0 +1,112 @@
+package retry
+
+import (
+	"encoding/json"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/nuxdie/instabot/metadata"
+)
+
+const queueKey = "retry:queue"
+const pollInterval = time.Second
+const pollBatch = 100
+
+// Queue holds messages to be published again later. It's a sorted set of
+// JSON encoded messages scored by the unix time in ms they're due.
+type Queue struct {
+	redis  *redis.Client
+	outbox metadata.Outbox
+}
+
+func NewQueue(client *redis.Client, outbox metadata.Outbox) *Queue {
+	return &Queue{
+		redis:  client,
+		outbox: outbox,
+	}
+}
+
+// Schedule publishes message again at at. The same message scheduled twice
+// is published once.
+func (queue *Queue) Schedule(message metadata.ChannelMessage, at time.Time) error {
+	payload, err := json.Marshal(&message)
+
+	if err != nil {
+		log.Printf("[ERROR] Couldn't encode JSON: %s", err)
+		return err
+	}
+
+	return queue.redis.ZAdd(queueKey, redis.Z{
+		Score:  float64(unixMillis(at)),
+		Member: string(payload),
+	}).Err()
+}
+
+// Run publishes due messages until stop is closed. Any number of processes
+// may run it, each message is published by one of them only.
+func (queue *Queue) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			queue.flush()
+		}
+	}
+}
+
+func (queue *Queue) flush() {
+	err := queue.redis.Watch(func(tx *redis.Tx) error {
+		due, err := tx.ZRangeByScore(queueKey, redis.ZRangeBy{
+			Min:   "-inf",
+			Max:   strconv.FormatInt(unixMillis(time.Now()), 10),
+			Count: pollBatch,
+		}).Result()
+
+		if err != nil || len(due) == 0 {
+			return err
+		}
+
+		_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
+			for _, payload := range due {
+				pipe.ZRem(queueKey, payload)
+
+				var message metadata.ChannelMessage
+				err := json.Unmarshal([]byte(payload), &message)
+
+				if err != nil {
+					log.Printf("[ERROR] Couldn't decode JSON message, dropping it: %s", payload)
+					continue
+				}
+
+				err = queue.outbox(pipe, message)
+
+				if err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+
+		if err == nil {
+			log.Printf("[DEBUG] Published %d delayed messages", len(due))
+		}
+
+		return err
+	}, queueKey)
+
+	// somebody else was faster, the next tick will pick up whatever is left
+	if err != nil && err != redis.TxFailedErr {
+		log.Printf("[ERROR] Couldn't publish delayed messages: %s", err)
+	}
+}
+
+func unixMillis(at time.Time) int64 {
+	return at.UnixNano() / int64(time.Millisecond)
+}
@@ -0,0 +1,174 @@
+// this package publishes photos at the time they were scheduled for
+package schedule
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/nuxdie/instabot/metadata"
+)
+
+const dueKey = "schedule:due"
+const chatKeyPrefix = "schedule:chat:"
+const pollInterval = time.Second
+const pollBatch = 100
+
+// the photo was scheduled again for later, it stays in the set
+var errNotDue = errors.New("photo isn't due yet")
+
+// Scheduler keeps scheduled photos in sorted sets scored by the unix time in
+// ms they're due: one of all photos, which is polled, and one per chat to
+// list them. The photo record has the last word, the sets may still hold
+// photos that were scheduled again, cancelled or published meanwhile.
+type Scheduler struct {
+	redis *redis.Client
+	store metadata.Store
+}
+
+func New(client *redis.Client, store metadata.Store) *Scheduler {
+	return &Scheduler{
+		redis: client,
+		store: store,
+	}
+}
+
+func chatKey(chatId int64) string {
+	return chatKeyPrefix + strconv.FormatInt(chatId, 10)
+}
+
+// Schedule has a photo published at at. Photos waiting for approval move to
+// SCHEDULED, scheduled ones just get the new time.
+func (scheduler *Scheduler) Schedule(photoId string, at time.Time) (metadata.PhotoMetadata, error) {
+	photo, err := scheduler.store.Get(photoId)
+
+	if err != nil {
+		return photo, err
+	}
+
+	// the sets go first, a photo that didn't make it to SCHEDULED is dropped
+	// from them once it's due
+	_, err = scheduler.redis.TxPipelined(func(pipe redis.Pipeliner) error {
+		member := redis.Z{Score: float64(unixMillis(at)), Member: photoId}
+		pipe.ZAdd(dueKey, member)
+		pipe.ZAdd(chatKey(photo.ChatId), member)
+
+		return nil
+	})
+
+	if err != nil {
+		return photo, err
+	}
+
+	return scheduler.store.Update(photoId, func(photo *metadata.PhotoMetadata) error {
+		if photo.State != metadata.StateScheduled {
+			err := photo.Transition(metadata.StateAwaitingApproval, metadata.StateScheduled)
+
+			if err != nil {
+				return err
+			}
+		}
+
+		photo.PublishAt = at.Unix()
+
+		return nil
+	})
+}
+
+// List returns the scheduled photos of a chat, the next one first
+func (scheduler *Scheduler) List(chatId int64) ([]metadata.PhotoMetadata, error) {
+	photoIds, err := scheduler.redis.ZRange(chatKey(chatId), 0, -1).Result()
+
+	if err != nil {
+		return nil, err
+	}
+
+	photos := make([]metadata.PhotoMetadata, 0, len(photoIds))
+
+	for _, photoId := range photoIds {
+		photo, err := scheduler.store.Get(photoId)
+
+		if err != nil && err != metadata.ErrNotFound {
+			return nil, err
+		}
+
+		if err == metadata.ErrNotFound || photo.State != metadata.StateScheduled {
+			scheduler.redis.ZRem(chatKey(chatId), photoId)
+			continue
+		}
+
+		photos = append(photos, photo)
+	}
+
+	return photos, nil
+}
+
+// Run sends due photos to instagram until stop is closed. Any number of
+// processes may run it, each photo is published by one of them only.
+func (scheduler *Scheduler) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			scheduler.flush()
+		}
+	}
+}
+
+func (scheduler *Scheduler) flush() {
+	now := time.Now()
+	due, err := scheduler.redis.ZRangeByScore(dueKey, redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(unixMillis(now), 10),
+		Count: pollBatch,
+	}).Result()
+
+	if err != nil {
+		log.Printf("[ERROR] Couldn't get due photos: %s", err)
+		return
+	}
+
+	for _, photoId := range due {
+		err := scheduler.publish(photoId, now)
+
+		if err == errNotDue {
+			continue
+		}
+
+		if err != nil && err != metadata.ErrNotFound && !metadata.IsTransitionError(err) {
+			log.Printf("[ERROR] Couldn't publish scheduled photo %s: %s", photoId, err)
+			continue
+		}
+
+		// published, or cancelled or published by somebody else meanwhile
+		scheduler.redis.ZRem(dueKey, photoId)
+	}
+}
+
+// publish moves a due photo on to PUBLISHING and sends PUBLISH for instagram,
+// both in one MULTI/EXEC
+func (scheduler *Scheduler) publish(photoId string, now time.Time) error {
+	_, err := scheduler.store.Update(photoId, func(photo *metadata.PhotoMetadata) error {
+		if photo.State == metadata.StateScheduled && photo.PublishAt > now.Unix() {
+			return errNotDue
+		}
+
+		return photo.Transition(metadata.StateScheduled, metadata.StatePublishing)
+	}, metadata.ChannelMessage{Type: "PUBLISH"})
+
+	if err == nil {
+		log.Printf("[INFO] Publishing scheduled photo %s", photoId)
+	}
+
+	return err
+}
+
+func unixMillis(at time.Time) int64 {
+	return at.UnixNano() / int64(time.Millisecond)
+}
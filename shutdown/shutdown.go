@@ -0,0 +1,51 @@
+// this package turns SIGTERM and SIGINT into a cancelled context, so services
+// can stop taking work and drain what's in flight before exiting
+package shutdown
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Context is cancelled on the first SIGTERM or SIGINT, the second one exits
+// right away without waiting for anything
+func Context(parent context.Context) context.Context {
+	ctx, cancel := context.WithCancel(parent)
+	signals := make(chan os.Signal, 2)
+
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	go func() {
+		sig := <-signals
+		log.Printf("[INFO] Got %s, shutting down", sig)
+		cancel()
+
+		sig = <-signals
+		log.Printf("[WARN] Got %s again, exiting without draining", sig)
+		os.Exit(1)
+	}()
+
+	return ctx
+}
+
+// Wait waits for group, false means it's still running after timeout
+func Wait(group *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+
+	go func() {
+		group.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nuxdie/instabot/account"
+	"github.com/nuxdie/instabot/logging"
+	"gopkg.in/telegram-bot-api.v4"
+)
+
+// Chats post to the instagram account they connected with /connect, or to
+// the default account of the instagram worker. Credentials are checked with
+// a test login before they're kept.
+
+// connectCommand connects the account given as /connect <username> <password>
+func (server *Server) connectCommand(update tgbotapi.Update) {
+	chatId := update.Message.Chat.ID
+	logger := logging.New(logging.Fields{ChatId: chatId})
+	args := strings.Fields(update.Message.CommandArguments())
+
+	if len(args) != 0 {
+		// the password shouldn't stay in the chat
+		server.deleteMessage(chatId, update.Message.MessageID)
+	}
+
+	if !update.Message.Chat.IsPrivate() {
+		server.bot.Send(tgbotapi.NewMessage(chatId, server.t(chatId, "connect_private")))
+		return
+	}
+
+	if len(args) != 2 {
+		server.bot.Send(tgbotapi.NewMessage(chatId, server.t(chatId, "connect_usage")))
+		return
+	}
+
+	if !server.accounts.CanConnect() {
+		server.bot.Send(tgbotapi.NewMessage(chatId, server.t(chatId, "connect_unavailable")))
+		return
+	}
+
+	username := strings.TrimPrefix(args[0], "@")
+	server.bot.Send(tgbotapi.NewMessage(chatId, server.t(chatId, "connect_checking", struct {
+		Username string
+	}{Username: username})))
+
+	insta, err := account.Verify(username, args[1])
+
+	if err != nil {
+		logger.Printf("[WARN] Instagram didn't take the credentials of %s: %s", username, err)
+		server.bot.Send(tgbotapi.NewMessage(chatId, server.t(chatId, "connect_failed", struct {
+			Username string
+			Error    error
+		}{Username: username, Error: err})))
+		return
+	}
+
+	connected := account.Account{
+		ChatId:      chatId,
+		Username:    username,
+		ConnectedAt: time.Now(),
+	}
+	password := []byte(args[1])
+	err = server.accounts.Put(connected, password)
+
+	for i := range password {
+		password[i] = 0
+	}
+
+	if err != nil {
+		logger.Printf("[ERROR] Couldn't connect account %s to chat %d: %s", username, chatId, err)
+		server.bot.Send(tgbotapi.NewMessage(chatId, server.t(chatId, "publish_err", struct {
+			Error error
+		}{Error: err})))
+		return
+	}
+
+	// the worker goes on with the session of the test login, on its device
+	err = server.accounts.SaveSession(connected, insta)
+
+	if err != nil {
+		logger.Printf("[WARN] Couldn't save the session of account %s, the worker logs in again: %s",
+			username, err)
+	}
+
+	logger.Printf("[INFO] Chat %d connected instagram account %s", chatId, username)
+	server.bot.Send(tgbotapi.NewMessage(chatId, server.t(chatId, "connect_ok", struct {
+		Username string
+	}{Username: username})))
+}
+
+// disconnectCommand forgets the account of the chat, its photos go to the
+// default account again
+func (server *Server) disconnectCommand(update tgbotapi.Update) {
+	chatId := update.Message.Chat.ID
+	logger := logging.New(logging.Fields{ChatId: chatId})
+
+	err := server.accounts.Delete(chatId)
+
+	if err == account.ErrNotFound {
+		server.bot.Send(tgbotapi.NewMessage(chatId, server.t(chatId, "account_none")))
+		return
+	}
+
+	if err != nil {
+		logger.Printf("[ERROR] Couldn't disconnect the account of chat %d: %s", chatId, err)
+		server.bot.Send(tgbotapi.NewMessage(chatId, server.t(chatId, "publish_err", struct {
+			Error error
+		}{Error: err})))
+		return
+	}
+
+	logger.Printf("[INFO] Chat %d disconnected its instagram account", chatId)
+	server.bot.Send(tgbotapi.NewMessage(chatId, server.t(chatId, "disconnect_ok")))
+}
+
+// accountCommand shows the account the chat posts to
+func (server *Server) accountCommand(update tgbotapi.Update) {
+	chatId := update.Message.Chat.ID
+	logger := logging.New(logging.Fields{ChatId: chatId})
+
+	connected, err := server.accounts.Get(chatId)
+
+	if err == account.ErrNotFound {
+		server.bot.Send(tgbotapi.NewMessage(chatId, server.t(chatId, "account_none")))
+		return
+	}
+
+	if err != nil {
+		logger.Printf("[ERROR] Couldn't get the account of chat %d: %s", chatId, err)
+		server.bot.Send(tgbotapi.NewMessage(chatId, server.t(chatId, "publish_err", struct {
+			Error error
+		}{Error: err})))
+		return
+	}
+
+	server.bot.Send(tgbotapi.NewMessage(chatId, server.t(chatId, "account_connected", struct {
+		Username string
+		Time     string
+	}{Username: connected.Username, Time: server.formatTime(chatId, connected.ConnectedAt)})))
+}
+
+// loggedText is the text of message as it may be logged, the credentials of
+// /connect are left out
+func loggedText(message *tgbotapi.Message) string {
+	if message.Command() == "connect" {
+		return "/connect [redacted]"
+	}
+
+	return message.Text
+}
+
+// deleteMessage removes a message of the chat, which bots may do in private
+// chats and where they're admins
+func (server Server) deleteMessage(chatId int64, messageId int) {
+	_, err := server.bot.MakeRequest("deleteMessage", url.Values{
+		"chat_id":    {strconv.FormatInt(chatId, 10)},
+		"message_id": {strconv.Itoa(messageId)},
+	})
+
+	if err != nil {
+		logging.New(logging.Fields{ChatId: chatId}).Printf("[WARN] Couldn't delete message %d: %s",
+			messageId, err)
+	}
+}
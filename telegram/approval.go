@@ -0,0 +1,685 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/nuxdie/instabot/logging"
+	"github.com/nuxdie/instabot/metadata"
+	"github.com/nuxdie/instabot/metrics"
+	"gopkg.in/telegram-bot-api.v4"
+)
+
+// callback data of the preview buttons
+const actionApprove = "approve"
+const actionCaption = "caption"
+const actionHashtags = "hashtags"
+const actionCancel = "cancel"
+
+// telegram only hands back the message a button or a reply belongs to, so
+// the photo of every message that can be clicked or replied to is kept here
+const replyKeyPrefix = "telegram:reply:"
+const replyTTL = time.Hour * 24 * 7
+
+// the photo of the latest preview of a chat, which /caption and /tags edit
+const previewKeyPrefix = "telegram:preview:"
+
+// every edit of a photo, oldest first, so the generated text isn't lost.
+// Only the latest maxEdits are kept, for editsTTL after the latest one.
+const editsKeyPrefix = "telegram:edits:"
+const editsTTL = time.Hour * 24 * 30
+const maxEdits = 100
+
+var errNotAwaitingApproval = errors.New("photo isn't waiting for approval")
+
+// editCommands maps the commands that work as replies to the field they
+// change, the schedule is changed like one
+var editCommands = map[string]string{
+	"caption":  actionCaption,
+	"tags":     actionHashtags,
+	"schedule": actionSchedule,
+}
+
+// replyTarget is what a bot message is about
+type replyTarget struct {
+	PhotoId string
+	Field   string // what a reply edits, actionCaption, actionHashtags or actionSchedule; empty for previews
+}
+
+func replyKey(chatId int64, messageId int) string {
+	return replyKeyPrefix + strconv.FormatInt(chatId, 10) + ":" + strconv.Itoa(messageId)
+}
+
+func (server Server) remember(chatId int64, messageId int, target replyTarget) error {
+	key := replyKey(chatId, messageId)
+
+	_, err := server.redis.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.HMSet(key, map[string]interface{}{
+			"photo_id": target.PhotoId,
+			"field":    target.Field,
+		})
+		pipe.Expire(key, replyTTL)
+
+		return nil
+	})
+
+	return err
+}
+
+// recall finds out what a bot message is about, nil means it's about nothing
+// or too old
+func (server Server) recall(chatId int64, messageId int) (*replyTarget, error) {
+	fields, err := server.redis.HGetAll(replyKey(chatId, messageId)).Result()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if fields["photo_id"] == "" {
+		return nil, nil
+	}
+
+	return &replyTarget{PhotoId: fields["photo_id"], Field: fields["field"]}, nil
+}
+
+// editRecord is one entry of the edit history of a photo
+type editRecord struct {
+	Field  string `json:"field"`
+	Old    string `json:"old"`
+	New    string `json:"new"`
+	ChatId int64  `json:"chat_id"`
+	At     int64  `json:"at"`
+}
+
+func previewKey(chatId int64) string {
+	return previewKeyPrefix + strconv.FormatInt(chatId, 10)
+}
+
+func editsKey(photoId string) string {
+	return editsKeyPrefix + photoId
+}
+
+// awaitApproval merges caption and hashtags of an enriched photo and asks the
+// user whether that's what should be posted
+func (server Server) awaitApproval(photoMetadata metadata.PhotoMetadata) error {
+	logger := logging.ForPhoto(photoMetadata)
+
+	updated, err := server.store.Update(photoMetadata.PhotoId, func(photo *metadata.PhotoMetadata) error {
+		err := photo.Transition(metadata.StateEnriching, metadata.StateAwaitingApproval)
+
+		if photo.IsGallery() {
+			// shared by the items, see checkGallery
+			photo.Caption, photo.Hashtag = photoMetadata.Caption, photoMetadata.Hashtag
+		}
+
+		photo.FinalCaption = server.mergeCaptions(photo.Caption, photo.Hashtag)
+
+		if photo.Framing == "" && len(photo.Framings()) > 0 {
+			photo.Framing = server.chatFraming(photo.ChatId)
+		}
+
+		return err
+	})
+
+	if metadata.IsTransitionError(err) {
+		logger.Printf("[DEBUG] %s", err)
+		return nil
+	}
+
+	if err != nil {
+		logger.Printf("[ERROR] Couldn't set photo %s awaiting approval: %s",
+			photoMetadata.PhotoId, err)
+		return err
+	}
+
+	return server.sendPreview(updated)
+}
+
+// sendPreview shows the final caption as a reply to the photo, with buttons
+// to approve, edit or cancel it, and the framed versions of the photo if
+// there are any
+func (server Server) sendPreview(photoMetadata metadata.PhotoMetadata) error {
+	logger := logging.ForPhoto(photoMetadata)
+	chatId := photoMetadata.ChatId
+
+	server.sendFramings(photoMetadata)
+
+	msg := tgbotapi.NewMessage(chatId, server.previewText(photoMetadata))
+	msg.ReplyToMessageID = photoMetadata.MessageId
+	msg.ReplyMarkup = server.previewKeyboard(photoMetadata)
+
+	sent, err := server.bot.Send(msg)
+
+	if err != nil {
+		logger.Printf("[ERROR] Couldn't send preview of %s: %s", photoMetadata.PhotoId, err)
+		return err
+	}
+
+	err = server.remember(chatId, sent.MessageID, replyTarget{PhotoId: photoMetadata.PhotoId})
+
+	if err == nil {
+		err = server.redis.Set(previewKey(chatId), photoMetadata.PhotoId, replyTTL).Err()
+	}
+
+	if err != nil {
+		logger.Printf("[ERROR] Couldn't remember preview of %s: %s", photoMetadata.PhotoId, err)
+		return err
+	}
+
+	_, err = server.store.Update(photoMetadata.PhotoId, func(photo *metadata.PhotoMetadata) error {
+		photo.PreviewMessageId = sent.MessageID
+		return nil
+	})
+
+	if err != nil {
+		logger.Printf("[ERROR] Couldn't store preview of %s: %s", photoMetadata.PhotoId, err)
+		return err
+	}
+
+	logger.Printf("[INFO] Sent preview of %s, waiting for approval", photoMetadata.PhotoId)
+
+	return nil
+}
+
+// updatePreview renders the preview again after the photo changed. Once
+// there's a status the photo isn't waiting for approval and the buttons go.
+func (server Server) updatePreview(photoMetadata metadata.PhotoMetadata, status string) {
+	chatId := photoMetadata.ChatId
+
+	if photoMetadata.PreviewMessageId == 0 {
+		return
+	}
+
+	text := server.previewText(photoMetadata)
+
+	if status != "" {
+		text += "\n\n" + status
+	}
+
+	edit := tgbotapi.NewEditMessageText(chatId, photoMetadata.PreviewMessageId, text)
+
+	if status == "" {
+		keyboard := server.previewKeyboard(photoMetadata)
+		edit.ReplyMarkup = &keyboard
+	}
+
+	_, err := server.bot.Send(edit)
+
+	if err != nil {
+		logging.ForPhoto(photoMetadata).Printf("[WARN] Couldn't update preview of %s: %s",
+			photoMetadata.PhotoId, err)
+	}
+}
+
+func (server Server) previewText(photoMetadata metadata.PhotoMetadata) string {
+	text := server.t(photoMetadata.ChatId, "preview", struct {
+		Info string
+	}{Info: photoMetadata.FinalCaption})
+
+	if len(photoMetadata.Framings()) > 0 {
+		text += "\n\n" + server.t(photoMetadata.ChatId, "preview_framing")
+	}
+
+	return text
+}
+
+func (server Server) previewKeyboard(photoMetadata metadata.PhotoMetadata) tgbotapi.InlineKeyboardMarkup {
+	chatId := photoMetadata.ChatId
+	keyboard := tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(server.t(chatId, "button_approve"), actionApprove),
+			tgbotapi.NewInlineKeyboardButtonData(server.t(chatId, "button_schedule"), actionSchedule),
+			tgbotapi.NewInlineKeyboardButtonData(server.t(chatId, "button_cancel"), actionCancel),
+		),
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(server.t(chatId, "button_edit_caption"), actionCaption),
+			tgbotapi.NewInlineKeyboardButtonData(server.t(chatId, "button_edit_hashtags"), actionHashtags),
+		),
+	)
+
+	if len(photoMetadata.Framings()) > 0 {
+		keyboard.InlineKeyboard = append(keyboard.InlineKeyboard, server.framingRow(photoMetadata))
+	}
+
+	return keyboard
+}
+
+// handleCallback handles clicks on the preview buttons
+func (server *Server) handleCallback(query *tgbotapi.CallbackQuery) {
+	if query.Message == nil {
+		// clicks on inline mode messages, which the bot doesn't send
+		server.bot.AnswerCallbackQuery(tgbotapi.NewCallback(query.ID, ""))
+		return
+	}
+
+	chatId := query.Message.Chat.ID
+	logger := logging.New(logging.Fields{ChatId: chatId})
+
+	logger.Printf("[INFO] Button %s clicked in chat %d", query.Data, chatId)
+
+	// history pages aren't about a photo
+	if strings.HasPrefix(query.Data, actionHistory) {
+		server.turnHistoryPage(query)
+		return
+	}
+
+	target, err := server.recall(chatId, query.Message.MessageID)
+
+	if err != nil {
+		logger.Printf("[ERROR] Couldn't find out what message %d is about: %s",
+			query.Message.MessageID, err)
+		server.bot.AnswerCallbackQuery(tgbotapi.NewCallback(query.ID, err.Error()))
+		return
+	}
+
+	if target == nil {
+		server.bot.AnswerCallbackQuery(tgbotapi.NewCallback(query.ID,
+			server.t(chatId, "photo_expired")))
+		return
+	}
+
+	logger = logging.New(logging.Fields{ChatId: chatId, PhotoId: target.PhotoId})
+
+	if !server.mayHandle(logger, chatId, query.From, target.PhotoId) {
+		server.bot.AnswerCallbackQuery(tgbotapi.NewCallbackWithAlert(query.ID,
+			server.t(chatId, "photo_not_yours")))
+		return
+	}
+
+	var answer string
+
+	switch query.Data {
+	case actionApprove:
+		answer = server.approve(logger, chatId, target.PhotoId)
+	case actionCancel:
+		answer = server.cancel(logger, chatId, target.PhotoId)
+	case actionCaption, actionHashtags, actionSchedule:
+		answer = server.promptEdit(logger, chatId, target.PhotoId, query.Data)
+	default:
+		if strings.HasPrefix(query.Data, actionFrame) {
+			answer = server.chooseFraming(logger, chatId, target.PhotoId,
+				strings.TrimPrefix(query.Data, actionFrame))
+		} else {
+			logger.Printf("[WARN] Unknown button %s", query.Data)
+		}
+	}
+
+	server.bot.AnswerCallbackQuery(tgbotapi.NewCallback(query.ID, answer))
+}
+
+// mayHandle tells whether user may approve, edit, schedule or cancel a photo:
+// the one who sent it may, and so may the admins of the chat. Photos recorded
+// before their senders were may be handled by anyone in the chat.
+func (server Server) mayHandle(logger *log.Logger, chatId int64, user *tgbotapi.User, photoId string) bool {
+	if user == nil {
+		return false
+	}
+
+	photo, err := server.store.Get(photoId)
+
+	if err == metadata.ErrNotFound {
+		// the handlers tell it's gone
+		return true
+	}
+
+	if err != nil {
+		logger.Printf("[ERROR] Couldn't get photo %s: %s", photoId, err)
+		return false
+	}
+
+	if sentBy(photo, user) || server.isChatAdmin(logger, chatId, user) {
+		return true
+	}
+
+	logger.Printf("[WARN] User %d isn't allowed to handle photo %s of user %d", user.ID, photoId,
+		photo.UserId)
+
+	return false
+}
+
+// isChatAdmin tells whether user created or administers the chat
+func (server Server) isChatAdmin(logger *log.Logger, chatId int64, user *tgbotapi.User) bool {
+	if user == nil {
+		return false
+	}
+
+	member, err := server.bot.GetChatMember(tgbotapi.ChatConfigWithUser{ChatID: chatId, UserID: user.ID})
+
+	if err != nil {
+		logger.Printf("[ERROR] Couldn't get member %d of chat %d: %s", user.ID, chatId, err)
+		return false
+	}
+
+	return member.IsCreator() || member.IsAdministrator()
+}
+
+// approve sends a photo waiting for approval on to instagram. Clicking it
+// again retries a photo that was approved but couldn't be sent on.
+func (server Server) approve(logger *log.Logger, chatId int64, photoId string) string {
+	photo, err := server.transition(photoId, metadata.StateAwaitingApproval, metadata.StateReady)
+
+	if metadata.IsTransitionError(err) && photo.State != metadata.StateReady {
+		logger.Printf("[DEBUG] %s", err)
+		return server.t(chatId, "photo_handled")
+	}
+
+	if err != nil && !metadata.IsTransitionError(err) {
+		logger.Printf("[ERROR] Couldn't approve photo %s: %s", photoId, err)
+		return err.Error()
+	}
+
+	logger.Printf("[INFO] Photo %s approved", photoId)
+
+	err = server.publish(photo)
+
+	if err != nil {
+		return err.Error()
+	}
+
+	return server.t(chatId, "publish_ok")
+}
+
+// cancel drops a photo of the chat anywhere before it's uploaded. Stages
+// still working on it drop their results, see pipeline.Job.Store.
+func (server Server) cancel(logger *log.Logger, chatId int64, photoId string) string {
+	photo, err := server.store.Update(photoId, func(photo *metadata.PhotoMetadata) error {
+		if photo.ChatId != chatId {
+			return metadata.ErrNotFound
+		}
+
+		if photo.State == metadata.StatePublishing {
+			return errTooLate
+		}
+
+		return photo.Transition(photo.State, metadata.StateRejected)
+	})
+
+	if metadata.IsTransitionError(err) {
+		logger.Printf("[DEBUG] %s", err)
+		return server.t(chatId, "photo_handled")
+	}
+
+	if err == metadata.ErrNotFound {
+		return server.t(chatId, "photo_expired")
+	}
+
+	if err == errTooLate {
+		return server.t(chatId, "cancel_too_late")
+	}
+
+	if err != nil {
+		logger.Printf("[ERROR] Couldn't cancel photo %s: %s", photoId, err)
+		return err.Error()
+	}
+
+	logger.Printf("[INFO] Photo %s cancelled", photoId)
+	metrics.Photos.WithLabelValues("rejected", "cancelled").Inc()
+
+	if photo.IsGallery() {
+		server.settleItems(photo)
+	}
+
+	server.updatePreview(photo, server.t(chatId, "cancelled"))
+
+	return server.t(chatId, "cancelled")
+}
+
+// promptEdit asks for a new caption, new hashtags or the time to publish at,
+// the answer is a reply to the prompt, see handleReply. Scheduled photos may
+// only get a new time.
+func (server Server) promptEdit(logger *log.Logger, chatId int64, photoId, field string) string {
+	photo, err := server.getPhoto(logger, photoId)
+
+	if photo == nil {
+		return server.t(chatId, "photo_expired")
+	}
+
+	if err != nil {
+		return err.Error()
+	}
+
+	rescheduling := field == actionSchedule && photo.State == metadata.StateScheduled
+
+	if photo.State != metadata.StateAwaitingApproval && !rescheduling {
+		return server.t(chatId, "photo_handled")
+	}
+
+	msg := tgbotapi.NewMessage(chatId, server.t(chatId, "edit_"+field+"_prompt", struct {
+		Timezone string
+	}{Timezone: server.chatLocation(chatId).String()}))
+	msg.ReplyToMessageID = photo.PreviewMessageId
+	msg.ReplyMarkup = tgbotapi.ForceReply{ForceReply: true, Selective: true}
+
+	sent, err := server.bot.Send(msg)
+
+	if err != nil {
+		logger.Printf("[ERROR] Couldn't ask for new %s of %s: %s", field, photoId, err)
+		return err.Error()
+	}
+
+	err = server.remember(chatId, sent.MessageID, replyTarget{PhotoId: photoId, Field: field})
+
+	if err != nil {
+		logger.Printf("[ERROR] Couldn't remember prompt for %s: %s", photoId, err)
+		return err.Error()
+	}
+
+	return ""
+}
+
+// handleReply edits the photo a reply is about. Replies to a prompt change
+// what was asked for, replies to the preview change the caption, or the
+// hashtags when there's nothing else in them. /caption, /tags and /schedule
+// work as replies too. false means the message doesn't reply to anything the bot
+// knows about.
+func (server *Server) handleReply(update tgbotapi.Update) bool {
+	chatId := update.Message.Chat.ID
+	logger := logging.New(logging.Fields{ChatId: chatId})
+
+	target, err := server.recall(chatId, update.Message.ReplyToMessage.MessageID)
+
+	if err != nil {
+		logger.Printf("[ERROR] Couldn't find out what message %d is about: %s",
+			update.Message.ReplyToMessage.MessageID, err)
+		return false
+	}
+
+	if target == nil {
+		return false
+	}
+
+	field, text := target.Field, update.Message.Text
+
+	if update.Message.IsCommand() {
+		field, text = editCommands[update.Message.Command()], update.Message.CommandArguments()
+
+		if field == "" || strings.TrimSpace(text) == "" {
+			return false
+		}
+	} else if field == "" {
+		field = guessField(text)
+	}
+
+	logger = logging.New(logging.Fields{ChatId: chatId, PhotoId: target.PhotoId})
+
+	if !server.mayHandle(logger, chatId, update.Message.From, target.PhotoId) {
+		server.bot.Send(tgbotapi.NewMessage(chatId, server.t(chatId, "photo_not_yours")))
+		return true
+	}
+
+	if field == actionSchedule {
+		server.applySchedule(logger, chatId, target.PhotoId, text)
+	} else {
+		server.applyEdit(logger, chatId, target.PhotoId, field, text)
+	}
+
+	return true
+}
+
+// editCommand handles /caption and /tags sent on their own, they edit the
+// photo of the latest preview
+func (server *Server) editCommand(update tgbotapi.Update) {
+	chatId := update.Message.Chat.ID
+	logger := logging.New(logging.Fields{ChatId: chatId})
+	command := update.Message.Command()
+	text := update.Message.CommandArguments()
+
+	if strings.TrimSpace(text) == "" {
+		server.bot.Send(tgbotapi.NewMessage(chatId, server.t(chatId, "edit_usage", struct {
+			Command string
+		}{Command: command})))
+		return
+	}
+
+	photoId, err := server.redis.Get(previewKey(chatId)).Result()
+
+	if err == redis.Nil {
+		server.bot.Send(tgbotapi.NewMessage(chatId, server.t(chatId, "nothing_to_edit")))
+		return
+	}
+
+	if err != nil {
+		logger.Printf("[ERROR] Couldn't find the latest preview of chat %d: %s", chatId, err)
+		server.bot.Send(tgbotapi.NewMessage(chatId, server.t(chatId, "edit_err", struct {
+			Error error
+		}{Error: err})))
+		return
+	}
+
+	logger = logging.New(logging.Fields{ChatId: chatId, PhotoId: photoId})
+
+	if !server.mayHandle(logger, chatId, update.Message.From, photoId) {
+		server.bot.Send(tgbotapi.NewMessage(chatId, server.t(chatId, "photo_not_yours")))
+		return
+	}
+
+	server.applyEdit(logger, chatId, photoId, editCommands[command], text)
+}
+
+// applyEdit edits a photo and tells the user how it went
+func (server Server) applyEdit(logger *log.Logger, chatId int64, photoId, field, text string) {
+	err := server.edit(logger, chatId, photoId, field, text)
+
+	switch {
+	case err == errNotAwaitingApproval:
+		server.bot.Send(tgbotapi.NewMessage(chatId, server.t(chatId, "photo_handled")))
+	case err != nil:
+		server.bot.Send(tgbotapi.NewMessage(chatId, server.t(chatId, "edit_err", struct {
+			Error error
+		}{Error: err})))
+	default:
+		server.bot.Send(tgbotapi.NewMessage(chatId, server.t(chatId, "edit_ok")))
+	}
+}
+
+// edit replaces the caption or the hashtags of a photo waiting for approval,
+// adds the change to its history and renders the preview again
+func (server Server) edit(logger *log.Logger, chatId int64, photoId, field, text string) error {
+	record := editRecord{Field: field, ChatId: chatId}
+
+	photo, err := server.store.Update(photoId, func(photo *metadata.PhotoMetadata) error {
+		if photo.State != metadata.StateAwaitingApproval {
+			return errNotAwaitingApproval
+		}
+
+		switch field {
+		case actionCaption:
+			record.Old = photo.Caption
+			photo.Caption = strings.TrimSpace(text)
+			record.New = photo.Caption
+		case actionHashtags:
+			record.Old = photo.Hashtag
+			photo.Hashtag = normalizeHashtags(text)
+			record.New = photo.Hashtag
+		}
+
+		photo.FinalCaption = server.mergeCaptions(photo.Caption, photo.Hashtag)
+
+		return nil
+	})
+
+	if err == errNotAwaitingApproval {
+		logger.Printf("[DEBUG] Photo %s isn't waiting for approval, not editing %s", photoId, field)
+		return err
+	}
+
+	if err != nil {
+		logger.Printf("[ERROR] Couldn't edit %s of %s: %s", field, photoId, err)
+		return err
+	}
+
+	logger.Printf("[INFO] Edited %s of %s", field, photoId)
+
+	record.At = time.Now().Unix()
+	err = server.recordEdit(photoId, record)
+
+	if err != nil {
+		logger.Printf("[WARN] Couldn't add edit of %s to its history: %s", photoId, err)
+	}
+
+	server.updatePreview(photo, "")
+
+	return nil
+}
+
+func (server Server) recordEdit(photoId string, record editRecord) error {
+	data, err := json.Marshal(record)
+
+	if err != nil {
+		return err
+	}
+
+	key := editsKey(photoId)
+
+	_, err = server.redis.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.RPush(key, data)
+		pipe.LTrim(key, -maxEdits, -1)
+		pipe.Expire(key, editsTTL)
+
+		return nil
+	})
+
+	return err
+}
+
+// guessField tells which field a reply to the preview edits, text made of
+// hashtags only is meant to replace them
+func guessField(text string) string {
+	words := strings.Fields(text)
+
+	for _, word := range words {
+		if !strings.HasPrefix(word, "#") {
+			return actionCaption
+		}
+	}
+
+	if len(words) == 0 {
+		return actionCaption
+	}
+
+	return actionHashtags
+}
+
+// normalizeHashtags turns "cat, #dog fluffy" into "#cat #dog #fluffy"
+func normalizeHashtags(text string) string {
+	words := strings.FieldsFunc(text, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\n' || r == '\t'
+	})
+
+	tags := make([]string, 0, len(words))
+
+	for _, word := range words {
+		word = strings.TrimLeft(word, "#")
+
+		if word != "" {
+			tags = append(tags, "#"+word)
+		}
+	}
+
+	return strings.Join(tags, " ")
+}
@@ -0,0 +1,43 @@
+package main
+
+import "testing"
+
+func TestGuessField(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"#cat #dog", actionHashtags},
+		{"  #cat\n#dog ", actionHashtags},
+		{"#cat and a dog", actionCaption},
+		{"a cat", actionCaption},
+		{"", actionCaption},
+	}
+
+	for _, test := range tests {
+		if got := guessField(test.text); got != test.want {
+			t.Errorf("%q: got %s, want %s", test.text, got, test.want)
+		}
+	}
+}
+
+func TestNormalizeHashtags(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"cat, #dog fluffy", "#cat #dog #fluffy"},
+		{"#cat #dog", "#cat #dog"},
+		{"##cat,,dog", "#cat #dog"},
+		{"cat\ndog\tfluffy", "#cat #dog #fluffy"},
+		{"  # , #", ""},
+		{"", ""},
+		{"котик, #пёс", "#котик #пёс"},
+	}
+
+	for _, test := range tests {
+		if got := normalizeHashtags(test.text); got != test.want {
+			t.Errorf("%q: got %q, want %q", test.text, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"strings"
+
+	"github.com/nuxdie/instabot/chatconfig"
+	"github.com/nuxdie/instabot/derivative"
+	"github.com/nuxdie/instabot/logging"
+	"github.com/nuxdie/instabot/metadata"
+	"gopkg.in/telegram-bot-api.v4"
+)
+
+// callback data of the framing buttons, followed by the framing
+const actionFrame = "frame:"
+
+var errNoSuchFraming = errors.New("there's no such framing of this photo")
+
+// Photos Instagram wouldn't take as they are come with framed versions from
+// the frame stage. The preview shows all of them, the one the chat prefers
+// is picked until the user clicks another.
+
+// chatFraming is the framing a chat prefers, smart crop unless it chose
+// another with /frame
+func (server Server) chatFraming(chatId int64) string {
+	framing := server.chatConfig(chatId).Framing
+
+	if framing == "" {
+		return metadata.FramingCrop
+	}
+
+	return framing
+}
+
+func (server Server) setChatFraming(chatId int64, framing string) {
+	logger := logging.New(logging.Fields{ChatId: chatId})
+
+	logger.Printf("[DEBUG] Set framing %v for chatId %v", framing, chatId)
+	server.updateChatConfig(chatId, func(chatConf *chatconfig.ChatConfig) {
+		chatConf.Framing = framing
+	})
+}
+
+// frameCommand shows or sets the framing of the chat
+func (server *Server) frameCommand(update tgbotapi.Update) {
+	chatId := update.Message.Chat.ID
+	framing := strings.ToLower(strings.TrimSpace(update.Message.CommandArguments()))
+
+	if framing == "" || !isFraming(framing) {
+		server.bot.Send(tgbotapi.NewMessage(chatId, server.t(chatId, "frame_usage", struct {
+			Framing string
+		}{Framing: server.t(chatId, "framing_"+server.chatFraming(chatId))})))
+		return
+	}
+
+	server.setChatFraming(chatId, framing)
+	server.bot.Send(tgbotapi.NewMessage(chatId, server.t(chatId, "frame_set", struct {
+		Framing string
+	}{Framing: server.t(chatId, "framing_"+framing)})))
+}
+
+func isFraming(framing string) bool {
+	for _, known := range metadata.Framings {
+		if framing == known {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sendFramings shows every framed version of a photo, captioned like the
+// buttons that pick them
+func (server Server) sendFramings(photoMetadata metadata.PhotoMetadata) {
+	logger := logging.ForPhoto(photoMetadata)
+	chatId := photoMetadata.ChatId
+
+	for _, framing := range photoMetadata.Framings() {
+		data, err := derivative.Get(server.redis, photoMetadata.FramedUrl(framing))
+
+		if err != nil {
+			logger.Printf("[WARN] Couldn't get %s framing of %s: %s", framing, photoMetadata.PhotoId, err)
+			continue
+		}
+
+		msg := tgbotapi.NewPhotoUpload(chatId, tgbotapi.FileBytes{Name: framing + ".jpg", Bytes: data})
+		msg.Caption = server.t(chatId, "framing_"+framing)
+		msg.ReplyToMessageID = photoMetadata.MessageId
+
+		_, err = server.bot.Send(msg)
+
+		if err != nil {
+			logger.Printf("[WARN] Couldn't send %s framing of %s: %s", framing, photoMetadata.PhotoId, err)
+		}
+	}
+}
+
+// framingRow has a button for every framing of a photo, the picked one ticked
+func (server Server) framingRow(photoMetadata metadata.PhotoMetadata) []tgbotapi.InlineKeyboardButton {
+	chatId := photoMetadata.ChatId
+	row := make([]tgbotapi.InlineKeyboardButton, 0, len(metadata.Framings))
+
+	for _, framing := range photoMetadata.Framings() {
+		label := server.t(chatId, "framing_"+framing)
+
+		if framing == photoMetadata.Framing {
+			label = "✅ " + label
+		}
+
+		row = append(row, tgbotapi.NewInlineKeyboardButtonData(label, actionFrame+framing))
+	}
+
+	return row
+}
+
+// chooseFraming picks the framed version of a photo waiting for approval
+// that gets posted
+func (server Server) chooseFraming(logger *log.Logger, chatId int64, photoId, framing string) string {
+	photo, err := server.store.Update(photoId, func(photo *metadata.PhotoMetadata) error {
+		if photo.State != metadata.StateAwaitingApproval {
+			return errNotAwaitingApproval
+		}
+
+		if photo.FramedUrl(framing) == "" {
+			return errNoSuchFraming
+		}
+
+		photo.Framing = framing
+
+		return nil
+	})
+
+	if err == errNotAwaitingApproval {
+		logger.Printf("[DEBUG] Photo %s isn't waiting for approval, not framing it", photoId)
+		return server.t(chatId, "photo_handled")
+	}
+
+	if err != nil {
+		logger.Printf("[ERROR] Couldn't set framing %s of %s: %s", framing, photoId, err)
+		return err.Error()
+	}
+
+	logger.Printf("[INFO] Framing %s chosen for %s", framing, photoId)
+	server.updatePreview(photo, "")
+
+	return server.t(chatId, "framing_chosen", struct {
+		Framing string
+	}{Framing: server.t(chatId, "framing_"+framing)})
+}
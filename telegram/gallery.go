@@ -0,0 +1,377 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/nuxdie/instabot/logging"
+	"github.com/nuxdie/instabot/metadata"
+	"gopkg.in/telegram-bot-api.v4"
+)
+
+// Instagram ignores posts with more hashtags than that
+const maxHashtags = 30
+
+// the galleries still taking photos, scored by the unix time in milliseconds
+// their album window is over. A timer closes them in time, the set is there
+// for galleries whose timer was lost with a restart.
+const albumsKey = "telegram:albums"
+
+var errAlbumClosed = errors.New("album isn't taking photos any more")
+
+// Telegram sends the photos of an album as separate messages sharing a media
+// group ID. They're collected into a gallery record for albumWindow after
+// the first one arrived. Every photo still goes through enrichment on its
+// own and waits in READY, the gallery asks for approval once all of them
+// are there and is published as one carousel.
+
+// collect adds the photo to the gallery of its album, starting the gallery
+// with the first photo. An empty gallery ID means the photo goes on its own
+// because the album was closed or full already.
+func (server Server) collect(logger *log.Logger, message *tgbotapi.Message, photoId,
+	correlationId string) (string, error) {
+
+	galleryId := metadata.GalleryId(message.Chat.ID, message.MediaGroupID)
+	full := false
+
+	_, err := server.store.Update(galleryId, func(gallery *metadata.PhotoMetadata) error {
+		if gallery.State != metadata.StateNew {
+			return errAlbumClosed
+		}
+
+		full = !gallery.AddItem(photoId)
+
+		return nil
+	})
+
+	if err == metadata.ErrNotFound {
+		err = server.enqueue(message.Chat.ID, galleryId)
+
+		if err != nil {
+			logger.Printf("[WARN] Couldn't add gallery %s to the queue of chat %d: %s",
+				galleryId, message.Chat.ID, err)
+		}
+
+		gallery := metadata.PhotoMetadata{
+			PhotoId:       galleryId,
+			ChatId:        message.Chat.ID,
+			MessageId:     message.MessageID,
+			CorrelationId: correlationId,
+			Items:         photoId,
+		}
+
+		if message.From != nil {
+			gallery.UserId = int64(message.From.ID)
+		}
+
+		// before the record, a gallery without a deadline would never close
+		err = server.redis.ZAddNX(albumsKey, redis.Z{
+			Score:  float64(time.Now().Add(server.config.albumWindow).UnixNano() / int64(time.Millisecond)),
+			Member: galleryId,
+		}).Err()
+
+		if err != nil {
+			logger.Printf("[WARN] Couldn't save the deadline of gallery %s: %s", galleryId, err)
+		}
+
+		// galleries come without NEW, there's nothing to enrich about them
+		err = server.store.Create(gallery)
+
+		if err == nil {
+			logger.Printf("[INFO] Started gallery %s", galleryId)
+			time.AfterFunc(server.config.albumWindow, func() {
+				server.closeGallery(galleryId)
+			})
+		}
+	}
+
+	if err == errAlbumClosed || full {
+		logger.Printf("[WARN] Gallery %s is closed or full, photo %s goes on its own",
+			galleryId, photoId)
+		return "", nil
+	}
+
+	if err != nil {
+		logger.Printf("[ERROR] Couldn't add photo %s to gallery %s: %s", photoId, galleryId, err)
+		return "", err
+	}
+
+	return galleryId, nil
+}
+
+// closeGallery checks the gallery once its window is over and forgets its
+// deadline when it's closed
+func (server Server) closeGallery(galleryId string) {
+	logger := logging.New(logging.Fields{PhotoId: galleryId})
+
+	if server.checkGallery(galleryId) != nil {
+		return
+	}
+
+	gallery, err := server.store.Get(galleryId)
+
+	if err == nil && gallery.State == metadata.StateNew {
+		logger.Printf("[VERBOSE] Gallery %s is still open", galleryId)
+		return
+	}
+
+	if err != nil && err != metadata.ErrNotFound {
+		logger.Printf("[ERROR] Couldn't get gallery %s: %s", galleryId, err)
+		return
+	}
+
+	err = server.redis.ZRem(albumsKey, galleryId).Err()
+
+	if err != nil {
+		logger.Printf("[WARN] Couldn't forget the deadline of gallery %s: %s", galleryId, err)
+	}
+}
+
+// closeOverdueGalleries closes the galleries whose window is over, it's
+// called on every DONE in case their timer was lost
+func (server Server) closeOverdueGalleries() {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	galleryIds, err := server.redis.ZRangeByScore(albumsKey, redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(now, 10),
+	}).Result()
+
+	if err != nil {
+		log.Printf("[ERROR] Couldn't get the galleries that are due: %s", err)
+		return
+	}
+
+	for _, galleryId := range galleryIds {
+		server.closeGallery(galleryId)
+	}
+}
+
+// resumeGalleries closes the galleries that were due while the bot was down
+// and sets the timers of the others again
+func (server Server) resumeGalleries() {
+	server.closeOverdueGalleries()
+
+	deadlines, err := server.redis.ZRangeWithScores(albumsKey, 0, -1).Result()
+
+	if err != nil {
+		log.Printf("[ERROR] Couldn't get the open galleries: %s", err)
+		return
+	}
+
+	for _, deadline := range deadlines {
+		galleryId, ok := deadline.Member.(string)
+
+		if !ok {
+			continue
+		}
+
+		at := time.Unix(0, int64(deadline.Score)*int64(time.Millisecond))
+
+		time.AfterFunc(time.Until(at), func() {
+			server.closeGallery(galleryId)
+		})
+	}
+}
+
+// dropItem takes a photo that couldn't be recorded out of its gallery again,
+// the gallery would wait for it forever otherwise
+func (server Server) dropItem(logger *log.Logger, galleryId, photoId string) {
+	_, err := server.store.Update(galleryId, func(gallery *metadata.PhotoMetadata) error {
+		gallery.RemoveItem(photoId)
+		return nil
+	})
+
+	if err != nil {
+		logger.Printf("[ERROR] Couldn't drop photo %s from gallery %s: %s", photoId, galleryId, err)
+	}
+}
+
+// itemEnriched parks an enriched album photo in READY, or rejects it, and
+// lets its gallery know
+func (server Server) itemEnriched(item metadata.PhotoMetadata) error {
+	logger := logging.ForPhoto(item)
+
+	if item.NSFWChecked && item.NSFW {
+		err := server.reject(item)
+
+		if err != nil {
+			return err
+		}
+	} else {
+		_, err := server.transition(item.PhotoId, metadata.StateEnriching, metadata.StateReady)
+
+		if metadata.IsTransitionError(err) {
+			logger.Printf("[DEBUG] %s", err)
+			return nil
+		}
+
+		if err != nil {
+			logger.Printf("[ERROR] Couldn't set item %s ready: %s", item.PhotoId, err)
+			return err
+		}
+	}
+
+	return server.checkGallery(item.GalleryId)
+}
+
+// checkGallery closes the album once its window is over and asks for
+// approval as soon as every item is enriched. One rejected item rejects the
+// whole gallery.
+func (server Server) checkGallery(galleryId string) error {
+	logger := logging.New(logging.Fields{PhotoId: galleryId})
+
+	gallery, err := server.getPhoto(logger, galleryId)
+
+	if gallery == nil {
+		return err
+	}
+
+	logger = logging.ForPhoto(*gallery)
+
+	switch gallery.State {
+	case metadata.StateNew:
+		if time.Since(gallery.EnteredAt(metadata.StateNew)) < server.config.albumWindow {
+			logger.Printf("[VERBOSE] Gallery %s may still get photos", galleryId)
+			return nil
+		}
+
+		updated, err := server.transition(galleryId, metadata.StateNew, metadata.StateEnriching)
+
+		if metadata.IsTransitionError(err) {
+			logger.Printf("[DEBUG] %s", err)
+			return nil
+		}
+
+		if err != nil {
+			logger.Printf("[ERROR] Couldn't close gallery %s: %s", galleryId, err)
+			return err
+		}
+
+		logger.Printf("[INFO] Closed gallery %s with %d photos", galleryId,
+			len(updated.ItemIds()))
+
+		gallery = &updated
+	case metadata.StateEnriching:
+	case metadata.StateRejected:
+		// items enriched after the gallery was rejected follow it
+		server.settleItems(*gallery)
+		return nil
+	default:
+		logger.Printf("[VERBOSE] Nothing to do for gallery %s in state %s",
+			galleryId, gallery.State)
+		return nil
+	}
+
+	items := make([]metadata.PhotoMetadata, 0, len(gallery.ItemIds()))
+
+	for _, itemId := range gallery.ItemIds() {
+		item, err := server.store.Get(itemId)
+
+		if err == metadata.ErrNotFound {
+			logger.Printf("[VERBOSE] Item %s of gallery %s isn't recorded yet", itemId, galleryId)
+			return nil
+		}
+
+		if err != nil {
+			logger.Printf("[ERROR] Couldn't get item %s of gallery %s: %s", itemId, galleryId, err)
+			return err
+		}
+
+		switch item.State {
+		case metadata.StateReady:
+			items = append(items, item)
+		case metadata.StateRejected:
+			return server.rejectGallery(*gallery)
+		default:
+			logger.Printf("[VERBOSE] Item %s of gallery %s is %s", itemId, galleryId, item.State)
+			return nil
+		}
+	}
+
+	gallery.Caption, gallery.Hashtag = sharedCaption(items)
+
+	return server.awaitApproval(*gallery)
+}
+
+func (server Server) rejectGallery(gallery metadata.PhotoMetadata) error {
+	logger := logging.ForPhoto(gallery)
+
+	updated, err := server.transition(gallery.PhotoId,
+		metadata.StateEnriching, metadata.StateRejected)
+
+	if metadata.IsTransitionError(err) {
+		logger.Printf("[DEBUG] %s", err)
+		return nil
+	}
+
+	if err != nil {
+		logger.Printf("[ERROR] Couldn't reject gallery %s: %s", gallery.PhotoId, err)
+		return err
+	}
+
+	logger.Printf("[INFO] Rejected gallery %s, one of its photos was rejected", gallery.PhotoId)
+	server.settleItems(updated)
+
+	return nil
+}
+
+// settleItems moves the items of a published or rejected gallery along with
+// it, so they don't stay in progress forever
+func (server Server) settleItems(gallery metadata.PhotoMetadata) {
+	logger := logging.ForPhoto(gallery)
+
+	for _, itemId := range gallery.ItemIds() {
+		_, err := server.store.Update(itemId, func(item *metadata.PhotoMetadata) error {
+			if item.State.Final() {
+				return nil
+			}
+
+			if gallery.State != metadata.StatePublished {
+				return item.Transition(item.State, metadata.StateRejected)
+			}
+
+			item.PublishedUrl = gallery.PublishedUrl
+			err := item.Transition(metadata.StateReady, metadata.StatePublishing)
+
+			if err != nil {
+				return err
+			}
+
+			return item.Transition(metadata.StatePublishing, metadata.StatePublished)
+		})
+
+		if err != nil {
+			logger.Printf("[WARN] Couldn't settle item %s of gallery %s: %s",
+				itemId, gallery.PhotoId, err)
+		}
+	}
+}
+
+// sharedCaption picks the caption of the first item that has one and the
+// hashtags of all of them
+func sharedCaption(items []metadata.PhotoMetadata) (string, string) {
+	caption := ""
+	seen := make(map[string]bool)
+	hashtags := make([]string, 0, maxHashtags)
+
+	for _, item := range items {
+		if caption == "" {
+			caption = item.Caption
+		}
+
+		for _, hashtag := range strings.Fields(item.Hashtag) {
+			if seen[hashtag] || len(hashtags) == maxHashtags {
+				continue
+			}
+
+			seen[hashtag] = true
+			hashtags = append(hashtags, hashtag)
+		}
+	}
+
+	return caption, strings.Join(hashtags, " ")
+}
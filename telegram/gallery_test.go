@@ -0,0 +1,78 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/nuxdie/instabot/metadata"
+)
+
+// galleries whose window ran out while the bot was down are closed when it
+// starts, the others stay open
+func TestResumeGalleries(t *testing.T) {
+	addr := os.Getenv("TEST_REDIS_ADDR")
+
+	if addr == "" {
+		t.Skip("TEST_REDIS_ADDR isn't set")
+	}
+
+	server := Server{
+		redis:  redis.NewClient(&redis.Options{Addr: addr}),
+		store:  metadata.NewMemoryStore(),
+		config: &serverConfig{albumWindow: 3 * time.Second},
+	}
+
+	tests := []struct {
+		galleryId string
+		age       time.Duration // since the first photo arrived
+		state     metadata.State
+		open      bool // still has a deadline
+	}{
+		{"test:gallery:due", time.Hour, metadata.StateEnriching, false},
+		{"test:gallery:open", 0, metadata.StateNew, true},
+	}
+
+	for _, test := range tests {
+		server.redis.ZRem(albumsKey, test.galleryId)
+		defer server.redis.ZRem(albumsKey, test.galleryId)
+
+		// its photo isn't recorded yet, closing the gallery is all there is
+		err := server.store.Create(metadata.PhotoMetadata{PhotoId: test.galleryId, Items: "test:item"})
+
+		if err == nil {
+			_, err = server.store.Update(test.galleryId, func(gallery *metadata.PhotoMetadata) error {
+				gallery.NewAt -= int64(test.age / time.Second)
+				return nil
+			})
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		deadline := time.Now().Add(server.config.albumWindow - test.age)
+		server.redis.ZAdd(albumsKey, redis.Z{
+			Score:  float64(deadline.UnixNano() / int64(time.Millisecond)),
+			Member: test.galleryId,
+		})
+	}
+
+	server.resumeGalleries()
+
+	for _, test := range tests {
+		gallery, err := server.store.Get(test.galleryId)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		open := server.redis.ZScore(albumsKey, test.galleryId).Err() != redis.Nil
+
+		if gallery.State != test.state || open != test.open {
+			t.Errorf("%s: got %s, open %v, want %s, open %v", test.galleryId, gallery.State, open,
+				test.state, test.open)
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nuxdie/instabot/logging"
+	"github.com/nuxdie/instabot/metadata"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"gopkg.in/telegram-bot-api.v4"
+)
+
+// Photo records in redis are the working state of the pipeline, they can't
+// be listed by chat and go with the redis data, so published photos are
+// written to mongo as well. /history pages through them, newest first. Bots
+// running without mongo keep no history.
+
+const mongoHistoryCollectionName = "history"
+const historyPerPage = 5
+const historyCaptionLength = 100 // runes of the caption shown in /history
+
+// callback data of the history buttons, followed by <chat_id>:<page>
+const actionHistory = "history:"
+
+type Post struct {
+	PhotoId       string    `bson:"_id"`
+	ChatId        int64     `bson:"chat_id"`
+	MediaType     string    `bson:"media_type"`
+	InstagramId   string    `bson:"instagram_id"`
+	InstagramCode string    `bson:"instagram_code"`
+	Url           string    `bson:"url"`
+	Caption       string    `bson:"caption"`
+	Hashtags      string    `bson:"hashtags"`
+	ReceivedAt    time.Time `bson:"received_at"`
+	PublishedAt   time.Time `bson:"published_at"`
+}
+
+func (server Server) history() (*mgo.Session, *mgo.Collection) {
+	// a copy gets a fresh socket, the shared session keeps a broken one
+	session := server.mongo.Copy()
+
+	return session, session.DB(server.config.mongo.dbName).C(mongoHistoryCollectionName)
+}
+
+// historySetup creates the index /history pages with
+func (server Server) historySetup() {
+	session, collection := server.history()
+	defer session.Close()
+
+	err := collection.EnsureIndex(mgo.Index{
+		Key:        []string{"chat_id", "-published_at"},
+		Background: true,
+	})
+
+	if err != nil {
+		log.Printf("[ERROR] Couldn't create the index of %s: %s", mongoHistoryCollectionName, err)
+	}
+}
+
+// recordPost writes a published photo to the history. Posts are keyed by the
+// photo ID, recording one again just overwrites it.
+func (server Server) recordPost(photoMetadata metadata.PhotoMetadata) error {
+	if server.mongo == nil {
+		return nil
+	}
+
+	post := Post{
+		PhotoId:       photoMetadata.PhotoId,
+		ChatId:        photoMetadata.ChatId,
+		MediaType:     photoMetadata.MediaType,
+		InstagramId:   photoMetadata.InstagramId,
+		InstagramCode: photoMetadata.InstagramCode,
+		Url:           photoMetadata.PublishedUrl,
+		Caption:       photoMetadata.FinalCaption,
+		Hashtags:      photoMetadata.Hashtag,
+		ReceivedAt:    photoMetadata.EnteredAt(metadata.StateNew),
+		PublishedAt:   photoMetadata.EnteredAt(metadata.StatePublished),
+	}
+
+	if post.PublishedAt.IsZero() {
+		post.PublishedAt = time.Now()
+	}
+
+	session, collection := server.history()
+	defer session.Close()
+
+	_, err := collection.UpsertId(post.PhotoId, post)
+
+	return err
+}
+
+// historyCommand sends the latest posts of the chat. Operators may give the
+// ID of another chat to look at its posts.
+func (server *Server) historyCommand(update tgbotapi.Update) {
+	chatId := update.Message.Chat.ID
+	postsOf := chatId
+	arg := strings.TrimSpace(update.Message.CommandArguments())
+
+	if arg != "" && server.config.admins[chatId] {
+		id, err := strconv.ParseInt(arg, 10, 64)
+
+		if err != nil {
+			server.bot.Send(tgbotapi.NewMessage(chatId, server.t(chatId, "history_usage")))
+			return
+		}
+
+		postsOf = id
+	}
+
+	text, keyboard, err := server.historyPage(chatId, postsOf, 0)
+
+	if err != nil {
+		server.bot.Send(tgbotapi.NewMessage(chatId, server.t(chatId, "publish_err", struct {
+			Error error
+		}{Error: err})))
+		return
+	}
+
+	msg := tgbotapi.NewMessage(chatId, text)
+	msg.DisableWebPagePreview = true
+
+	if keyboard != nil {
+		msg.ReplyMarkup = *keyboard
+	}
+
+	server.bot.Send(msg)
+}
+
+// turnHistoryPage shows another page in place of the one whose button was
+// clicked
+func (server Server) turnHistoryPage(query *tgbotapi.CallbackQuery) {
+	chatId := query.Message.Chat.ID
+	logger := logging.New(logging.Fields{ChatId: chatId})
+	args := strings.Split(strings.TrimPrefix(query.Data, actionHistory), ":")
+	var postsOf int64
+	var page int
+	var err error
+
+	if len(args) == 2 {
+		postsOf, err = strconv.ParseInt(args[0], 10, 64)
+	}
+
+	if err == nil && len(args) == 2 {
+		page, err = strconv.Atoi(args[1])
+	}
+
+	if len(args) != 2 || err != nil || page < 0 ||
+		(postsOf != chatId && !server.config.admins[chatId]) {
+
+		logger.Printf("[WARN] Unknown history button %s", query.Data)
+		server.bot.AnswerCallbackQuery(tgbotapi.NewCallback(query.ID, ""))
+		return
+	}
+
+	text, keyboard, err := server.historyPage(chatId, postsOf, page)
+
+	if err != nil {
+		server.bot.AnswerCallbackQuery(tgbotapi.NewCallback(query.ID, err.Error()))
+		return
+	}
+
+	edit := tgbotapi.NewEditMessageText(chatId, query.Message.MessageID, text)
+	edit.DisableWebPagePreview = true
+	edit.ReplyMarkup = keyboard
+
+	_, err = server.bot.Send(edit)
+
+	if err != nil {
+		logger.Printf("[ERROR] Couldn't show page %d of the history of chat %d: %s", page, postsOf, err)
+	}
+
+	server.bot.AnswerCallbackQuery(tgbotapi.NewCallback(query.ID, ""))
+}
+
+// historyPage renders a page of the posts of postsOf for chatId, with buttons
+// to the pages next to it
+func (server Server) historyPage(chatId, postsOf int64, page int) (string,
+	*tgbotapi.InlineKeyboardMarkup, error) {
+
+	if server.mongo == nil {
+		return server.t(chatId, "history_unavailable"), nil, nil
+	}
+
+	logger := logging.New(logging.Fields{ChatId: chatId})
+	session, collection := server.history()
+	defer session.Close()
+
+	// one more than a page tells whether there's an older one
+	var posts []Post
+	err := collection.Find(bson.M{"chat_id": postsOf}).Sort("-published_at").
+		Skip(page * historyPerPage).Limit(historyPerPage + 1).All(&posts)
+
+	if err != nil {
+		logger.Printf("[ERROR] Couldn't get the history of chat %d: %s", postsOf, err)
+		return "", nil, err
+	}
+
+	if len(posts) == 0 && page == 0 {
+		return server.t(chatId, "history_empty"), nil, nil
+	}
+
+	older := len(posts) > historyPerPage
+
+	if older {
+		posts = posts[:historyPerPage]
+	}
+
+	lines := []string{server.t(chatId, "history_page", struct {
+		Page int
+	}{Page: page + 1})}
+
+	for _, post := range posts {
+		lines = append(lines, server.t(chatId, "history_post", struct {
+			Time    string
+			Url     string
+			Caption string
+		}{
+			Time:    post.PublishedAt.In(server.chatLocation(chatId)).Format(dateTimeLayout),
+			Url:     post.Url,
+			Caption: shorten(strings.TrimSpace(post.Caption), historyCaptionLength),
+		}))
+	}
+
+	var row []tgbotapi.InlineKeyboardButton
+
+	if page > 0 {
+		row = append(row, tgbotapi.NewInlineKeyboardButtonData(server.t(chatId, "button_newer"),
+			historyData(postsOf, page-1)))
+	}
+
+	if older {
+		row = append(row, tgbotapi.NewInlineKeyboardButtonData(server.t(chatId, "button_older"),
+			historyData(postsOf, page+1)))
+	}
+
+	if len(row) == 0 {
+		return strings.Join(lines, "\n\n"), nil, nil
+	}
+
+	keyboard := tgbotapi.NewInlineKeyboardMarkup(row)
+
+	return strings.Join(lines, "\n\n"), &keyboard, nil
+}
+
+func historyData(postsOf int64, page int) string {
+	return actionHistory + strconv.FormatInt(postsOf, 10) + ":" + strconv.Itoa(page)
+}
+
+// shorten cuts text down to length runes
+func shorten(text string, length int) string {
+	runes := []rune(text)
+
+	if len(runes) <= length {
+		return text
+	}
+
+	return string(runes[:length]) + "…"
+}
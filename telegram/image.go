@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+
+	"github.com/nuxdie/instabot/derivative"
+	"github.com/nuxdie/instabot/logging"
+	"github.com/nuxdie/instabot/media"
+	"github.com/nuxdie/instabot/metadata"
+	"github.com/nuxdie/instabot/metrics"
+	"gopkg.in/telegram-bot-api.v4"
+)
+
+// handleImageDocument takes images sent as files. They're converted to a
+// JPEG Instagram takes as it is, stored as a derivative and the photo record
+// points at that, so every stage sees the converted photo.
+func (server *Server) handleImageDocument(update tgbotapi.Update) {
+	document := update.Message.Document
+	chatId := update.Message.Chat.ID
+	correlationId := logging.NewCorrelationId()
+	logger := logging.New(logging.Fields{
+		PhotoId:       document.FileID,
+		ChatId:        chatId,
+		CorrelationId: correlationId,
+	})
+
+	data, err := download(server.getFileLink(document.FileID))
+
+	if err != nil {
+		server.rejectImage(logger, chatId, err)
+		return
+	}
+
+	jpeg, err := media.NormalizeImage(data)
+
+	if err == media.ErrColorProfile {
+		logger.Printf("[WARN] Can't convert the colours of %s image %s", document.MimeType, document.FileID)
+		metrics.Photos.WithLabelValues("rejected", "color_profile").Inc()
+		server.bot.Send(tgbotapi.NewMessage(chatId, server.t(chatId, "image_color_profile")))
+		return
+	}
+
+	if err != nil {
+		logger.Printf("[WARN] Couldn't convert %s image %s: %s", document.MimeType, document.FileID, err)
+		metrics.Photos.WithLabelValues("rejected", "unreadable").Inc()
+		server.bot.Send(tgbotapi.NewMessage(chatId, server.t(chatId, "image_unreadable")))
+		return
+	}
+
+	photoUrl, err := derivative.Put(server.redis, document.FileID, jpeg)
+
+	if err != nil {
+		server.rejectImage(logger, chatId, err)
+		return
+	}
+
+	logger.Printf("[INFO] Converted %s image %s to %d bytes of JPEG", document.MimeType,
+		document.FileID, len(jpeg))
+
+	err = server.pushPhoto(logger, update.Message, metadata.PhotoMetadata{
+		PhotoId:       document.FileID,
+		PhotoUrl:      photoUrl,
+		CorrelationId: correlationId,
+	})
+
+	if err != nil && err != errOverQuota {
+		server.rejectImage(logger, chatId, err)
+	}
+}
+
+func (server Server) rejectImage(logger *log.Logger, chatId int64, err error) {
+	logger.Printf("[ERROR] Couldn't publish photo: %s", err)
+	server.bot.Send(tgbotapi.NewMessage(chatId, server.t(chatId, "publish_err", struct {
+		Error error
+	}{Error: err})))
+}
+
+// download gets a whole file from telegram
+func download(fileUrl string) ([]byte, error) {
+	resp, err := metrics.Client("telegram", "telegram_file").Get(fileUrl)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("couldn't download file: %s", resp.Status)
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
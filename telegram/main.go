@@ -1,29 +1,55 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"log"
+	"net/http"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-redis/redis"
-	"github.com/mitchellh/mapstructure"
 	"github.com/nicksnyder/go-i18n/i18n"
+	"github.com/nuxdie/instabot/account"
+	"github.com/nuxdie/instabot/bus"
+	"github.com/nuxdie/instabot/chatconfig"
+	"github.com/nuxdie/instabot/health"
+	"github.com/nuxdie/instabot/lanes"
+	"github.com/nuxdie/instabot/logging"
+	"github.com/nuxdie/instabot/media"
+	"github.com/nuxdie/instabot/metadata"
+	"github.com/nuxdie/instabot/metrics"
+	"github.com/nuxdie/instabot/quota"
+	"github.com/nuxdie/instabot/retry"
+	"github.com/nuxdie/instabot/schedule"
+	"github.com/nuxdie/instabot/shutdown"
+	"github.com/nuxdie/instabot/vault"
 	"github.com/spf13/viper"
-	"gopkg.in/telegram-bot-api.v4"
-	"github.com/hashicorp/logutils"
-	"strconv"
 	"gopkg.in/mgo.v2"
-	"gopkg.in/mgo.v2/bson"
-	"github.com/nuxdie/instabot/metadata"
+	"gopkg.in/telegram-bot-api.v4"
 )
 
 type Server struct {
 	bot *tgbotapi.BotAPI
 	redis *redis.Client
+	bus *bus.Bus
+	store metadata.Store
+	deadLetters *retry.DeadLetters
+	scheduler *schedule.Scheduler
+	accounts *account.Store // instagram accounts chats connected
+	quotas *quota.Counter // photos chats sent, see quota.go
 	config *serverConfig
-	mongo *mgo.Session
+	mongo *mgo.Session // nil without TELEGRAM_MONGO_URL
+	chats *chatconfig.Repository
+	health *health.Checks
+	handlers *sync.WaitGroup // queued and running update handlers
+	updates *lanes.Pool // runs update handlers, one chat at a time
+	subscription chan struct{} // closed once the bus subscription returns
+	served       chan struct{} // closed once the HTTP server has stopped
 }
 
 type serverConfig struct {
@@ -32,29 +58,51 @@ type serverConfig struct {
 	timeout int
 	demoInstaURL string
 	landingUrl string
+	httpAddr string // serves /metrics, /healthz and /readyz
+	shutdownTimeout time.Duration // how long running handlers get to finish
+	poolSize int // updates and messages handled at once, each
+	albumWindow time.Duration // how long photos of an album are waited for
+	coverOffset time.Duration // where in videos the cover frame is taken
+	timezone *time.Location // of chats that didn't choose one
+	updateMode string // polling or webhook, see webhook.go
+	webhook struct{
+		url *url.URL // telegram posts updates to, its path is served
+		addr string
+		secret string
+		cert string // TLS is left to a reverse proxy without one
+		key string
+		selfSigned bool // the certificate is uploaded to telegram
+	}
 	mongo struct{
 		url string
 		dbName string
 	}
+	chatConfig struct{
+		store string // mongo, file or memory
+		file string
+	}
+	vault struct{
+		key string // base64, or in keyFile; instagram passwords aren't kept without
+		keyFile string
+		store string // redis or mongo
+	}
 	redis struct{
 		addr string
 		passwd string
-		channel string
+		stream string
+		group string
+		consumer string
+		claimIdle int // seconds
+		maxDeliveries int
 		db int
 	}
 	sleep int // duration between messages in ms
-	chatConfig map[int64]ChatConfig
+	admins map[int64]bool // chats allowed to manage dead letters
+	enrichmentStages []string // stages that must finish before publishing
+	plans map[string]quota.Plan // by name
 	translation map[string]i18n.TranslateFunc
 }
 
-type ChatConfig struct {
-	ID         bson.ObjectId `bson:"_id,omitempty"`
-	ChatId     int64         `bson:"chat_id"`
-	Locale     string        `bson:"locale"`
-	PhotoCount int           `bson:"photo_count"`
-	Registered bool          `bson:"registered"`
-}
-
 const envLogLevel = "LOG_LEVEL"
 const envTelegramBotToken = "TELEGRAM_BOT_TOKEN"
 const envTelegramBotSleep = "TELEGRAM_BOT_SLEEP"
@@ -64,12 +112,43 @@ const envTelegramDemoLandingUrl = "TELEGRAM_DEMO_LANDING_URL"
 const envTelegramBotTimeout = "TELEGRAM_BOT_TIMEOUT"
 const envTelegramMongoUrl = "TELEGRAM_MONGO_URL"
 const envTelegramMongoDbName = "TELEGRAM_MONGO_DB_NAME"
+const envTelegramChatConfigStore = "TELEGRAM_CHAT_CONFIG_STORE"
+const envTelegramChatConfigFile = "TELEGRAM_CHAT_CONFIG_FILE"
+const envTelegramVaultKey = "TELEGRAM_VAULT_KEY"
+const envTelegramVaultKeyFile = "TELEGRAM_VAULT_KEY_FILE"
+const envTelegramVaultStore = "TELEGRAM_VAULT_STORE"
 const envTelegramRedisAddr = "TELEGRAM_REDIS_ADDR"
 const envTelegramRedisPasswd = "TELEGRAM_REDIS_PASSWD"
-const envTelegramRedisChannel = "TELEGRAM_REDIS_CHANNEL"
+const envTelegramRedisStream = "TELEGRAM_REDIS_STREAM"
+const envTelegramRedisGroup = "TELEGRAM_REDIS_GROUP"
+const envTelegramRedisConsumer = "TELEGRAM_REDIS_CONSUMER"
+const envTelegramRedisClaimIdle = "TELEGRAM_REDIS_CLAIM_IDLE"
+const envTelegramRedisMaxDeliveries = "TELEGRAM_REDIS_MAX_DELIVERIES"
 const envTelegramRedisDb = "TELEGRAM_REDIS_DB"
+const envTelegramEnrichmentStages = "TELEGRAM_ENRICHMENT_STAGES"
+const envTelegramAdminChatIds = "TELEGRAM_ADMIN_CHAT_IDS"
+const envTelegramHttpAddr = "TELEGRAM_HTTP_ADDR"
+const envTelegramShutdownTimeout = "TELEGRAM_SHUTDOWN_TIMEOUT"
+const envTelegramPoolSize = "TELEGRAM_POOL_SIZE"
+const envTelegramAlbumWindow = "TELEGRAM_ALBUM_WINDOW"
+const envTelegramVideoCoverOffset = "TELEGRAM_VIDEO_COVER_OFFSET"
+const envTelegramDefaultTimezone = "TELEGRAM_DEFAULT_TIMEZONE"
+const envTelegramUpdateMode = "TELEGRAM_UPDATE_MODE"
+const envTelegramWebhookUrl = "TELEGRAM_WEBHOOK_URL"
+const envTelegramWebhookAddr = "TELEGRAM_WEBHOOK_ADDR"
+const envTelegramWebhookSecret = "TELEGRAM_WEBHOOK_SECRET"
+const envTelegramWebhookCert = "TELEGRAM_WEBHOOK_CERT"
+const envTelegramWebhookKey = "TELEGRAM_WEBHOOK_KEY"
+const envTelegramWebhookSelfSigned = "TELEGRAM_WEBHOOK_SELF_SIGNED"
+const envTelegramQuotaDemo = "TELEGRAM_QUOTA_DEMO"
+const envTelegramQuotaBasic = "TELEGRAM_QUOTA_BASIC"
+const envTelegramQuotaPro = "TELEGRAM_QUOTA_PRO"
 
 const mongoSettingsCollectionName = "settings"
+const mongoVaultCollectionName = "vault"
+const vaultRedisKey = "vault"
+const deadLettersPerList = 20
+const updatesPerLane = 10 // queued before polling waits for handlers
 
 func main() {
 	server := NewServer()
@@ -100,12 +179,89 @@ func NewServer() *Server {
 		DB: server.config.redis.db,
 	})
 
+	server.bus = bus.New(server.redis, bus.Config{
+		Stream: server.config.redis.stream,
+		Group: server.config.redis.group,
+		Consumer: server.config.redis.consumer,
+		ClaimIdle: time.Second * time.Duration(server.config.redis.claimIdle),
+		MaxDeliveries: int64(server.config.redis.maxDeliveries),
+		Handlers: server.config.poolSize,
+	})
+
+	server.store = metadata.NewRedisStore(server.redis, server.bus.Outbox)
+	server.deadLetters = retry.NewDeadLetters(server.redis, server.store)
+	server.scheduler = schedule.New(server.redis, server.store)
+	server.quotas = quota.NewCounter(server.redis)
+
+	if server.config.mongo.url != "" {
+		server.mongoConnect()
+		server.historySetup()
+	}
+
+	server.chatConfigSetup()
+	server.accounts = account.NewStore(server.redis, server.openVault())
+
+	server.health = health.New()
+	server.health.Live("subscription", server.bus.Alive)
+	server.health.Ready("redis", func() error {
+		return server.redis.Ping().Err()
+	})
+	server.health.Ready("stream", server.bus.Ready)
+
+	if server.mongo != nil {
+		server.health.Ready("mongo", func() error {
+			// a copy gets a fresh socket, the shared session keeps a broken one
+			session := server.mongo.Copy()
+			defer session.Close()
+
+			return session.Ping()
+		})
+	}
+
+	server.handlers = &sync.WaitGroup{}
+	server.updates = lanes.New(server.config.poolSize, updatesPerLane)
+	server.subscription = make(chan struct{})
+	server.served = make(chan struct{})
+
 	go server.redisSetup()
-	go server.mongoConnect()
 
 	return &server
 }
 
+// serveHTTP serves metrics and health checks until ctx is cancelled, running
+// requests then get up to shutdownTimeout to finish
+func (server Server) serveHTTP(ctx context.Context) {
+	defer close(server.served)
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	server.health.Register(mux)
+
+	httpServer := &http.Server{
+		Addr:    server.config.httpAddr,
+		Handler: mux,
+	}
+
+	go func() {
+		<-ctx.Done()
+
+		timeout, cancel := context.WithTimeout(context.Background(), server.config.shutdownTimeout)
+		defer cancel()
+
+		err := httpServer.Shutdown(timeout)
+
+		if err != nil {
+			log.Printf("[ERROR] Couldn't stop serving HTTP: %s", err)
+		}
+	}()
+
+	err := httpServer.ListenAndServe()
+
+	if err != nil && err != http.ErrServerClosed {
+		log.Printf("[ERROR] Couldn't serve HTTP on %s: %s", server.config.httpAddr, err)
+	}
+}
+
 func (server Server) redisSetup() {
 	pong, err := server.redis.Ping().Result()
 
@@ -115,23 +271,17 @@ func (server Server) redisSetup() {
 		log.Printf("[DEBUG] got pong from redis %v", pong)
 	}
 
-	pubsub := server.redis.Subscribe(server.config.redis.channel)
-	ch := pubsub.Channel()
+	// albums left open by a restart, Subscribe only returns on shutdown
+	server.resumeGalleries()
 
-	status, err := pubsub.ReceiveTimeout(time.Second*time.Duration(10))
+	err = server.bus.Subscribe(server.handleRedis)
 
 	if err != nil {
-		log.Panicf("[ERROR] Couldn't subscribe to redis channel %s: %s",
-			server.config.redis.channel, err)
+		log.Panicf("[ERROR] Couldn't subscribe to redis stream %s: %s",
+			server.config.redis.stream, err)
 	}
 
-	log.Printf("[INFO] redis %v", status)
-
-	for message := range ch {
-		go func(messageVal *redis.Message){
-			server.handleRedis(messageVal)
-		}(message)
-	}
+	close(server.subscription)
 }
 
 func i18nSetup() (i18n.TranslateFunc, i18n.TranslateFunc) {
@@ -165,20 +315,41 @@ func config() *serverConfig {
 	viper.SetDefault(envTelegramBotSleep, 300)
 	viper.SetDefault(envTelegramDemoInstaURL, "https://instagram.com/instabeat7374")
 	viper.SetDefault(envTelegramDemoLandingUrl, "https://instabeat.ml/?utm_source=telegram")
-	viper.SetDefault(envTelegramMongoUrl, "localhost")
 	viper.SetDefault(envTelegramMongoDbName, "instabot")
+	viper.SetDefault(envTelegramChatConfigStore, "mongo")
+	viper.SetDefault(envTelegramChatConfigFile, "chats.json")
+	viper.SetDefault(envTelegramVaultKey, "")
+	viper.SetDefault(envTelegramVaultKeyFile, "")
+	viper.SetDefault(envTelegramVaultStore, "redis")
 	viper.SetDefault(envTelegramRedisAddr, "localhost:6379")
 	viper.SetDefault(envTelegramRedisPasswd, "")
 	viper.SetDefault(envTelegramRedisDb, 0)
-	viper.SetDefault(envTelegramRedisChannel, "message")
+	viper.SetDefault(envTelegramRedisStream, "message")
+	viper.SetDefault(envTelegramRedisGroup, "telegram")
+	viper.SetDefault(envTelegramRedisConsumer, "")
+	viper.SetDefault(envTelegramRedisClaimIdle, 60)
+	viper.SetDefault(envTelegramRedisMaxDeliveries, 5)
+	viper.SetDefault(envTelegramEnrichmentStages, "")
+	viper.SetDefault(envTelegramAdminChatIds, "")
+	viper.SetDefault(envTelegramHttpAddr, ":8080")
+	viper.SetDefault(envTelegramShutdownTimeout, 20)
+	viper.SetDefault(envTelegramPoolSize, 8)
+	viper.SetDefault(envTelegramAlbumWindow, 3)
+	viper.SetDefault(envTelegramVideoCoverOffset, 0)
+	viper.SetDefault(envTelegramDefaultTimezone, "UTC")
+	viper.SetDefault(envTelegramUpdateMode, updateModePolling)
+	viper.SetDefault(envTelegramWebhookUrl, "")
+	viper.SetDefault(envTelegramWebhookAddr, ":8443")
+	viper.SetDefault(envTelegramWebhookSecret, "")
+	viper.SetDefault(envTelegramWebhookCert, "")
+	viper.SetDefault(envTelegramWebhookKey, "")
+	viper.SetDefault(envTelegramWebhookSelfSigned, false)
+	viper.SetDefault(envTelegramQuotaDemo, "3,3")
+	viper.SetDefault(envTelegramQuotaBasic, "10,100")
+	viper.SetDefault(envTelegramQuotaPro, "50,1000")
 	viper.SetDefault(envLogLevel, "WARN")
 
-	filter := &logutils.LevelFilter{
-		Levels: []logutils.LogLevel{"VERBOSE", "DEBUG", "INFO", "WARN", "ERROR", "FATAL"},
-		MinLevel: logutils.LogLevel(viper.GetString(envLogLevel)),
-		Writer: os.Stderr,
-	}
-	log.SetOutput(filter)
+	logging.Setup("telegram", viper.GetString(envLogLevel))
 
 	if len(viper.GetString(envTelegramBotToken)) == 0 {
 		log.Fatal("[FATAL] Please provide a valid Telegram Bot token")
@@ -190,8 +361,70 @@ func config() *serverConfig {
 		timeout: viper.GetInt(envTelegramBotTimeout),
 		demoInstaURL: viper.GetString(envTelegramDemoInstaURL),
 		landingUrl: viper.GetString(envTelegramDemoLandingUrl),
+		httpAddr: viper.GetString(envTelegramHttpAddr),
+		shutdownTimeout: time.Second * time.Duration(viper.GetInt(envTelegramShutdownTimeout)),
+		poolSize: viper.GetInt(envTelegramPoolSize),
+		albumWindow: time.Second * time.Duration(viper.GetInt(envTelegramAlbumWindow)),
+		coverOffset: time.Duration(viper.GetFloat64(envTelegramVideoCoverOffset) * float64(time.Second)),
 		sleep: viper.GetInt(envTelegramBotSleep),
-		chatConfig: make(map[int64]ChatConfig),
+	}
+
+	timezone, err := time.LoadLocation(viper.GetString(envTelegramDefaultTimezone))
+
+	if err != nil {
+		log.Fatalf("[FATAL] Incorrect default time zone %s: %s",
+			viper.GetString(envTelegramDefaultTimezone), err)
+	}
+
+	conf.timezone = timezone
+
+	conf.updateMode = viper.GetString(envTelegramUpdateMode)
+
+	switch conf.updateMode {
+	case updateModePolling:
+	case updateModeWebhook:
+		webhookConfig(conf)
+	default:
+		log.Fatalf("[FATAL] Unknown update mode %s, use %s or %s", conf.updateMode,
+			updateModePolling, updateModeWebhook)
+	}
+
+	for _, stage := range strings.Split(viper.GetString(envTelegramEnrichmentStages), ",") {
+		if stage = strings.TrimSpace(stage); stage != "" {
+			conf.enrichmentStages = append(conf.enrichmentStages, stage)
+		}
+	}
+
+	conf.admins = make(map[int64]bool)
+
+	for _, chatId := range strings.Split(viper.GetString(envTelegramAdminChatIds), ",") {
+		if chatId = strings.TrimSpace(chatId); chatId == "" {
+			continue
+		}
+
+		id, err := strconv.ParseInt(chatId, 10, 64)
+
+		if err != nil {
+			log.Fatalf("[FATAL] Incorrect admin chat ID %s: %s", chatId, err)
+		}
+
+		conf.admins[id] = true
+	}
+
+	conf.plans = make(map[string]quota.Plan)
+
+	for name, env := range map[string]string{
+		quota.Demo: envTelegramQuotaDemo,
+		quota.Basic: envTelegramQuotaBasic,
+		quota.Pro: envTelegramQuotaPro,
+	} {
+		plan, err := quota.ParsePlan(name, viper.GetString(env))
+
+		if err != nil {
+			log.Fatalf("[FATAL] Incorrect quota in %s: %s", env, err)
+		}
+
+		conf.plans[name] = plan
 	}
 
 	tEn, tRu := i18nSetup()
@@ -201,209 +434,437 @@ func config() *serverConfig {
 
 	conf.redis.addr = viper.GetString(envTelegramRedisAddr)
 	conf.redis.passwd = viper.GetString(envTelegramRedisPasswd)
-	conf.redis.channel = viper.GetString(envTelegramRedisChannel)
+	conf.redis.stream = viper.GetString(envTelegramRedisStream)
+	conf.redis.group = viper.GetString(envTelegramRedisGroup)
+	conf.redis.consumer = viper.GetString(envTelegramRedisConsumer)
+	conf.redis.claimIdle = viper.GetInt(envTelegramRedisClaimIdle)
+	conf.redis.maxDeliveries = viper.GetInt(envTelegramRedisMaxDeliveries)
 	conf.redis.db = viper.GetInt(envTelegramRedisDb)
 
 	conf.mongo.url = viper.GetString(envTelegramMongoUrl)
 	conf.mongo.dbName = viper.GetString(envTelegramMongoDbName)
 
+	conf.chatConfig.store = viper.GetString(envTelegramChatConfigStore)
+	conf.chatConfig.file = viper.GetString(envTelegramChatConfigFile)
+
+	conf.vault.key = viper.GetString(envTelegramVaultKey)
+	conf.vault.keyFile = viper.GetString(envTelegramVaultKeyFile)
+	conf.vault.store = viper.GetString(envTelegramVaultStore)
+
+	if conf.vault.store == "mongo" && conf.mongo.url == "" {
+		log.Fatalf("[FATAL] Secrets are kept in mongo, please provide %s", envTelegramMongoUrl)
+	}
+
+	if conf.chatConfig.store == "mongo" && conf.mongo.url == "" {
+		log.Fatalf("[FATAL] Chat configs are kept in mongo, please provide %s", envTelegramMongoUrl)
+	}
+
 	return conf
 }
 
+func webhookConfig(conf *serverConfig) {
+	webhookUrl, err := url.Parse(viper.GetString(envTelegramWebhookUrl))
+
+	if err != nil || webhookUrl.Scheme != "https" || webhookUrl.Host == "" {
+		log.Fatalf("[FATAL] Please provide the https URL of the webhook in %s", envTelegramWebhookUrl)
+	}
+
+	if webhookUrl.Path == "" {
+		webhookUrl.Path = "/"
+	}
+
+	conf.webhook.url = webhookUrl
+	conf.webhook.addr = viper.GetString(envTelegramWebhookAddr)
+	conf.webhook.secret = viper.GetString(envTelegramWebhookSecret)
+	conf.webhook.cert = viper.GetString(envTelegramWebhookCert)
+	conf.webhook.key = viper.GetString(envTelegramWebhookKey)
+	conf.webhook.selfSigned = viper.GetBool(envTelegramWebhookSelfSigned)
+
+	if !secretTokenFormat.MatchString(conf.webhook.secret) {
+		log.Fatalf("[FATAL] Please provide a secret token of up to 256 letters, digits, _ and - in %s",
+			envTelegramWebhookSecret)
+	}
+
+	if (conf.webhook.cert == "") != (conf.webhook.key == "") {
+		log.Fatalf("[FATAL] Please provide both %s and %s, or neither", envTelegramWebhookCert,
+			envTelegramWebhookKey)
+	}
+
+	if conf.webhook.selfSigned && conf.webhook.cert == "" {
+		log.Fatalf("[FATAL] Please provide the self-signed certificate in %s", envTelegramWebhookCert)
+	}
+}
+
+// Start handles updates and serves HTTP until SIGTERM or SIGINT. It then
+// stops taking updates, messages and requests and gives running handlers up
+// to shutdownTimeout.
 func (server *Server) Start() {
+	ctx := shutdown.Context(context.Background())
+
+	go server.serveHTTP(ctx)
+	go server.scheduler.Run(ctx.Done())
+
+	if server.config.updateMode == updateModeWebhook {
+		server.listen(ctx)
+	} else {
+		server.removeWebhook()
+		server.poll(ctx)
+	}
+
+	deadline := time.Now().Add(server.config.shutdownTimeout)
+
+	log.Printf("[INFO] Stopped taking updates, waiting up to %s for running handlers",
+		server.config.shutdownTimeout)
+
+	if !shutdown.Wait(server.handlers, time.Until(deadline)) {
+		log.Printf("[WARN] Update handlers still running, leaving them behind")
+	}
+
+	server.updates.Close()
+
+	server.bus.Close()
+	<-server.subscription
+
+	// entries of handlers left behind stay pending, another consumer claims them
+	if !server.bus.Wait(time.Until(deadline)) {
+		log.Printf("[WARN] Message handlers still running, leaving them behind")
+	}
+
+	server.bus.Unsubscribe()
+	<-server.served
+}
+
+// poll feeds updates to handleUpdate until ctx is cancelled. Updates of the
+// same chat are handled in order, polling waits while handlers are busy.
+// Telegram considers an update delivered once updates are asked for with a
+// higher offset, so whatever wasn't queued is sent again after a restart.
+func (server *Server) poll(ctx context.Context) {
 	u := tgbotapi.NewUpdate(0) // get last updates from offset 0
 	u.Timeout = server.config.timeout
 
 	log.Printf("[DEBUG] started listening for telegram updates with timeout %d",
 		server.config.timeout)
 
-	updates, err := server.bot.GetUpdatesChan(u)
+	for {
+		result := make(chan []tgbotapi.Update, 1)
 
-	if err != nil {
-		log.Printf("[ERROR] Couldn't get updates from chan %s: %s", u, err)
+		go func(config tgbotapi.UpdateConfig) {
+			updates, err := server.bot.GetUpdates(config)
+
+			if err != nil {
+				log.Printf("[ERROR] Couldn't get updates, retrying in 3 seconds: %s", err)
+				time.Sleep(time.Second * 3)
+			}
+
+			result <- updates
+		}(u)
+
+		select {
+		case <-ctx.Done():
+			server.confirm(u.Offset)
+			return
+		case updates := <-result:
+			for _, update := range updates {
+				if update.UpdateID < u.Offset {
+					continue
+				}
+
+				server.handlers.Add(1)
+
+				if !server.updates.Submit(ctx.Done(), chatKey(update), server.handle(update)) {
+					server.handlers.Done()
+					server.confirm(u.Offset)
+					return
+				}
+
+				u.Offset = update.UpdateID + 1
+			}
+		}
 	}
+}
 
-	for update := range updates {
-		go func (updateVal tgbotapi.Update) {
-			server.handleUpdate(updateVal)
-		}(update)
+func (server *Server) handle(update tgbotapi.Update) func() {
+	return func() {
+		defer server.handlers.Done()
+		server.handleUpdate(update)
 	}
 }
 
-func (server Server) handleRedis(message *redis.Message) {
-	log.Printf("[VERBOSE] Got message from redis channel %s: %v",
-		server.config.redis.channel, message)
+// chatKey picks the lane of an update
+func chatKey(update tgbotapi.Update) string {
+	if update.Message != nil {
+		return strconv.FormatInt(update.Message.Chat.ID, 10)
+	}
 
-	var updateMsg metadata.ChannelMessage
-	err := json.Unmarshal([]byte(message.Payload), &updateMsg)
+	if update.CallbackQuery != nil && update.CallbackQuery.Message != nil {
+		return strconv.FormatInt(update.CallbackQuery.Message.Chat.ID, 10)
+	}
+
+	return strconv.Itoa(update.UpdateID)
+}
+
+// confirm tells telegram every update before offset was delivered, so the
+// ones being handled now don't come back after a restart
+func (server *Server) confirm(offset int) {
+	if offset == 0 {
+		return
+	}
+
+	_, err := server.bot.GetUpdates(tgbotapi.UpdateConfig{Offset: offset, Limit: 1})
 
 	if err != nil {
-		log.Printf("[ERROR] Couldn't decode JSON metadata, %s", message.Payload)
+		log.Printf("[ERROR] Couldn't confirm updates before %d: %s", offset, err)
 	}
+}
+
+func (server Server) handleRedis(updateMsg metadata.ChannelMessage) error {
+	logger := logging.ForMessage(updateMsg)
+
+	logger.Printf("[VERBOSE] Got message from redis stream %s: %v",
+		server.config.redis.stream, updateMsg)
 
 	switch updateMsg.Type {
 	case "NEW":
 		fallthrough
 	case "DONE":
-		log.Printf("[DEBUG] Got message from redis %v", updateMsg)
-
-		res, err := server.redis.HGetAll(updateMsg.PhotoId).Result()
+		logger.Printf("[DEBUG] Got message from redis %v", updateMsg)
 
-		if err != nil {
-			log.Printf("[ERROR] Couldn't hget from redis for ID %s: %s",
-				updateMsg.PhotoId, err)
-		}
-		log.Printf("[VERBOSE] Got from redis: %v", res)
+		server.closeOverdueGalleries()
 
-		var metaFromRedis metadata.PhotoMetadata
-		err = mapstructure.WeakDecode(res, &metaFromRedis)
+		metaFromRedis, err := server.getPhoto(logger, updateMsg.PhotoId)
 
-		if err != nil {
-			log.Printf("[ERROR] Couldn't map response from API to metadata struct: %s", err)
-			return
+		if metaFromRedis == nil {
+			return err
 		}
 
-		server.checkIfReady(metaFromRedis)
+		return server.checkIfReady(*metaFromRedis)
 	case "ERROR":
-		log.Printf("[DEBUG] Got message from redis %v", updateMsg)
+		logger.Printf("[DEBUG] Got message from redis %v", updateMsg)
 
-		res, err := server.redis.HGetAll(updateMsg.PhotoId).Result()
+		metaFromRedis, err := server.getPhoto(logger, updateMsg.PhotoId)
 
-		if err != nil {
-			log.Printf("[ERROR] Couldn't hget from redis for ID %s: %s",
-				updateMsg.PhotoId, err)
-		}
-		log.Printf("[VERBOSE] Got from redis: %v", res)
-
-		var metaFromRedis metadata.PhotoMetadata
-		err = mapstructure.WeakDecode(res, &metaFromRedis)
-
-		if err != nil {
-			log.Printf("[ERROR] Couldn't map response from API to metadata struct: %s", err)
-			return
+		if metaFromRedis == nil {
+			return err
 		}
 
 		msg := tgbotapi.NewMessage(metaFromRedis.ChatId,
-			server.t(metaFromRedis.ChatId, "publish_err", &struct {
+			server.t(metaFromRedis.ChatId, "photo_failed", &struct {
 				Error string
-			}{Error: updateMsg.Message}))
+				Attempts int
+			}{Error: updateMsg.Message, Attempts: metaFromRedis.Attempts}))
 		server.bot.Send(msg)
 	default:
-		log.Printf("[VERBOSE] Not interested in this message: %v", updateMsg)
+		logger.Printf("[VERBOSE] Not interested in this message: %v", updateMsg)
 	}
 
+	return nil
+}
+
+// getPhoto reads the photo record. A nil photo with nil error means there's
+// nothing to retry: the photo is gone or its record is broken.
+func (server Server) getPhoto(logger *log.Logger, photoId string) (*metadata.PhotoMetadata, error) {
+	photo, err := server.store.Get(photoId)
 
+	if err == metadata.ErrNotFound || metadata.IsDecodeError(err) {
+		logger.Printf("[ERROR] Couldn't get photo %s: %s", photoId, err)
+		return nil, nil
+	}
+
+	if err != nil {
+		logger.Printf("[ERROR] Couldn't get photo %s from redis: %s", photoId, err)
+		return nil, err
+	}
+
+	logger.Printf("[VERBOSE] Got from redis: %v", photo)
+
+	return &photo, nil
 }
 
-func (server Server) checkIfReady(photoMetadata metadata.PhotoMetadata) {
-	log.Printf("[VERBOSE] cheking metadata from redis: %v", photoMetadata)
-	currentChatConfig := server.config.chatConfig[photoMetadata.ChatId]
+func (server Server) checkIfReady(photoMetadata metadata.PhotoMetadata) error {
+	logger := logging.ForPhoto(photoMetadata)
 
-	if photoMetadata.Publish == false &&
-	photoMetadata.Published == false {
-		_, err := server.redis.HSet(photoMetadata.PhotoId, "publish", true).Result()
+	logger.Printf("[VERBOSE] cheking metadata from redis: %v", photoMetadata)
 
-		if err != nil {
-			log.Printf("[ERROR] Couldn't set photo %s for publishing: %s",
-				photoMetadata.PhotoId, err)
-			return
+	switch photoMetadata.State {
+	case metadata.StateNew:
+		if photoMetadata.IsGallery() {
+			return server.checkGallery(photoMetadata.PhotoId)
 		}
 
-		info := server.mergeCaptions(photoMetadata.Caption, photoMetadata.Hashtag)
+		updated, err := server.transition(photoMetadata.PhotoId,
+			metadata.StateNew, metadata.StateEnriching)
 
-		_, err = server.redis.HSet(photoMetadata.PhotoId, "final_caption", info).Result()
+		if metadata.IsTransitionError(err) {
+			logger.Printf("[DEBUG] %s", err)
+			return nil
+		}
 
 		if err != nil {
-			log.Printf("[ERROR] Couldn't set photo %s final_caption: %s",
-				photoMetadata.PhotoId, err)
-			return
+			logger.Printf("[ERROR] Couldn't start enriching photo %s: %s", photoMetadata.PhotoId, err)
+			return err
+		}
+
+		photoMetadata = updated
+		fallthrough
+	case metadata.StateEnriching:
+		if photoMetadata.IsGallery() {
+			return server.checkGallery(photoMetadata.PhotoId)
 		}
 
-		photoMetadata.FinalCaption = info
+		if !server.enriched(photoMetadata) {
+			logger.Printf("[VERBOSE] Not yet ready for publish %v", photoMetadata)
+			return nil
+		}
 
-		photoMetadata.Publish = true
+		if photoMetadata.GalleryId != "" {
+			return server.itemEnriched(photoMetadata)
+		}
 
-		var updateMesssage metadata.ChannelMessage
+		if photoMetadata.NSFWChecked && photoMetadata.NSFW {
+			return server.reject(photoMetadata)
+		}
 
-		updateMesssage.Type = "PUBLISH"
-		updateMesssage.PhotoId = photoMetadata.PhotoId
+		return server.awaitApproval(photoMetadata)
+	case metadata.StateAwaitingApproval:
+		if photoMetadata.PreviewMessageId == 0 {
+			// sending the preview failed last time
+			return server.sendPreview(photoMetadata)
+		}
+	case metadata.StatePublished:
+		logger.Printf("[INFO] Published %s.", photoMetadata.PhotoId)
 
-		meta, err := json.Marshal(&updateMesssage)
+		err := server.recordPost(photoMetadata)
 
 		if err != nil {
-			log.Printf("[ERROR] Couldn't encode JSON: %s", err)
+			logger.Printf("[ERROR] Couldn't record post %s in history: %s", photoMetadata.PhotoId, err)
+			return err
 		}
-		_, err = server.redis.Publish(server.config.redis.channel, meta).Result()
 
-		if err != nil {
-			log.Printf("[ERROR] Couldn't publish message to redis channel %s: %s",
-				server.config.redis.channel, err)
+		if photoMetadata.IsGallery() {
+			server.settleItems(photoMetadata)
 		}
 
 		msg := tgbotapi.NewMessage(photoMetadata.ChatId, server.t(photoMetadata.ChatId,
-				"all_fields_ready", struct {
-				Info string
-			}{Info: info}))
+			"published", struct {
+				Url string
+			}{Url: photoMetadata.PublishedUrl}))
 		server.bot.Send(msg)
-		return
-	} else {
-		log.Printf("[VERBOSE] Not yet ready for publish %v", photoMetadata)
+	default:
+		logger.Printf("[VERBOSE] Nothing to do for photo %s in state %s",
+			photoMetadata.PhotoId, photoMetadata.State)
 	}
 
-	if photoMetadata.Published {
-		log.Printf("[INFO] Published %s.", photoMetadata.PhotoId)
+	return nil
+}
 
-		if currentChatConfig.PhotoCount == 0 {
-			currentChatConfig.PhotoCount = 1
-		} else {
-			currentChatConfig.PhotoCount++
+// enriched tells whether every configured enrichment stage left its result
+func (server Server) enriched(photoMetadata metadata.PhotoMetadata) bool {
+	for _, stage := range server.config.enrichmentStages {
+		if !stageDone(photoMetadata, stage) {
+			return false
 		}
-		server.config.chatConfig[photoMetadata.ChatId] = currentChatConfig
+	}
 
-		msg := tgbotapi.NewMessage(photoMetadata.ChatId, server.t(photoMetadata.ChatId,
-			"published", struct {
-				Url string
-			}{Url: photoMetadata.PublishedUrl}))
-		server.bot.Send(msg)
+	return true
+}
+
+// stageDone tells whether an enrichment stage left its result
+func stageDone(photoMetadata metadata.PhotoMetadata, stage string) bool {
+	switch stage {
+	case "caption":
+		return len(photoMetadata.Caption) != 0
+	case "hashtag":
+		return len(photoMetadata.Hashtag) != 0
+	case "nsfw":
+		return photoMetadata.NSFWChecked
+	case "frame":
+		return photoMetadata.FramingChecked
 	}
 
-	if photoMetadata.NSFWChecked && photoMetadata.NSFW {
-		log.Printf("[INFO] NSFW detected %s! chatId: %s",
-			photoMetadata.PhotoId, photoMetadata.ChatId)
-		msg := tgbotapi.NewMessage(photoMetadata.ChatId, server.t(photoMetadata.ChatId,
-			"nsfw_detected"))
-		server.bot.Send(msg)
+	return true
+}
+
+func (server Server) reject(photoMetadata metadata.PhotoMetadata) error {
+	logger := logging.ForPhoto(photoMetadata)
+
+	_, err := server.transition(photoMetadata.PhotoId,
+		metadata.StateEnriching, metadata.StateRejected)
+
+	if metadata.IsTransitionError(err) {
+		logger.Printf("[DEBUG] %s", err)
+		return nil
+	}
+
+	if err != nil {
+		logger.Printf("[ERROR] Couldn't reject photo %s: %s", photoMetadata.PhotoId, err)
+		return err
 	}
+
+	metrics.Photos.WithLabelValues("rejected", "nsfw").Inc()
+
+	logger.Printf("[INFO] NSFW detected %s! chatId: %d",
+		photoMetadata.PhotoId, photoMetadata.ChatId)
+	msg := tgbotapi.NewMessage(photoMetadata.ChatId, server.t(photoMetadata.ChatId,
+		"nsfw_detected"))
+	server.bot.Send(msg)
+
+	return nil
+}
+
+// publish sends an approved photo to the instagram worker. Only the caller
+// that wins the READY -> PUBLISHING transition sends PUBLISH, so the
+// instagram worker is told exactly once.
+func (server Server) publish(photoMetadata metadata.PhotoMetadata) error {
+	logger := logging.ForPhoto(photoMetadata)
+
+	updated, err := server.transition(photoMetadata.PhotoId,
+		metadata.StateReady, metadata.StatePublishing, metadata.ChannelMessage{
+			Type: "PUBLISH",
+		})
+
+	if metadata.IsTransitionError(err) {
+		logger.Printf("[DEBUG] %s", err)
+		return nil
+	}
+
+	if err != nil {
+		logger.Printf("[ERROR] Couldn't set photo %s for publishing: %s",
+			photoMetadata.PhotoId, err)
+		return err
+	}
+
+	server.updatePreview(updated, server.t(updated.ChatId, "publish_ok"))
+
+	return nil
 }
 
 func (server *Server) handleUpdate(update tgbotapi.Update) {
-	log.Printf("[INFO] New update from chat %v @%s: %s",
-		update.Message.Chat.ID, update.Message.Chat.UserName, update.Message.Text)
+	metrics.TelegramUpdates.WithLabelValues(updateType(update)).Inc()
 
-	if len(update.Message.Text) != 0 {
-		server.handleText(update)
+	if update.CallbackQuery != nil {
+		server.handleCallback(update.CallbackQuery)
+		return
 	}
 
-	if update.Message.Document != nil || update.Message.Photo != nil {
-		currentChatConfig := server.config.chatConfig[update.Message.Chat.ID]
+	if update.Message == nil {
+		return
+	}
 
-		if !currentChatConfig.Registered && currentChatConfig.PhotoCount > 3 {
-			landingUrl := server.config.landingUrl+"&chat_id="+strconv.Itoa(int(update.Message.Chat.ID))
+	logger := logging.New(logging.Fields{ChatId: update.Message.Chat.ID})
 
-			msg := tgbotapi.NewMessage(update.Message.Chat.ID,
-				server.t(update.Message.Chat.ID, "demo_end_1"))
-			server.bot.Send(msg)
+	logger.Printf("[INFO] New update from chat %v @%s: %s",
+		update.Message.Chat.ID, update.Message.Chat.UserName, loggedText(update.Message))
 
-			time.Sleep(time.Millisecond * time.Duration(server.config.sleep))
+	if update.Message.ReplyToMessage != nil && len(update.Message.Text) != 0 &&
+		server.handleReply(update) {
+		return
+	}
 
-			msg = tgbotapi.NewMessage(update.Message.Chat.ID,
-				server.t(update.Message.Chat.ID, "demo_end_2", &struct {
-					LandingUrl string
-				}{LandingUrl: landingUrl}))
-			server.bot.Send(msg)
-			return
-		}
+	if len(update.Message.Text) != 0 {
+		server.handleText(update)
+	}
 
+	if update.Message.Document != nil || update.Message.Photo != nil || update.Message.Video != nil {
 		if update.Message.Document != nil {
 			server.handleDocument(update)
 		}
@@ -411,12 +872,40 @@ func (server *Server) handleUpdate(update tgbotapi.Update) {
 		if update.Message.Photo != nil {
 			server.handlePhoto(update)
 		}
+
+		if update.Message.Video != nil {
+			server.handleVideo(update)
+		}
+	}
+}
+
+// updateType names the kind of update for metrics
+func updateType(update tgbotapi.Update) string {
+	switch {
+	case update.CallbackQuery != nil:
+		return "callback"
+	case update.Message == nil:
+		return "other"
+	case update.Message.Photo != nil:
+		return "photo"
+	case update.Message.Document != nil:
+		return "document"
+	case update.Message.Video != nil:
+		return "video"
+	case update.Message.IsCommand():
+		return "command"
+	case len(update.Message.Text) != 0:
+		return "text"
 	}
+
+	return "other"
 }
 
 func (server *Server) handleText(update tgbotapi.Update) {
-	switch update.Message.Text {
-	case "/start":
+	logger := logging.New(logging.Fields{ChatId: update.Message.Chat.ID})
+
+	switch update.Message.Command() {
+	case "start":
 		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
 			server.t(update.Message.Chat.ID,"greeting", struct {
 				Person string
@@ -431,8 +920,8 @@ func (server *Server) handleText(update tgbotapi.Update) {
 			server.t(update.Message.Chat.ID, "switch_locale"))
 		msg.ParseMode = "markdown"
 		server.bot.Send(msg)
-	case "/ru":
-		log.Printf("[INFO] Change locale to ru-ru for chat %v", update.Message.Chat.ID)
+	case "ru":
+		logger.Printf("[INFO] Change locale to ru-ru for chat %v", update.Message.Chat.ID)
 		server.setLocale(update.Message.Chat.ID, "ru")
 
 		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
@@ -448,8 +937,8 @@ func (server *Server) handleText(update tgbotapi.Update) {
 
 		time.Sleep(time.Millisecond * time.Duration(server.config.sleep))
 		server.sendIntro1(update)
-	case "/en":
-		log.Printf("[INFO] Change locale to en-us for chat %v", update.Message.Chat.ID)
+	case "en":
+		logger.Printf("[INFO] Change locale to en-us for chat %v", update.Message.Chat.ID)
 		server.setLocale(update.Message.Chat.ID, "en")
 
 		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
@@ -465,12 +954,54 @@ func (server *Server) handleText(update tgbotapi.Update) {
 
 		time.Sleep(time.Millisecond * time.Duration(server.config.sleep))
 		server.sendIntro1(update)
-	case "/register":
-		log.Printf("[INFO] Request to register new user: %s", update.Message.Chat.UserName)
+	case "register":
+		logger.Printf("[INFO] Request to register new user: %s", update.Message.Chat.UserName)
 		server.registerUser(update)
 		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
 			server.t(update.Message.Chat.ID, "registered"))
 		server.bot.Send(msg)
+	case "caption", "tags":
+		server.editCommand(update)
+	case "frame":
+		server.frameCommand(update)
+	case "queue":
+		server.listQueue(update)
+	case "cancel":
+		server.cancelCommand(update)
+	case "schedule":
+		server.scheduleCommand(update)
+	case "scheduled":
+		server.listScheduled(update)
+	case "timezone":
+		server.timezoneCommand(update)
+	case "history":
+		server.historyCommand(update)
+	case "connect":
+		server.connectCommand(update)
+	case "disconnect":
+		server.disconnectCommand(update)
+	case "account":
+		server.accountCommand(update)
+	case "usage":
+		server.usageCommand(update)
+	case "plan":
+		server.planCommand(update)
+	case "retry":
+		server.retryFailed(update)
+	case "dead", "requeue":
+		if !server.config.admins[update.Message.Chat.ID] {
+			logger.Printf("[WARN] Chat %d isn't allowed to /%s", update.Message.Chat.ID,
+				update.Message.Command())
+			server.bot.Send(tgbotapi.NewMessage(update.Message.Chat.ID,
+				server.t(update.Message.Chat.ID, "meow")))
+			return
+		}
+
+		if update.Message.Command() == "dead" {
+			server.listDeadLetters(update)
+		} else {
+			server.requeue(update)
+		}
 	default:
 		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
 			server.t(update.Message.Chat.ID, "meow"))
@@ -478,11 +1009,106 @@ func (server *Server) handleText(update tgbotapi.Update) {
 	}
 }
 
+// retryFailed requeues every failed photo of the chat
+func (server *Server) retryFailed(update tgbotapi.Update) {
+	chatId := update.Message.Chat.ID
+	logger := logging.New(logging.Fields{ChatId: chatId})
+	photos, err := server.deadLetters.List(chatId, deadLettersPerList)
+
+	if err != nil {
+		logger.Printf("[ERROR] Couldn't list failed photos of chat %d: %s", chatId, err)
+		server.bot.Send(tgbotapi.NewMessage(chatId, server.t(chatId, "publish_err", struct {
+			Error error
+		}{Error: err})))
+		return
+	}
+
+	count := 0
+
+	for _, photo := range photos {
+		_, err := server.deadLetters.Requeue(photo.PhotoId)
+
+		if err != nil {
+			logger.Printf("[WARN] Couldn't requeue photo %s: %s", photo.PhotoId, err)
+			continue
+		}
+
+		count++
+	}
+
+	logger.Printf("[INFO] Requeued %d failed photos of chat %d", count, chatId)
+
+	if count == 0 {
+		server.bot.Send(tgbotapi.NewMessage(chatId, server.t(chatId, "retry_nothing")))
+		return
+	}
+
+	server.bot.Send(tgbotapi.NewMessage(chatId, server.t(chatId, "retry_ok", struct {
+		Count int
+	}{Count: count})))
+}
+
+// listDeadLetters shows operators the latest failures of every chat
+func (server *Server) listDeadLetters(update tgbotapi.Update) {
+	logger := logging.New(logging.Fields{ChatId: update.Message.Chat.ID})
+
+	photos, err := server.deadLetters.List(0, deadLettersPerList)
+
+	if err != nil {
+		logger.Printf("[ERROR] Couldn't list dead letters: %s", err)
+		server.bot.Send(tgbotapi.NewMessage(update.Message.Chat.ID, err.Error()))
+		return
+	}
+
+	if len(photos) == 0 {
+		server.bot.Send(tgbotapi.NewMessage(update.Message.Chat.ID, "No dead letters"))
+		return
+	}
+
+	lines := make([]string, 0, len(photos))
+
+	for _, photo := range photos {
+		lines = append(lines, fmt.Sprintf("%s chat %d, %s failed %d times at %s: %s",
+			photo.PhotoId, photo.ChatId, photo.FailedStage, photo.Attempts,
+			photo.EnteredAt(metadata.StateFailed).Format(time.RFC3339), photo.Error))
+	}
+
+	lines = append(lines, "Send /requeue <photo_id> to try again")
+
+	server.bot.Send(tgbotapi.NewMessage(update.Message.Chat.ID, strings.Join(lines, "\n\n")))
+}
+
+// requeue sends the photos given as arguments through the pipeline again
+func (server *Server) requeue(update tgbotapi.Update) {
+	logger := logging.New(logging.Fields{ChatId: update.Message.Chat.ID})
+
+	photoIds := strings.Fields(update.Message.CommandArguments())
+
+	if len(photoIds) == 0 {
+		server.bot.Send(tgbotapi.NewMessage(update.Message.Chat.ID,
+			"Usage: /requeue <photo_id> [<photo_id> ...]"))
+		return
+	}
+
+	for _, photoId := range photoIds {
+		reply := "Requeued " + photoId
+		_, err := server.deadLetters.Requeue(photoId)
+
+		if err != nil {
+			logger.Printf("[WARN] Couldn't requeue photo %s: %s", photoId, err)
+			reply = fmt.Sprintf("Couldn't requeue %s: %s", photoId, err)
+		} else {
+			logger.Printf("[INFO] Photo %s requeued by chat %d", photoId, update.Message.Chat.ID)
+		}
+
+		server.bot.Send(tgbotapi.NewMessage(update.Message.Chat.ID, reply))
+	}
+}
+
 func (server *Server) registerUser(update tgbotapi.Update) {
-	chatConfig := server.config.chatConfig[update.Message.Chat.ID]
-	chatConfig.Registered = true
-	server.config.chatConfig[update.Message.Chat.ID] = chatConfig
-	server.saveChatConfig(update.Message.Chat.ID)
+	server.updateChatConfig(update.Message.Chat.ID, func(chatConf *chatconfig.ChatConfig) {
+		chatConf.Registered = true
+	})
 }
 
 func (server *Server) sendIntro1(update tgbotapi.Update) {
@@ -508,11 +1134,23 @@ func (server *Server) sendIntro1(update tgbotapi.Update) {
 func (server *Server) handleDocument(update tgbotapi.Update) {
 	fileType := update.Message.Document.MimeType
 	fileId := update.Message.Document.FileID
+	correlationId := logging.NewCorrelationId()
+	logger := logging.New(logging.Fields{
+		PhotoId: fileId,
+		ChatId: update.Message.Chat.ID,
+		CorrelationId: correlationId,
+	})
 
-	log.Printf("[DEBUG] File type %s ID %s", fileType, fileId)
+	logger.Printf("[DEBUG] File type %s ID %s", fileType, fileId)
 
-	if fileType != "image/jpg" && fileType != "image/jpeg" {
-		log.Printf("[WARN] Wrong file type %s received", fileType)
+	if fileType == "video/mp4" {
+		server.handleVideoDocument(update)
+		return
+	}
+
+	if !media.IsStillImage(fileType) {
+		logger.Printf("[WARN] Wrong file type %s received", fileType)
+		metrics.Photos.WithLabelValues("rejected", "wrong_file_type").Inc()
 
 		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
 			server.t(update.Message.Chat.ID, "wrong_file_type", struct {
@@ -522,33 +1160,30 @@ func (server *Server) handleDocument(update tgbotapi.Update) {
 		return
 	}
 
-	photoUrl := server.getFileLink(fileId)
-	log.Printf("[INFO] Got photo from Telegram: %s", photoUrl)
-
-	_, err := server.pushPhoto(update.Message.Chat.ID, fileId, photoUrl)
-
-	if err != nil {
-		log.Printf("[ERROR] Couldn't publish photo %s: %s", photoUrl, err)
-		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
-			server.t(update.Message.Chat.ID, "publish_err", struct {
-				Error error
-			}{Error: err}))
-		server.bot.Send(msg)
-	}
-
+	server.handleImageDocument(update)
 }
 
 func (server *Server) handlePhoto(update tgbotapi.Update) {
 	photos := * update.Message.Photo
 	lastPhoto := photos[len(photos) -1] // get the biggest possible photo size
+	correlationId := logging.NewCorrelationId()
+	logger := logging.New(logging.Fields{
+		PhotoId: lastPhoto.FileID,
+		ChatId: update.Message.Chat.ID,
+		CorrelationId: correlationId,
+	})
 	photoUrl := server.getFileLink(lastPhoto.FileID)
 
-	log.Printf("[INFO] Got photo from Telegram: %s", photoUrl)
+	logger.Printf("[INFO] Got photo from Telegram: %s", photoUrl)
 
-	_, err := server.pushPhoto(update.Message.Chat.ID, lastPhoto.FileID, photoUrl)
+	err := server.pushPhoto(logger, update.Message, metadata.PhotoMetadata{
+		PhotoId: lastPhoto.FileID,
+		PhotoUrl: photoUrl,
+		CorrelationId: correlationId,
+	})
 
-	if err != nil {
-		log.Printf("[ERROR] Couldn't publish photo %s: %s", photoUrl, err)
+	if err != nil && err != errOverQuota {
+		logger.Printf("[ERROR] Couldn't publish photo %s: %s", photoUrl, err)
 		msg := tgbotapi.NewMessage(update.Message.Chat.ID,
 			server.t(update.Message.Chat.ID, "publish_err", struct {
 				Error error
@@ -557,46 +1192,86 @@ func (server *Server) handlePhoto(update tgbotapi.Update) {
 	}
 }
 
-func (server Server) pushPhoto(chatId int64, photoId, photoUrl string) (int64, error) {
-	updateMessage, err := json.Marshal(&metadata.ChannelMessage{
-		Type: "NEW",
-		PhotoId: photoId,
-	})
+// transition moves the photo, publishing messages in the same step
+func (server Server) transition(photoId string, from, to metadata.State,
+	messages ...metadata.ChannelMessage) (metadata.PhotoMetadata, error) {
 
-	log.Printf("[VERBOSE] JSON encoded metadata: %s", string(updateMessage))
-	if err != nil {
-		log.Printf("[ERROR] Couldn't encode photo metadata to JSON: %s", err)
-		return 0, err
-	}
+	return server.store.Update(photoId, func(photo *metadata.PhotoMetadata) error {
+		return photo.Transition(from, to)
+	}, messages...)
+}
 
-	_, err = server.redis.HSet(photoId, "photo_url", photoUrl).Result()
+// pushPhoto counts the photo of message against the quota of its chat,
+// records it and sends it down the pipeline. Photos of an album join its
+// gallery first, videos always go on their own. errOverQuota means the chat
+// was told it can't send more.
+func (server Server) pushPhoto(logger *log.Logger, message *tgbotapi.Message,
+	photo metadata.PhotoMetadata) error {
 
-	if err != nil {
-		log.Printf("[ERROR] Couldn't hset field %s: %s", "photo_url", err)
+	photoId := photo.PhotoId
+	photo.ChatId = message.Chat.ID
+	photo.MessageId = message.MessageID
+
+	if message.From != nil {
+		photo.UserId = int64(message.From.ID)
 	}
 
-	_, err = server.redis.HSet(photoId, "chat_id", chatId).Result()
+	err := server.takeQuota(logger, photo.ChatId)
+
+	if err == errOverQuota {
+		return err
+	}
 
 	if err != nil {
-		log.Printf("[ERROR] Couldn't hset field %s: %s", "chat_id", err)
+		metrics.Photos.WithLabelValues("rejected", "error").Inc()
+		return err
 	}
 
+	if message.MediaGroupID != "" && !photo.IsVideo() {
+		galleryId, err := server.collect(logger, message, photoId, photo.CorrelationId)
 
-	_, err = server.redis.HSet(photoId, "photo_id", photoId).Result()
+		if err != nil {
+			server.giveQuota(logger, photo.ChatId)
+			metrics.Photos.WithLabelValues("rejected", "error").Inc()
+			return err
+		}
 
-	if err != nil {
-		log.Printf("[ERROR] Couldn't hset field %s: %s", "photo_id", err)
+		photo.GalleryId = galleryId
+	}
+
+	// album photos are queued as their gallery
+	if photo.GalleryId == "" {
+		err := server.enqueue(photo.ChatId, photoId)
+
+		if err != nil {
+			logger.Printf("[WARN] Couldn't add photo %s to the queue of chat %d: %s",
+				photoId, photo.ChatId, err)
+		}
 	}
 
-	res, err := server.redis.Publish(server.config.redis.channel, updateMessage).Result()
+	// record and NEW message are written in one MULTI/EXEC, so either both
+	// make it to redis or neither does
+	err = server.store.Create(photo, metadata.ChannelMessage{
+		Type: "NEW",
+	})
+
+	if err != nil && photo.GalleryId != "" {
+		server.dropItem(logger, photo.GalleryId, photoId)
+	}
 
 	if err != nil {
-		log.Printf("[ERROR] Couldn't publish message to redis channel %s: %s",
-			server.config.redis.channel, err)
-		return 0, err
+		server.giveQuota(logger, photo.ChatId)
+		logger.Printf("[ERROR] Couldn't push photo %s to redis stream %s: %s",
+			photoId, server.config.redis.stream, err)
+		metrics.Photos.WithLabelValues("rejected", "error").Inc()
+		return err
 	}
 
-	return res, nil
+	metrics.Photos.WithLabelValues("accepted", "").Inc()
+
+	logger.Printf("[VERBOSE] Pushed photo %s", photoId)
+
+	return nil
 }
 
 func (server *Server) getFileLink(fileId string) string {
@@ -611,21 +1286,17 @@ func (server *Server) getFileLink(fileId string) string {
 }
 
 func (server Server) setLocale(chatId int64, locale string) {
-	chatConf := server.config.chatConfig[chatId]
-	chatConf.Locale = locale
-	log.Printf("[DEBUG] Set locale %v for chatId %v", locale, chatId)
-	server.config.chatConfig[chatId] = chatConf
+	logger := logging.New(logging.Fields{ChatId: chatId})
 
-	go server.saveChatConfig(chatId)
+	logger.Printf("[DEBUG] Set locale %v for chatId %v", locale, chatId)
+	server.updateChatConfig(chatId, func(chatConf *chatconfig.ChatConfig) {
+		chatConf.Locale = locale
+	})
 	// TODO Make sure hashtags and caption are translated
 }
 
-func (server Server) saveChatConfig(chatId int64) error {
-	chatConf := server.config.chatConfig[chatId]
-
-	chatConf.ChatId = chatId
-
-	log.Printf("[DEBUG] Saving chat config to mongo for %s: %v", chatId, chatConf)
+func (server *Server) mongoConnect() error {
+	log.Printf("[DEBUG] mongo url: %s", server.config.mongo.url)
 
 	session, err := mgo.Dial(server.config.mongo.url)
 
@@ -634,85 +1305,110 @@ func (server Server) saveChatConfig(chatId int64) error {
 		return err
 	}
 
-	// FIXME this doesn't work (not setting anything in db)
-	c := session.DB(server.config.mongo.dbName).C(mongoSettingsCollectionName)
-	err = c.Insert(chatConf)
+	log.Printf("[INFO] Connected to mongo!")
 
-	defer session.Close()
+	//defer session.Close()
 
-	if err != nil {
-		log.Printf("[ERROR] Couldn't set chat config for %s: %s", chatId, err)
-		return err
-	}
+	server.mongo = session
 
 	return nil
 }
 
-func (server Server) getChatLocale(chatId int64) (string, error) {
-	session, err := mgo.Dial(server.config.mongo.url)
+// chatConfigSetup opens the store chat configs are kept in and loads them
+func (server *Server) chatConfigSetup() {
+	var store chatconfig.Store
+	var err error
+
+	switch server.config.chatConfig.store {
+	case "mongo":
+		store, err = chatconfig.NewMongoStore(server.mongo, server.config.mongo.dbName,
+			mongoSettingsCollectionName)
+	case "file":
+		store, err = chatconfig.NewFileStore(server.config.chatConfig.file)
+	case "memory":
+		store = chatconfig.NewMemoryStore()
+	default:
+		log.Fatalf("[FATAL] Unknown chat config store %s", server.config.chatConfig.store)
+	}
 
 	if err != nil {
-		log.Fatalf("[ERROR] Couldn't connect to mongo, %s", err)
-		return "", err
+		log.Fatalf("[FATAL] Couldn't open %s chat config store: %s", server.config.chatConfig.store, err)
 	}
 
-	c := session.DB(server.config.mongo.dbName).C(mongoSettingsCollectionName)
+	server.chats = chatconfig.NewRepository(store)
+	count, err := server.chats.Load()
+
+	if err != nil {
+		log.Fatalf("[FATAL] Couldn't load chat configs: %s", err)
+	}
 
-	var result ChatConfig
-	err = c.Find(bson.M{"chatId":strconv.Itoa(int(chatId))}).One(&result)
+	log.Printf("[INFO] Loaded %d chat configs from %s", count, server.config.chatConfig.store)
+}
 
-	defer session.Close()
+// openVault opens the vault instagram passwords are kept in, nil without a
+// key. The instagram worker seals secrets of previous keys again.
+func (server Server) openVault() *vault.Vault {
+	key, _, err := vault.LoadKeys(server.config.vault.key, server.config.vault.keyFile, "")
 
 	if err != nil {
-		log.Printf("[ERROR] Couldn't find config for chat %s: %s", chatId, err)
-		return "", err
+		log.Fatalf("[FATAL] Couldn't load vault key: %s", err)
 	}
 
-	log.Printf("[VERBOSE] Found locale for chat %s: %s", chatId, result.Locale)
+	if key == nil {
+		log.Printf("[WARN] No vault key, chats can't connect instagram accounts")
+		return nil
+	}
 
-	return result.Locale, nil
-}
+	var backend vault.Backend
 
-func (server Server) mongoConnect() error {
-	log.Printf("[DEBUG] mongo url: %s", server.config.mongo.url)
+	switch server.config.vault.store {
+	case "redis":
+		backend = vault.NewRedisBackend(server.redis, vaultRedisKey)
+	case "mongo":
+		backend = vault.NewMongoBackend(server.mongo, server.config.mongo.dbName, mongoVaultCollectionName)
+	default:
+		log.Fatalf("[FATAL] Unknown vault store %s", server.config.vault.store)
+	}
 
-	session, err := mgo.Dial(server.config.mongo.url)
+	secrets, err := vault.New(backend, key)
 
 	if err != nil {
-		log.Fatalf("[ERROR] Couldn't connect to mongo, %s", err)
-		return err
+		log.Fatalf("[FATAL] Couldn't open vault: %s", err)
 	}
 
-	log.Printf("[INFO] Connected to mongo!")
+	return secrets
+}
 
-	//defer session.Close()
+// chatConfig returns the config of a chat, an empty one if it couldn't be read
+func (server Server) chatConfig(chatId int64) chatconfig.ChatConfig {
+	chatConf, err := server.chats.Get(chatId)
 
-	server.mongo = session
+	if err != nil {
+		log.Printf("[ERROR] Couldn't get config of chat %d: %s", chatId, err)
+	}
 
-	return nil
+	return chatConf
 }
 
-func (server Server) t(chatId int64, translationID string, args ...interface{}) string {
-	chatConf := server.config.chatConfig[chatId]
-	localeStr := chatConf.Locale
+// updateChatConfig changes the config of a chat with fn and saves it
+func (server Server) updateChatConfig(chatId int64, fn func(chatConf *chatconfig.ChatConfig)) {
+	logger := logging.New(logging.Fields{ChatId: chatId})
 
-	if localeStr == "" {
-		log.Printf("[DEBUG] Trying to get locale from mongo for %s before setting default en",
-			chatId)
+	chatConf, err := server.chats.Update(chatId, fn)
 
-		localeFromMongo, err := server.getChatLocale(chatId)
+	if err != nil {
+		logger.Printf("[ERROR] Couldn't save config of chat %d: %s", chatId, err)
+		return
+	}
 
-		if err != nil {
-			log.Printf("[ERROR] Couldn't get locale for chat, %s: %s", chatId, err)
-		}
+	logger.Printf("[DEBUG] Saved config of chat %d: %v", chatId, chatConf)
+}
 
-		if localeFromMongo == "" {
-			log.Printf("[DEBUG] Couldn't find locale for %s, setting default, en", chatId)
-			server.setLocale(chatId, "en")
-		} else {
-			server.setLocale(chatId, localeFromMongo)
-		}
-		return server.t(chatId, translationID, args...)
+func (server Server) t(chatId int64, translationID string, args ...interface{}) string {
+	localeStr := server.chatConfig(chatId).Locale
+
+	if localeStr == "" {
+		localeStr = "en"
 	}
 
 	tFunc := server.config.translation[localeStr]
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/nuxdie/instabot/logging"
+	"github.com/nuxdie/instabot/metadata"
+	"gopkg.in/telegram-bot-api.v4"
+)
+
+// the photos of a chat that were sent, scored by the unix time they arrived.
+// Photos that are done are dropped from it when /queue comes across them.
+const queueKeyPrefix = "telegram:queue:"
+const queuePerList = 20
+
+var errTooLate = errors.New("photo is being uploaded already")
+
+// stage names of the enrichment stages, as in TELEGRAM_ENRICHMENT_STAGES
+var stageNames = map[string]string{
+	"caption": "stage_caption",
+	"hashtag": "stage_hashtag",
+	"nsfw":    "stage_nsfw",
+	"frame":   "stage_frame",
+}
+
+func queueKey(chatId int64) string {
+	return queueKeyPrefix + strconv.FormatInt(chatId, 10)
+}
+
+// enqueue adds a photo, or a gallery, to the queue of its chat. It's called
+// before the record is created, a photo that didn't make it is dropped later.
+func (server Server) enqueue(chatId int64, photoId string) error {
+	return server.redis.ZAddNX(queueKey(chatId), redis.Z{
+		Score:  float64(time.Now().Unix()),
+		Member: photoId,
+	}).Err()
+}
+
+// listQueue sends every photo of the user that isn't done yet, with its
+// stage, its age and a button to cancel it. Admins of the chat list the
+// photos of everyone with /queue all.
+func (server *Server) listQueue(update tgbotapi.Update) {
+	chatId := update.Message.Chat.ID
+	logger := logging.New(logging.Fields{ChatId: chatId})
+	user := update.Message.From
+	all := strings.TrimSpace(update.Message.CommandArguments()) == "all"
+
+	if all && !server.isChatAdmin(logger, chatId, user) {
+		server.bot.Send(tgbotapi.NewMessage(chatId, server.t(chatId, "queue_all_admins")))
+		return
+	}
+
+	photoIds, err := server.redis.ZRange(queueKey(chatId), 0, -1).Result()
+
+	if err != nil {
+		logger.Printf("[ERROR] Couldn't list the queue of chat %d: %s", chatId, err)
+		server.bot.Send(tgbotapi.NewMessage(chatId, server.t(chatId, "publish_err", struct {
+			Error error
+		}{Error: err})))
+		return
+	}
+
+	listed := 0
+
+	for _, photoId := range photoIds {
+		photo, err := server.store.Get(photoId)
+
+		if err != nil && err != metadata.ErrNotFound {
+			logger.Printf("[ERROR] Couldn't get queued photo %s: %s", photoId, err)
+			continue
+		}
+
+		if err == metadata.ErrNotFound || photo.State.Final() {
+			server.redis.ZRem(queueKey(chatId), photoId)
+			continue
+		}
+
+		if !all && !sentBy(photo, user) {
+			continue
+		}
+
+		if listed == queuePerList {
+			continue
+		}
+
+		listed++
+		server.sendQueued(logger, photo)
+	}
+
+	if listed == 0 && all {
+		server.bot.Send(tgbotapi.NewMessage(chatId, server.t(chatId, "queue_empty_chat")))
+	} else if listed == 0 {
+		server.bot.Send(tgbotapi.NewMessage(chatId, server.t(chatId, "queue_empty")))
+	}
+}
+
+// sentBy tells whether user sent the photo. Photos recorded before their
+// senders were count as everybody's.
+func sentBy(photo metadata.PhotoMetadata, user *tgbotapi.User) bool {
+	return photo.UserId == 0 || user != nil && photo.UserId == int64(user.ID)
+}
+
+func (server Server) sendQueued(logger *log.Logger, photo metadata.PhotoMetadata) {
+	chatId := photo.ChatId
+
+	msg := tgbotapi.NewMessage(chatId, server.t(chatId, "queue_item", struct {
+		Stage string
+		Age   string
+		Id    string
+	}{
+		Stage: server.stage(photo),
+		Age:   age(time.Since(photo.EnteredAt(metadata.StateNew))),
+		Id:    photo.PhotoId,
+	}))
+	msg.ReplyToMessageID = photo.MessageId
+
+	if photo.State != metadata.StatePublishing {
+		msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(server.t(chatId, "button_cancel"), actionCancel),
+		))
+	}
+
+	sent, err := server.bot.Send(msg)
+
+	if err != nil {
+		logger.Printf("[ERROR] Couldn't send queued photo %s: %s", photo.PhotoId, err)
+		return
+	}
+
+	err = server.remember(chatId, sent.MessageID, replyTarget{PhotoId: photo.PhotoId})
+
+	if err != nil {
+		logger.Printf("[ERROR] Couldn't remember queued photo %s: %s", photo.PhotoId, err)
+	}
+}
+
+// stage tells users what a photo is waiting for
+func (server Server) stage(photo metadata.PhotoMetadata) string {
+	chatId := photo.ChatId
+
+	switch photo.State {
+	case metadata.StateEnriching:
+		pending := server.pendingStages(photo)
+
+		if len(pending) == 0 {
+			return server.t(chatId, "stage_enriched")
+		}
+
+		return server.t(chatId, "stage_enriching", struct {
+			Stages string
+		}{Stages: strings.Join(pending, ", ")})
+	case metadata.StateScheduled:
+		return server.scheduledText(photo)
+	}
+
+	return server.t(chatId, "stage_"+strings.ToLower(string(photo.State)))
+}
+
+// pendingStages names the enrichment stages that didn't leave their result
+// yet, galleries wait for their photos instead
+func (server Server) pendingStages(photo metadata.PhotoMetadata) []string {
+	if photo.IsGallery() {
+		return []string{server.t(photo.ChatId, "stage_items")}
+	}
+
+	var pending []string
+
+	for _, stage := range server.config.enrichmentStages {
+		if !stageDone(photo, stage) {
+			pending = append(pending, server.t(photo.ChatId, stageNames[stage]))
+		}
+	}
+
+	return pending
+}
+
+// cancelCommand cancels the photo given by ID, or the one of the message
+// it replies to
+func (server *Server) cancelCommand(update tgbotapi.Update) {
+	chatId := update.Message.Chat.ID
+	logger := logging.New(logging.Fields{ChatId: chatId})
+	photoId := strings.TrimSpace(update.Message.CommandArguments())
+
+	if photoId == "" && update.Message.ReplyToMessage != nil {
+		target, err := server.recall(chatId, update.Message.ReplyToMessage.MessageID)
+
+		if err != nil {
+			logger.Printf("[ERROR] Couldn't find out what message %d is about: %s",
+				update.Message.ReplyToMessage.MessageID, err)
+		}
+
+		if target != nil {
+			photoId = target.PhotoId
+		}
+	}
+
+	if photoId == "" {
+		server.bot.Send(tgbotapi.NewMessage(chatId, server.t(chatId, "cancel_usage")))
+		return
+	}
+
+	logger = logging.New(logging.Fields{ChatId: chatId, PhotoId: photoId})
+
+	if !server.mayHandle(logger, chatId, update.Message.From, photoId) {
+		server.bot.Send(tgbotapi.NewMessage(chatId, server.t(chatId, "photo_not_yours")))
+		return
+	}
+
+	server.bot.Send(tgbotapi.NewMessage(chatId, server.cancel(logger, chatId, photoId)))
+}
+
+// age rounds how long a photo is around to what's worth telling
+func age(duration time.Duration) string {
+	if duration < time.Minute {
+		return duration.Round(time.Second).String()
+	}
+
+	return strings.TrimSuffix(duration.Round(time.Minute).String(), "0s")
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/nuxdie/instabot/metadata"
+	"gopkg.in/telegram-bot-api.v4"
+)
+
+func TestSentBy(t *testing.T) {
+	user := &tgbotapi.User{ID: 42}
+
+	tests := []struct {
+		name   string
+		userId int64
+		user   *tgbotapi.User
+		want   bool
+	}{
+		{"sender", 42, user, true},
+		{"someone else", 7, user, false},
+		{"recorded without sender", 0, user, true},
+		{"no user", 42, nil, false},
+	}
+
+	for _, test := range tests {
+		photo := metadata.PhotoMetadata{PhotoId: "photo", UserId: test.userId}
+
+		if got := sentBy(photo, test.user); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nuxdie/instabot/chatconfig"
+	"github.com/nuxdie/instabot/logging"
+	"github.com/nuxdie/instabot/metrics"
+	"github.com/nuxdie/instabot/quota"
+	"gopkg.in/telegram-bot-api.v4"
+)
+
+// Every chat is on a plan that limits the photos it may send a day and a
+// month. Photos are counted once they passed the checks of the bot and are
+// recorded, whatever becomes of them later. Chats are on the demo plan until
+// they /register, operators move them to another one with /plan.
+
+// tells the chat handlers the chat was told already
+var errOverQuota = errors.New("quota used up")
+
+// plan is the plan of a chat, registered chats that never got one are on
+// the basic plan
+func (server Server) plan(chatId int64) quota.Plan {
+	chatConf := server.chatConfig(chatId)
+	name := chatConf.Plan
+
+	if name == "" && chatConf.Registered {
+		name = quota.Basic
+	}
+
+	if name == "" {
+		name = quota.Demo
+	}
+
+	plan, ok := server.config.plans[name]
+
+	if !ok {
+		log.Printf("[WARN] Chat %d is on unknown plan %s, counting it as %s", chatId, name, quota.Demo)
+		return server.config.plans[quota.Demo]
+	}
+
+	return plan
+}
+
+// takeQuota counts a photo of chatId against the plan of the chat. A chat
+// that used up its quota is told so and gets errOverQuota.
+func (server Server) takeQuota(logger *log.Logger, chatId int64) error {
+	plan := server.plan(chatId)
+
+	usage, taken, err := server.quotas.Take(chatId, plan)
+
+	if err != nil {
+		logger.Printf("[ERROR] Couldn't count a photo of chat %d: %s", chatId, err)
+		return err
+	}
+
+	if taken {
+		return nil
+	}
+
+	logger.Printf("[INFO] Chat %d used up the quota of plan %s", chatId, plan.Name)
+
+	if plan.Name != quota.Demo {
+		metrics.Photos.WithLabelValues("rejected", "quota").Inc()
+		server.bot.Send(tgbotapi.NewMessage(chatId, server.t(chatId, "quota_exceeded", struct {
+			Plan     string
+			ResetsAt string
+		}{Plan: server.planName(chatId, plan), ResetsAt: server.formatTime(chatId, usage.ResetsAt())})))
+		return errOverQuota
+	}
+
+	metrics.Photos.WithLabelValues("rejected", "demo_limit").Inc()
+	server.bot.Send(tgbotapi.NewMessage(chatId, server.t(chatId, "demo_end_1")))
+
+	time.Sleep(time.Millisecond * time.Duration(server.config.sleep))
+
+	landingUrl := server.config.landingUrl + "&chat_id=" + strconv.FormatInt(chatId, 10)
+	server.bot.Send(tgbotapi.NewMessage(chatId, server.t(chatId, "demo_end_2", struct {
+		LandingUrl string
+	}{LandingUrl: landingUrl})))
+
+	return errOverQuota
+}
+
+// giveQuota takes back a photo that was counted but couldn't be recorded
+func (server Server) giveQuota(logger *log.Logger, chatId int64) {
+	err := server.quotas.Give(chatId)
+
+	if err != nil {
+		logger.Printf("[ERROR] Couldn't take back a photo of chat %d from its quota: %s", chatId, err)
+	}
+}
+
+// usageCommand shows the plan of the chat, what's left of it and when it
+// resets
+func (server *Server) usageCommand(update tgbotapi.Update) {
+	chatId := update.Message.Chat.ID
+	logger := logging.New(logging.Fields{ChatId: chatId})
+	plan := server.plan(chatId)
+
+	usage, err := server.quotas.Usage(chatId, plan)
+
+	if err != nil {
+		logger.Printf("[ERROR] Couldn't get the quota usage of chat %d: %s", chatId, err)
+		server.bot.Send(tgbotapi.NewMessage(chatId, server.t(chatId, "publish_err", struct {
+			Error error
+		}{Error: err})))
+		return
+	}
+
+	lines := []string{
+		server.t(chatId, "usage_plan", struct {
+			Plan string
+		}{Plan: server.planName(chatId, plan)}),
+		server.usageLine(chatId, "usage_day", usage.Day, plan.Day, usage.DayLeft(), usage.DayResetsAt),
+		server.usageLine(chatId, "usage_month", usage.Month, plan.Month, usage.MonthLeft(),
+			usage.MonthResetsAt),
+	}
+
+	server.bot.Send(tgbotapi.NewMessage(chatId, strings.Join(lines, "\n")))
+}
+
+// usageLine renders the usage of a period, periods without a limit get the
+// _unlimited variant of id
+func (server Server) usageLine(chatId int64, id string, used, limit, left int,
+	resetsAt time.Time) string {
+
+	if limit == 0 {
+		return server.t(chatId, id+"_unlimited", struct {
+			Used int
+		}{Used: used})
+	}
+
+	return server.t(chatId, id, struct {
+		Used     int
+		Limit    int
+		Left     int
+		ResetsAt string
+	}{Used: used, Limit: limit, Left: left, ResetsAt: server.formatTime(chatId, resetsAt)})
+}
+
+func (server Server) planName(chatId int64, plan quota.Plan) string {
+	return server.t(chatId, "plan_"+plan.Name)
+}
+
+// planCommand moves a chat to another plan, for operators:
+// /plan <chat_id> <plan>
+func (server *Server) planCommand(update tgbotapi.Update) {
+	chatId := update.Message.Chat.ID
+	logger := logging.New(logging.Fields{ChatId: chatId})
+
+	if !server.config.admins[chatId] {
+		logger.Printf("[WARN] Chat %d isn't allowed to /plan", chatId)
+		server.bot.Send(tgbotapi.NewMessage(chatId, server.t(chatId, "meow")))
+		return
+	}
+
+	args := strings.Fields(update.Message.CommandArguments())
+
+	if len(args) != 2 {
+		server.bot.Send(tgbotapi.NewMessage(chatId, server.t(chatId, "plan_usage")))
+		return
+	}
+
+	target, err := strconv.ParseInt(args[0], 10, 64)
+
+	if err != nil {
+		server.bot.Send(tgbotapi.NewMessage(chatId, server.t(chatId, "plan_usage")))
+		return
+	}
+
+	plan, ok := server.config.plans[strings.ToLower(args[1])]
+
+	if !ok {
+		server.bot.Send(tgbotapi.NewMessage(chatId, server.t(chatId, "plan_unknown", struct {
+			Plan string
+		}{Plan: args[1]})))
+		return
+	}
+
+	server.updateChatConfig(target, func(chatConf *chatconfig.ChatConfig) {
+		chatConf.Plan = plan.Name
+	})
+
+	logger.Printf("[INFO] Chat %d moved chat %d to plan %s", chatId, target, plan.Name)
+	server.bot.Send(tgbotapi.NewMessage(chatId, server.t(chatId, "plan_set", struct {
+		ChatId int64
+		Plan   string
+	}{ChatId: target, Plan: server.planName(chatId, plan)})))
+}
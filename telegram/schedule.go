@@ -0,0 +1,299 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/nuxdie/instabot/chatconfig"
+	"github.com/nuxdie/instabot/logging"
+	"github.com/nuxdie/instabot/metadata"
+	"gopkg.in/telegram-bot-api.v4"
+)
+
+// callback data of the schedule buttons, answered like an edit prompt
+const actionSchedule = "schedule"
+
+var errBadTime = errors.New("unknown time format")
+var errPastTime = errors.New("time is in the past")
+
+// time formats users may schedule with, besides "in <duration>"
+const dateTimeLayout = "2006-01-02 15:04"
+const dayMonthLayout = "02.01 15:04"
+const clockLayout = "15:04"
+
+// days words may start a time with
+var dayOffsets = map[string]int{
+	"today":    0,
+	"сегодня":  0,
+	"tomorrow": 1,
+	"завтра":   1,
+}
+
+// chatLocation is the time zone a chat schedules in
+func (server Server) chatLocation(chatId int64) *time.Location {
+	name := server.chatConfig(chatId).Timezone
+
+	if name == "" {
+		return server.config.timezone
+	}
+
+	location, err := time.LoadLocation(name)
+
+	if err != nil {
+		log.Printf("[WARN] Couldn't load time zone %s of chat %d: %s", name, chatId, err)
+		return server.config.timezone
+	}
+
+	return location
+}
+
+func (server Server) setTimezone(chatId int64, timezone string) {
+	logger := logging.New(logging.Fields{ChatId: chatId})
+
+	logger.Printf("[DEBUG] Set time zone %v for chatId %v", timezone, chatId)
+	server.updateChatConfig(chatId, func(chatConf *chatconfig.ChatConfig) {
+		chatConf.Timezone = timezone
+	})
+}
+
+// timezoneCommand shows or sets the time zone of the chat
+func (server *Server) timezoneCommand(update tgbotapi.Update) {
+	chatId := update.Message.Chat.ID
+	name := strings.TrimSpace(update.Message.CommandArguments())
+
+	if name == "" {
+		server.bot.Send(tgbotapi.NewMessage(chatId, server.t(chatId, "timezone_usage", struct {
+			Timezone string
+		}{Timezone: server.chatLocation(chatId).String()})))
+		return
+	}
+
+	location, err := time.LoadLocation(name)
+
+	if err != nil || name == "Local" {
+		server.bot.Send(tgbotapi.NewMessage(chatId, server.t(chatId, "timezone_unknown", struct {
+			Timezone string
+		}{Timezone: name})))
+		return
+	}
+
+	server.setTimezone(chatId, location.String())
+	server.bot.Send(tgbotapi.NewMessage(chatId, server.t(chatId, "timezone_set", struct {
+		Timezone string
+	}{Timezone: location.String()})))
+}
+
+// scheduleCommand handles /schedule sent on its own, it schedules the photo
+// of the latest preview
+func (server *Server) scheduleCommand(update tgbotapi.Update) {
+	chatId := update.Message.Chat.ID
+	logger := logging.New(logging.Fields{ChatId: chatId})
+	text := update.Message.CommandArguments()
+
+	if strings.TrimSpace(text) == "" {
+		server.bot.Send(tgbotapi.NewMessage(chatId, server.t(chatId, "schedule_usage", struct {
+			Timezone string
+		}{Timezone: server.chatLocation(chatId).String()})))
+		return
+	}
+
+	photoId, err := server.redis.Get(previewKey(chatId)).Result()
+
+	if err == redis.Nil {
+		server.bot.Send(tgbotapi.NewMessage(chatId, server.t(chatId, "nothing_to_edit")))
+		return
+	}
+
+	if err != nil {
+		logger.Printf("[ERROR] Couldn't find the latest preview of chat %d: %s", chatId, err)
+		server.bot.Send(tgbotapi.NewMessage(chatId, server.t(chatId, "edit_err", struct {
+			Error error
+		}{Error: err})))
+		return
+	}
+
+	logger = logging.New(logging.Fields{ChatId: chatId, PhotoId: photoId})
+
+	if !server.mayHandle(logger, chatId, update.Message.From, photoId) {
+		server.bot.Send(tgbotapi.NewMessage(chatId, server.t(chatId, "photo_not_yours")))
+		return
+	}
+
+	server.applySchedule(logger, chatId, photoId, text)
+}
+
+// applySchedule schedules a photo for the time in text and tells the user
+// how it went
+func (server Server) applySchedule(logger *log.Logger, chatId int64, photoId, text string) {
+	location := server.chatLocation(chatId)
+	at, err := parseTime(text, time.Now().In(location))
+
+	if err == errPastTime {
+		server.bot.Send(tgbotapi.NewMessage(chatId, server.t(chatId, "schedule_past")))
+		return
+	}
+
+	if err != nil {
+		server.bot.Send(tgbotapi.NewMessage(chatId, server.t(chatId, "schedule_bad_time", struct {
+			Text string
+		}{Text: strings.TrimSpace(text)})))
+		return
+	}
+
+	photo, err := server.scheduler.Schedule(photoId, at)
+
+	if metadata.IsTransitionError(err) {
+		logger.Printf("[DEBUG] %s", err)
+		server.bot.Send(tgbotapi.NewMessage(chatId, server.t(chatId, "photo_handled")))
+		return
+	}
+
+	if err == metadata.ErrNotFound {
+		server.bot.Send(tgbotapi.NewMessage(chatId, server.t(chatId, "photo_expired")))
+		return
+	}
+
+	if err != nil {
+		logger.Printf("[ERROR] Couldn't schedule photo %s: %s", photoId, err)
+		server.bot.Send(tgbotapi.NewMessage(chatId, server.t(chatId, "edit_err", struct {
+			Error error
+		}{Error: err})))
+		return
+	}
+
+	logger.Printf("[INFO] Scheduled photo %s for %s", photoId, at)
+
+	status := server.scheduledText(photo)
+	server.updatePreview(photo, status)
+	server.bot.Send(tgbotapi.NewMessage(chatId, status))
+}
+
+func (server Server) scheduledText(photoMetadata metadata.PhotoMetadata) string {
+	return server.t(photoMetadata.ChatId, "scheduled", struct {
+		Time string
+	}{Time: server.formatTime(photoMetadata.ChatId, time.Unix(photoMetadata.PublishAt, 0))})
+}
+
+func (server Server) formatTime(chatId int64, at time.Time) string {
+	location := server.chatLocation(chatId)
+
+	return at.In(location).Format(dateTimeLayout) + " (" + location.String() + ")"
+}
+
+// listScheduled sends every scheduled photo of the chat with buttons to
+// schedule it again or cancel it, a reply with a time schedules it again too
+func (server *Server) listScheduled(update tgbotapi.Update) {
+	chatId := update.Message.Chat.ID
+	logger := logging.New(logging.Fields{ChatId: chatId})
+	photos, err := server.scheduler.List(chatId)
+
+	if err != nil {
+		logger.Printf("[ERROR] Couldn't list scheduled photos of chat %d: %s", chatId, err)
+		server.bot.Send(tgbotapi.NewMessage(chatId, server.t(chatId, "publish_err", struct {
+			Error error
+		}{Error: err})))
+		return
+	}
+
+	if len(photos) == 0 {
+		server.bot.Send(tgbotapi.NewMessage(chatId, server.t(chatId, "scheduled_nothing")))
+		return
+	}
+
+	for _, photo := range photos {
+		msg := tgbotapi.NewMessage(chatId, server.scheduledText(photo)+"\n\n"+photo.FinalCaption)
+		msg.ReplyToMessageID = photo.MessageId
+		msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData(server.t(chatId, "button_reschedule"), actionSchedule),
+			tgbotapi.NewInlineKeyboardButtonData(server.t(chatId, "button_cancel"), actionCancel),
+		))
+
+		sent, err := server.bot.Send(msg)
+
+		if err != nil {
+			logger.Printf("[ERROR] Couldn't send scheduled photo %s: %s", photo.PhotoId, err)
+			continue
+		}
+
+		// replies to the list schedule the photo again
+		err = server.remember(chatId, sent.MessageID, replyTarget{PhotoId: photo.PhotoId,
+			Field: actionSchedule})
+
+		if err != nil {
+			logger.Printf("[ERROR] Couldn't remember scheduled photo %s: %s", photo.PhotoId, err)
+		}
+	}
+}
+
+// parseTime reads the time a user wants a photo published at: "18:30" (the
+// next one), "tomorrow 9:00", "2006-01-02 15:04", "02.01 15:04" or
+// "in 2h30m". Times are in the location of now.
+func parseTime(text string, now time.Time) (time.Time, error) {
+	text = strings.ToLower(strings.Join(strings.Fields(text), " "))
+
+	if strings.HasPrefix(text, "in ") {
+		delay, err := time.ParseDuration(strings.TrimPrefix(text, "in "))
+
+		if err != nil {
+			return time.Time{}, errBadTime
+		}
+
+		return future(now.Add(delay), now)
+	}
+
+	at, err := time.ParseInLocation(dateTimeLayout, text, now.Location())
+
+	if err == nil {
+		return future(at, now)
+	}
+
+	at, err = time.ParseInLocation(dayMonthLayout, text, now.Location())
+
+	if err == nil {
+		at = at.AddDate(now.Year()-at.Year(), 0, 0)
+
+		if at.Before(now) {
+			at = at.AddDate(1, 0, 0)
+		}
+
+		return future(at, now)
+	}
+
+	words := strings.SplitN(text, " ", 2)
+	days, dayGiven := dayOffsets[words[0]]
+
+	if dayGiven {
+		if len(words) < 2 {
+			return time.Time{}, errBadTime
+		}
+
+		text = words[1]
+	}
+
+	clock, err := time.Parse(clockLayout, text)
+
+	if err != nil {
+		return time.Time{}, errBadTime
+	}
+
+	at = time.Date(now.Year(), now.Month(), now.Day(), clock.Hour(), clock.Minute(), 0, 0,
+		now.Location()).AddDate(0, 0, days)
+
+	// a bare clock time means the next one
+	if !dayGiven && !at.After(now) {
+		at = at.AddDate(0, 0, 1)
+	}
+
+	return future(at, now)
+}
+
+func future(at, now time.Time) (time.Time, error) {
+	if !at.After(now) {
+		return time.Time{}, errPastTime
+	}
+
+	return at, nil
+}
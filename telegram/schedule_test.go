@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTime(t *testing.T) {
+	moscow := time.FixedZone("MSK", 3*60*60)
+	now := time.Date(2026, 10, 17, 14, 0, 0, 0, moscow)
+
+	tests := []struct {
+		text string
+		want time.Time
+		err  error
+	}{
+		{"18:30", time.Date(2026, 10, 17, 18, 30, 0, 0, moscow), nil},
+		{"9:00", time.Date(2026, 10, 18, 9, 0, 0, 0, moscow), nil},
+		{"14:00", time.Date(2026, 10, 18, 14, 0, 0, 0, moscow), nil},
+		{"today 18:30", time.Date(2026, 10, 17, 18, 30, 0, 0, moscow), nil},
+		{"today 9:00", time.Time{}, errPastTime},
+		{"tomorrow 9:00", time.Date(2026, 10, 18, 9, 0, 0, 0, moscow), nil},
+		{"  Tomorrow   9:00 ", time.Date(2026, 10, 18, 9, 0, 0, 0, moscow), nil},
+		{"завтра 9:00", time.Date(2026, 10, 18, 9, 0, 0, 0, moscow), nil},
+		{"сегодня 23:59", time.Date(2026, 10, 17, 23, 59, 0, 0, moscow), nil},
+		{"2026-10-20 09:00", time.Date(2026, 10, 20, 9, 0, 0, 0, moscow), nil},
+		{"2026-10-01 09:00", time.Time{}, errPastTime},
+		{"20.10 09:00", time.Date(2026, 10, 20, 9, 0, 0, 0, moscow), nil},
+		// a day of the year that's over means the next year
+		{"01.03 09:00", time.Date(2027, 3, 1, 9, 0, 0, 0, moscow), nil},
+		{"in 2h30m", time.Date(2026, 10, 17, 16, 30, 0, 0, moscow), nil},
+		{"IN 45m", time.Date(2026, 10, 17, 14, 45, 0, 0, moscow), nil},
+		{"in -1h", time.Time{}, errPastTime},
+		{"in a while", time.Time{}, errBadTime},
+		{"tomorrow", time.Time{}, errBadTime},
+		{"25:00", time.Time{}, errBadTime},
+		{"next week", time.Time{}, errBadTime},
+		{"", time.Time{}, errBadTime},
+	}
+
+	for _, test := range tests {
+		got, err := parseTime(test.text, now)
+
+		if err != test.err || !got.Equal(test.want) {
+			t.Errorf("%q: got %s, %v, want %s, %v", test.text, got, err, test.want, test.err)
+		}
+
+		if err == nil && got.Location() != moscow {
+			t.Errorf("%q: got time in %s, want %s", test.text, got.Location(), moscow)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/nuxdie/instabot/derivative"
+	"github.com/nuxdie/instabot/logging"
+	"github.com/nuxdie/instabot/media"
+	"github.com/nuxdie/instabot/metadata"
+	"github.com/nuxdie/instabot/metrics"
+	"gopkg.in/telegram-bot-api.v4"
+)
+
+// stages look at a frame of the video, taken with ffmpeg or, when that
+// fails, the thumbnail telegram made
+var errNoCover = errors.New("video has no cover frame")
+
+// handleVideo takes videos sent as videos, telegram tells what's in them
+func (server *Server) handleVideo(update tgbotapi.Update) {
+	video := update.Message.Video
+	chatId := update.Message.Chat.ID
+	correlationId := logging.NewCorrelationId()
+	logger := logging.New(logging.Fields{
+		PhotoId:       video.FileID,
+		ChatId:        chatId,
+		CorrelationId: correlationId,
+	})
+
+	err := media.Validate(media.Info{
+		Duration: time.Second * time.Duration(video.Duration),
+		Width:    video.Width,
+		Height:   video.Height,
+	}, int64(video.FileSize))
+
+	if err != nil {
+		server.rejectVideo(logger, chatId, err)
+		return
+	}
+
+	err = server.pushVideo(logger, update.Message, video.FileID, server.getFileLink(video.FileID), nil,
+		video.Thumbnail, video.Duration, correlationId)
+
+	if err != nil && err != errOverQuota {
+		server.rejectVideo(logger, chatId, err)
+	}
+}
+
+// handleVideoDocument takes MP4 files, they have to be downloaded to find out
+// what's in them
+func (server *Server) handleVideoDocument(update tgbotapi.Update) {
+	document := update.Message.Document
+	chatId := update.Message.Chat.ID
+	correlationId := logging.NewCorrelationId()
+	logger := logging.New(logging.Fields{
+		PhotoId:       document.FileID,
+		ChatId:        chatId,
+		CorrelationId: correlationId,
+	})
+
+	err := media.CheckSize(int64(document.FileSize))
+
+	if err != nil {
+		server.rejectVideo(logger, chatId, err)
+		return
+	}
+
+	videoUrl := server.getFileLink(document.FileID)
+	data, err := download(videoUrl)
+
+	if err != nil {
+		server.rejectVideo(logger, chatId, err)
+		return
+	}
+
+	// MP4 files keep their headers at the start or at the end
+	info, err := media.ProbeMP4(data)
+
+	if err != nil {
+		logger.Printf("[WARN] Couldn't read video %s: %s", document.FileID, err)
+		server.rejectVideo(logger, chatId, err)
+		return
+	}
+
+	err = media.Validate(info, int64(document.FileSize))
+
+	if err != nil {
+		server.rejectVideo(logger, chatId, err)
+		return
+	}
+
+	err = server.pushVideo(logger, update.Message, document.FileID, videoUrl, data,
+		document.Thumbnail, int(info.Duration/time.Second), correlationId)
+
+	if err != nil && err != errOverQuota {
+		server.rejectVideo(logger, chatId, err)
+	}
+}
+
+// pushVideo records a video with its cover frame. data is the video when it
+// was downloaded already.
+func (server Server) pushVideo(logger *log.Logger, message *tgbotapi.Message, fileId, videoUrl string,
+	data []byte, thumbnail *tgbotapi.PhotoSize, duration int, correlationId string) error {
+
+	logger.Printf("[INFO] Got video from Telegram: %s", videoUrl)
+
+	coverUrl, err := server.videoCover(logger, fileId, videoUrl, data, thumbnail, duration)
+
+	if err != nil {
+		return err
+	}
+
+	return server.pushPhoto(logger, message, metadata.PhotoMetadata{
+		PhotoId:       fileId,
+		PhotoUrl:      videoUrl,
+		CorrelationId: correlationId,
+		MediaType:     metadata.MediaVideo,
+		CoverUrl:      coverUrl,
+		Duration:      duration,
+	})
+}
+
+// videoCover takes the frame at the cover offset of a video, or the first one
+// of videos shorter than that, and stores it as a derivative. The thumbnail
+// telegram made is the fallback, it's small and not always there.
+func (server Server) videoCover(logger *log.Logger, fileId, videoUrl string, data []byte,
+	thumbnail *tgbotapi.PhotoSize, duration int) (string, error) {
+
+	offset := server.config.coverOffset
+
+	if offset >= time.Second*time.Duration(duration) {
+		offset = 0
+	}
+
+	var err error
+
+	if data == nil {
+		data, err = download(videoUrl)
+	}
+
+	var frame []byte
+
+	if err == nil {
+		frame, err = media.ExtractFrame(data, offset)
+	}
+
+	var coverUrl string
+
+	if err == nil {
+		coverUrl, err = derivative.Put(server.redis, fileId+":cover", frame)
+	}
+
+	if err == nil {
+		return coverUrl, nil
+	}
+
+	if thumbnail == nil {
+		logger.Printf("[WARN] Couldn't take the cover of video %s: %s", fileId, err)
+		return "", errNoCover
+	}
+
+	logger.Printf("[WARN] Couldn't take the cover of video %s, taking the thumbnail: %s", fileId, err)
+
+	return server.getFileLink(thumbnail.FileID), nil
+}
+
+// rejectVideo tells the user why a video won't be posted
+func (server Server) rejectVideo(logger *log.Logger, chatId int64, err error) {
+	if limit, ok := err.(*media.LimitError); ok {
+		logger.Printf("[WARN] Video doesn't fit Instagram: %s", err)
+		metrics.Photos.WithLabelValues("rejected", "video_limits").Inc()
+		server.bot.Send(tgbotapi.NewMessage(chatId, server.t(chatId, "video_"+limit.Limit, limit)))
+		return
+	}
+
+	if err == errNoCover || err == media.ErrNotMP4 {
+		logger.Printf("[WARN] Can't post video: %s", err)
+		metrics.Photos.WithLabelValues("rejected", "wrong_file_type").Inc()
+		server.bot.Send(tgbotapi.NewMessage(chatId, server.t(chatId, "video_unreadable")))
+		return
+	}
+
+	logger.Printf("[ERROR] Couldn't publish video: %s", err)
+	server.bot.Send(tgbotapi.NewMessage(chatId, server.t(chatId, "publish_err", struct {
+		Error error
+	}{Error: err})))
+}
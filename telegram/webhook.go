@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"time"
+
+	"gopkg.in/telegram-bot-api.v4"
+)
+
+// In webhook mode telegram posts every update to TELEGRAM_WEBHOOK_URL
+// instead of the bot polling for them, so any number of bots can run behind
+// a load balancer. Requests must carry the secret token the webhook was
+// registered with.
+
+const updateModePolling = "polling"
+const updateModeWebhook = "webhook"
+
+const secretTokenHeader = "X-Telegram-Bot-Api-Secret-Token"
+
+// telegram retries updates it couldn't deliver, the same update may arrive
+// twice and at another bot. Updates seen are remembered for as long as
+// telegram keeps them.
+const updateSeenKeyPrefix = "telegram:update:"
+const updateSeenTTL = 24 * time.Hour
+
+const webhookTimeout = 10 * time.Second // to read a request and write the response
+
+// secret tokens telegram accepts
+var secretTokenFormat = regexp.MustCompile(`^[A-Za-z0-9_-]{1,256}$`)
+
+// listen serves the webhook until ctx is cancelled. Updates are handled like
+// polled ones, once the webhook has stopped taking them none are submitted
+// anymore.
+func (server *Server) listen(ctx context.Context) {
+	err := server.setWebhook()
+
+	if err != nil {
+		log.Fatalf("[FATAL] Couldn't set webhook %s: %s", server.config.webhook.url, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(server.config.webhook.url.Path, server.webhookHandler(ctx))
+
+	httpServer := &http.Server{
+		Addr:         server.config.webhook.addr,
+		Handler:      mux,
+		ReadTimeout:  webhookTimeout,
+		WriteTimeout: webhookTimeout,
+	}
+
+	go func() {
+		var err error
+
+		if server.config.webhook.cert != "" {
+			err = httpServer.ListenAndServeTLS(server.config.webhook.cert, server.config.webhook.key)
+		} else {
+			err = httpServer.ListenAndServe()
+		}
+
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatalf("[FATAL] Couldn't serve webhook on %s: %s", server.config.webhook.addr, err)
+		}
+	}()
+
+	log.Printf("[INFO] Taking updates on webhook %s, listening on %s", server.config.webhook.url.Path,
+		server.config.webhook.addr)
+
+	<-ctx.Done()
+
+	// handlers stop submitting once ctx is done, this only waits for them to
+	// answer. The webhook stays set, telegram keeps updates until a bot is back.
+	timeout, cancel := context.WithTimeout(context.Background(), server.config.shutdownTimeout)
+	defer cancel()
+
+	err = httpServer.Shutdown(timeout)
+
+	if err != nil {
+		log.Printf("[ERROR] Couldn't stop webhook: %s", err)
+	}
+}
+
+// setWebhook registers the webhook with its secret token, uploading the
+// certificate when it's self-signed
+func (server Server) setWebhook() error {
+	webhook := server.config.webhook
+	params := map[string]string{
+		"url":          webhook.url.String(),
+		"secret_token": webhook.secret,
+	}
+
+	if webhook.selfSigned {
+		_, err := server.bot.UploadFile("setWebhook", params, "certificate", webhook.cert)
+		return err
+	}
+
+	values := url.Values{}
+
+	for key, value := range params {
+		values.Set(key, value)
+	}
+
+	_, err := server.bot.MakeRequest("setWebhook", values)
+
+	return err
+}
+
+// removeWebhook lets a bot switched back to polling get updates again
+func (server Server) removeWebhook() {
+	info, err := server.bot.GetWebhookInfo()
+
+	if err != nil {
+		log.Printf("[ERROR] Couldn't get webhook info: %s", err)
+		return
+	}
+
+	if !info.IsSet() {
+		return
+	}
+
+	log.Printf("[WARN] Removing webhook %s to poll for updates", info.URL)
+
+	_, err = server.bot.RemoveWebhook()
+
+	if err != nil {
+		log.Printf("[ERROR] Couldn't remove webhook: %s", err)
+	}
+}
+
+// webhookHandler checks the secret token and queues updates for
+// handleUpdate. Telegram sends an update again unless it gets a 2xx.
+func (server *Server) webhookHandler(ctx context.Context) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		token := r.Header.Get(secretTokenHeader)
+
+		if subtle.ConstantTimeCompare([]byte(token), []byte(server.config.webhook.secret)) != 1 {
+			log.Printf("[WARN] Webhook request from %s with wrong secret token", r.RemoteAddr)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		var update tgbotapi.Update
+		err := json.NewDecoder(r.Body).Decode(&update)
+
+		if err != nil {
+			log.Printf("[WARN] Couldn't decode webhook update: %s", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if !server.firstDelivery(update) {
+			log.Printf("[DEBUG] Update %d was delivered already", update.UpdateID)
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		server.handlers.Add(1)
+
+		if !server.updates.Submit(ctx.Done(), chatKey(update), server.handle(update)) {
+			server.handlers.Done()
+			server.redis.Del(updateSeenKey(update))
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// firstDelivery remembers an update and tells whether it's new. Updates
+// are handled when redis can't tell.
+func (server Server) firstDelivery(update tgbotapi.Update) bool {
+	first, err := server.redis.SetNX(updateSeenKey(update), 1, updateSeenTTL).Result()
+
+	if err != nil {
+		log.Printf("[ERROR] Couldn't check whether update %d was delivered already: %s",
+			update.UpdateID, err)
+		return true
+	}
+
+	return first
+}
+
+func updateSeenKey(update tgbotapi.Update) string {
+	return updateSeenKeyPrefix + strconv.Itoa(update.UpdateID)
+}
@@ -0,0 +1,104 @@
+package vault
+
+import (
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// MongoBackend keeps a document per sealed secret in a mongo collection,
+// the name is its _id
+type MongoBackend struct {
+	session    *mgo.Session
+	db         string
+	collection string
+}
+
+type sealedSecret struct {
+	Name   string `bson:"_id"`
+	Sealed string `bson:"sealed"`
+}
+
+func NewMongoBackend(session *mgo.Session, db, collection string) *MongoBackend {
+	return &MongoBackend{
+		session:    session,
+		db:         db,
+		collection: collection,
+	}
+}
+
+// secrets returns the collection on a copy of the session, a copy gets a
+// fresh socket while the shared session keeps a broken one
+func (backend *MongoBackend) secrets() (*mgo.Session, *mgo.Collection) {
+	session := backend.session.Copy()
+
+	return session, session.DB(backend.db).C(backend.collection)
+}
+
+func (backend *MongoBackend) Get(name string) (string, error) {
+	session, secrets := backend.secrets()
+	defer session.Close()
+
+	var secret sealedSecret
+	err := secrets.FindId(name).One(&secret)
+
+	if err == mgo.ErrNotFound {
+		return "", ErrNotFound
+	}
+
+	return secret.Sealed, err
+}
+
+func (backend *MongoBackend) Put(name, sealed string) error {
+	session, secrets := backend.secrets()
+	defer session.Close()
+
+	_, err := secrets.UpsertId(name, sealedSecret{Name: name, Sealed: sealed})
+
+	return err
+}
+
+func (backend *MongoBackend) Delete(name string) error {
+	session, secrets := backend.secrets()
+	defer session.Close()
+
+	err := secrets.RemoveId(name)
+
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+
+	return err
+}
+
+func (backend *MongoBackend) Swap(name, old, sealed string) (bool, error) {
+	session, secrets := backend.secrets()
+	defer session.Close()
+
+	err := secrets.Update(bson.M{"_id": name, "sealed": old}, bson.M{"$set": bson.M{"sealed": sealed}})
+
+	if err == mgo.ErrNotFound {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+func (backend *MongoBackend) Names() ([]string, error) {
+	session, secrets := backend.secrets()
+	defer session.Close()
+
+	var all []sealedSecret
+	err := secrets.Find(nil).Select(bson.M{"_id": 1}).All(&all)
+
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(all))
+
+	for _, secret := range all {
+		names = append(names, secret.Name)
+	}
+
+	return names, nil
+}
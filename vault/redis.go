@@ -0,0 +1,55 @@
+package vault
+
+import (
+	"github.com/go-redis/redis"
+)
+
+// sets a field of the hash only if it still holds the old value
+var swapScript = redis.NewScript(`
+if redis.call("HGET", KEYS[1], ARGV[1]) == ARGV[2] then
+	redis.call("HSET", KEYS[1], ARGV[1], ARGV[3])
+	return 1
+end
+return 0
+`)
+
+// RedisBackend keeps sealed secrets in one redis hash, by name
+type RedisBackend struct {
+	redis *redis.Client
+	key   string
+}
+
+func NewRedisBackend(client *redis.Client, key string) *RedisBackend {
+	return &RedisBackend{
+		redis: client,
+		key:   key,
+	}
+}
+
+func (backend *RedisBackend) Get(name string) (string, error) {
+	sealed, err := backend.redis.HGet(backend.key, name).Result()
+
+	if err == redis.Nil {
+		return "", ErrNotFound
+	}
+
+	return sealed, err
+}
+
+func (backend *RedisBackend) Put(name, sealed string) error {
+	return backend.redis.HSet(backend.key, name, sealed).Err()
+}
+
+func (backend *RedisBackend) Delete(name string) error {
+	return backend.redis.HDel(backend.key, name).Err()
+}
+
+func (backend *RedisBackend) Swap(name, old, sealed string) (bool, error) {
+	swapped, err := swapScript.Run(backend.redis, []string{backend.key}, name, old, sealed).Result()
+
+	return swapped == int64(1), err
+}
+
+func (backend *RedisBackend) Names() ([]string, error) {
+	return backend.redis.HKeys(backend.key).Result()
+}
@@ -0,0 +1,297 @@
+// this package keeps secrets encrypted with AES-GCM
+package vault
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// KeySize is the size of master keys, AES-256
+const KeySize = 32
+
+// sealed secrets are "v1:<key id>:<base64 of nonce and ciphertext>"
+const sealedVersion = "v1"
+
+var ErrNotFound = errors.New("secret not found")
+var ErrUnknownKey = errors.New("secret is sealed with a key the vault doesn't have")
+var ErrMalformed = errors.New("sealed secret is malformed")
+var ErrBadKey = fmt.Errorf("master keys must be %d bytes, base64 encoded", KeySize)
+
+// Backend stores sealed secrets by name, it never sees them in the clear
+type Backend interface {
+	// Get returns ErrNotFound for unknown names
+	Get(name string) (string, error)
+	Put(name, sealed string) error
+	// Delete doesn't mind unknown names
+	Delete(name string) error
+	// Swap replaces old with sealed, false when the secret isn't old anymore
+	Swap(name, old, sealed string) (bool, error)
+	Names() ([]string, error)
+}
+
+// Vault seals secrets with the current master key before they go to the
+// backend. Previous keys are kept to open secrets sealed before a rotation,
+// Rotate seals those again with the current key.
+type Vault struct {
+	backend Backend
+	current string // ID of the key secrets are sealed with
+	keys    map[string]cipher.AEAD
+}
+
+func New(backend Backend, current []byte, previous ...[]byte) (*Vault, error) {
+	vault := &Vault{
+		backend: backend,
+		keys:    make(map[string]cipher.AEAD),
+	}
+
+	for i, key := range append([][]byte{current}, previous...) {
+		if len(key) != KeySize {
+			return nil, ErrBadKey
+		}
+
+		block, err := aes.NewCipher(key)
+
+		if err != nil {
+			return nil, err
+		}
+
+		aead, err := cipher.NewGCM(block)
+
+		if err != nil {
+			return nil, err
+		}
+
+		id := keyId(key)
+		vault.keys[id] = aead
+
+		if i == 0 {
+			vault.current = id
+		}
+	}
+
+	return vault, nil
+}
+
+// ParseKey decodes a base64 master key
+func ParseKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+
+	if err != nil || len(key) != KeySize {
+		return nil, ErrBadKey
+	}
+
+	return key, nil
+}
+
+// ReadKey reads a base64 master key from a file
+func ReadKey(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer zero(data)
+
+	return ParseKey(string(data))
+}
+
+// keyId names a key in sealed secrets without giving it away
+func keyId(key []byte) string {
+	sum := sha256.Sum256(key)
+
+	return hex.EncodeToString(sum[:4])
+}
+
+// Put seals secret under name, replacing what was there. Callers should
+// zero secret once it's stored.
+func (vault *Vault) Put(name string, secret []byte) error {
+	sealed, err := vault.seal(name, secret)
+
+	if err != nil {
+		return err
+	}
+
+	return vault.backend.Put(name, sealed)
+}
+
+// Open hands the secret stored under name to fn. The secret is zeroed once
+// fn returns, fn mustn't keep it.
+func (vault *Vault) Open(name string, fn func(secret []byte) error) error {
+	sealed, err := vault.backend.Get(name)
+
+	if err != nil {
+		return err
+	}
+
+	secret, _, err := vault.open(name, sealed)
+
+	if err != nil {
+		return err
+	}
+
+	defer zero(secret)
+
+	return fn(secret)
+}
+
+func (vault *Vault) Delete(name string) error {
+	return vault.backend.Delete(name)
+}
+
+// Rotate seals every secret that isn't sealed with the current key again
+// and returns how many it sealed. Secrets changed meanwhile are left alone,
+// they're sealed with the current key already.
+func (vault *Vault) Rotate() (int, error) {
+	names, err := vault.backend.Names()
+
+	if err != nil {
+		return 0, err
+	}
+
+	rotated := 0
+
+	for _, name := range names {
+		sealed, err := vault.backend.Get(name)
+
+		if err == ErrNotFound {
+			continue
+		}
+
+		if err != nil {
+			return rotated, err
+		}
+
+		swapped, err := vault.reseal(name, sealed)
+
+		if err != nil {
+			return rotated, fmt.Errorf("couldn't rotate %s: %s", name, err)
+		}
+
+		if swapped {
+			rotated++
+		}
+	}
+
+	return rotated, nil
+}
+
+func (vault *Vault) reseal(name, sealed string) (bool, error) {
+	secret, id, err := vault.open(name, sealed)
+
+	if err != nil {
+		return false, err
+	}
+
+	defer zero(secret)
+
+	if id == vault.current {
+		return false, nil
+	}
+
+	resealed, err := vault.seal(name, secret)
+
+	if err != nil {
+		return false, err
+	}
+
+	return vault.backend.Swap(name, sealed, resealed)
+}
+
+// seal encrypts secret with the current key. The name is authenticated
+// along with it, so a sealed secret can't be passed off under another name.
+func (vault *Vault) seal(name string, secret []byte) (string, error) {
+	aead := vault.keys[vault.current]
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(secret)+aead.Overhead())
+
+	_, err := io.ReadFull(rand.Reader, nonce)
+
+	if err != nil {
+		return "", err
+	}
+
+	box := aead.Seal(nonce, nonce, secret, []byte(name))
+
+	return sealedVersion + ":" + vault.current + ":" + base64.StdEncoding.EncodeToString(box), nil
+}
+
+// open decrypts a sealed secret and tells which key it was sealed with
+func (vault *Vault) open(name, sealed string) ([]byte, string, error) {
+	parts := strings.SplitN(sealed, ":", 3)
+
+	if len(parts) != 3 || parts[0] != sealedVersion {
+		return nil, "", ErrMalformed
+	}
+
+	aead, ok := vault.keys[parts[1]]
+
+	if !ok {
+		return nil, "", ErrUnknownKey
+	}
+
+	box, err := base64.StdEncoding.DecodeString(parts[2])
+
+	if err != nil || len(box) < aead.NonceSize() {
+		return nil, "", ErrMalformed
+	}
+
+	secret, err := aead.Open(nil, box[:aead.NonceSize()], box[aead.NonceSize():], []byte(name))
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	return secret, parts[1], nil
+}
+
+func zero(data []byte) {
+	for i := range data {
+		data[i] = 0
+	}
+}
+
+// LoadKeys reads the current master key from keyFile, or from key when
+// there's no file, and the comma separated previous keys. Without either
+// the current key is nil.
+func LoadKeys(key, keyFile, previous string) ([]byte, [][]byte, error) {
+	var current []byte
+	var err error
+
+	switch {
+	case keyFile != "":
+		current, err = ReadKey(keyFile)
+	case key != "":
+		current, err = ParseKey(key)
+	}
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var previousKeys [][]byte
+
+	for _, encoded := range strings.Split(previous, ",") {
+		if strings.TrimSpace(encoded) == "" {
+			continue
+		}
+
+		previousKey, err := ParseKey(encoded)
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		previousKeys = append(previousKeys, previousKey)
+	}
+
+	return current, previousKeys, nil
+}
@@ -0,0 +1,273 @@
+package vault
+
+import (
+	"bytes"
+	"encoding/base64"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// mapBackend keeps sealed secrets in a map
+type mapBackend map[string]string
+
+func (backend mapBackend) Get(name string) (string, error) {
+	sealed, ok := backend[name]
+
+	if !ok {
+		return "", ErrNotFound
+	}
+
+	return sealed, nil
+}
+
+func (backend mapBackend) Put(name, sealed string) error {
+	backend[name] = sealed
+	return nil
+}
+
+func (backend mapBackend) Delete(name string) error {
+	delete(backend, name)
+	return nil
+}
+
+func (backend mapBackend) Swap(name, old, sealed string) (bool, error) {
+	if backend[name] != old {
+		return false, nil
+	}
+
+	backend[name] = sealed
+
+	return true, nil
+}
+
+func (backend mapBackend) Names() ([]string, error) {
+	names := make([]string, 0, len(backend))
+
+	for name := range backend {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names, nil
+}
+
+func testKey(fill byte) []byte {
+	return bytes.Repeat([]byte{fill}, KeySize)
+}
+
+func openSecret(vault *Vault, name string) ([]byte, error) {
+	var opened []byte
+
+	err := vault.Open(name, func(secret []byte) error {
+		opened = append([]byte(nil), secret...)
+		return nil
+	})
+
+	return opened, err
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name     string
+		current  []byte
+		previous [][]byte
+		err      error
+	}{
+		{"current only", testKey(1), nil, nil},
+		{"with previous", testKey(1), [][]byte{testKey(2), testKey(3)}, nil},
+		{"short current", testKey(1)[:16], nil, ErrBadKey},
+		{"short previous", testKey(1), [][]byte{testKey(2)[:31]}, ErrBadKey},
+		{"no current", nil, nil, ErrBadKey},
+	}
+
+	for _, test := range tests {
+		_, err := New(mapBackend{}, test.current, test.previous...)
+
+		if err != test.err {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.err)
+		}
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	tests := []struct {
+		encoded string
+		err     error
+	}{
+		{base64.StdEncoding.EncodeToString(testKey(1)), nil},
+		{base64.StdEncoding.EncodeToString(testKey(1)) + "\n", nil},
+		{base64.StdEncoding.EncodeToString(testKey(1)[:16]), ErrBadKey},
+		{"not base64!", ErrBadKey},
+		{"", ErrBadKey},
+	}
+
+	for _, test := range tests {
+		key, err := ParseKey(test.encoded)
+
+		if err != test.err {
+			t.Errorf("%q: got %v, want %v", test.encoded, err, test.err)
+		}
+
+		if err == nil && !bytes.Equal(key, testKey(1)) {
+			t.Errorf("%q: got key %x", test.encoded, key)
+		}
+	}
+}
+
+func TestSealOpen(t *testing.T) {
+	backend := mapBackend{}
+	vault, _ := New(backend, testKey(1))
+
+	err := vault.Put("account:42", []byte("hunter2"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(backend["account:42"], "hunter2") ||
+		!strings.HasPrefix(backend["account:42"], sealedVersion+":") {
+		t.Errorf("backend got %q", backend["account:42"])
+	}
+
+	secret, err := openSecret(vault, "account:42")
+
+	if err != nil || string(secret) != "hunter2" {
+		t.Errorf("got %q, %v, want hunter2", secret, err)
+	}
+
+	// sealed with a fresh nonce every time
+	sealed := backend["account:42"]
+	vault.Put("account:42", []byte("hunter2"))
+
+	if backend["account:42"] == sealed {
+		t.Errorf("sealing twice gave the same %q", sealed)
+	}
+}
+
+func TestOpenErrors(t *testing.T) {
+	backend := mapBackend{}
+	vault, _ := New(backend, testKey(1))
+	other, _ := New(mapBackend{}, testKey(2))
+
+	vault.Put("account:42", []byte("hunter2"))
+	sealed := backend["account:42"]
+	foreign, _ := other.seal("account:42", []byte("hunter2"))
+	parts := strings.SplitN(sealed, ":", 3)
+	box, _ := base64.StdEncoding.DecodeString(parts[2])
+	box[len(box)-1] ^= 1
+	tampered := parts[0] + ":" + parts[1] + ":" + base64.StdEncoding.EncodeToString(box)
+
+	tests := []struct {
+		name   string
+		sealed string
+		err    error
+	}{
+		{"unknown key", foreign, ErrUnknownKey},
+		{"plaintext", "hunter2", ErrMalformed},
+		{"other version", "v0" + strings.TrimPrefix(sealed, sealedVersion), ErrMalformed},
+		{"not base64", parts[0] + ":" + parts[1] + ":!!!", ErrMalformed},
+		{"too short", parts[0] + ":" + parts[1] + ":AAAA", ErrMalformed},
+	}
+
+	for _, test := range tests {
+		backend["test"] = test.sealed
+
+		_, err := openSecret(vault, "test")
+
+		if err != test.err {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.err)
+		}
+	}
+
+	// the name is authenticated, a secret can't be moved to another one
+	backend["account:43"] = sealed
+
+	if _, err := openSecret(vault, "account:43"); err == nil {
+		t.Errorf("opened account:42 as account:43")
+	}
+
+	backend["account:42"] = tampered
+
+	if _, err := openSecret(vault, "account:42"); err == nil {
+		t.Errorf("opened a tampered secret")
+	}
+
+	if _, err := openSecret(vault, "missing"); err != ErrNotFound {
+		t.Errorf("got %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestOpenZeroesSecret(t *testing.T) {
+	vault, _ := New(mapBackend{}, testKey(1))
+	vault.Put("account:42", []byte("hunter2"))
+
+	var kept []byte
+
+	vault.Open("account:42", func(secret []byte) error {
+		kept = secret
+		return nil
+	})
+
+	if !bytes.Equal(kept, make([]byte, len("hunter2"))) {
+		t.Errorf("secret is %q after Open returned", kept)
+	}
+}
+
+func TestRotate(t *testing.T) {
+	backend := mapBackend{}
+	old, _ := New(backend, testKey(1))
+
+	old.Put("account:1", []byte("one"))
+	old.Put("account:2", []byte("two"))
+
+	vault, _ := New(backend, testKey(2), testKey(1))
+	vault.Put("account:3", []byte("three"))
+
+	rotated, err := vault.Rotate()
+
+	if err != nil || rotated != 2 {
+		t.Fatalf("got %d rotated, %v, want 2", rotated, err)
+	}
+
+	// only the new key is needed now
+	current, _ := New(backend, testKey(2))
+
+	tests := []struct {
+		name   string
+		secret string
+	}{
+		{"account:1", "one"},
+		{"account:2", "two"},
+		{"account:3", "three"},
+	}
+
+	for _, test := range tests {
+		secret, err := openSecret(current, test.name)
+
+		if err != nil || string(secret) != test.secret {
+			t.Errorf("%s: got %q, %v, want %q", test.name, secret, err, test.secret)
+		}
+	}
+
+	rotated, err = vault.Rotate()
+
+	if err != nil || rotated != 0 {
+		t.Errorf("second rotation: got %d rotated, %v, want 0", rotated, err)
+	}
+}
+
+func TestRotateUnknownKey(t *testing.T) {
+	backend := mapBackend{}
+	lost, _ := New(backend, testKey(1))
+	lost.Put("account:1", []byte("one"))
+
+	vault, _ := New(backend, testKey(2))
+
+	_, err := vault.Rotate()
+
+	if err == nil || !strings.Contains(err.Error(), "account:1") {
+		t.Errorf("got %v, want an error about account:1", err)
+	}
+}